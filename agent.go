@@ -1,18 +1,30 @@
 package swarmgo
 
 import (
+	"fmt"
 	"strings"
 	"text/template"
 )
 
+// InstructionsFunc computes an agent's instructions for a request from the
+// run's context variables.
+type InstructionsFunc func(contextVariables map[string]interface{}) (string, error)
+
 // Agent defines the interface for an agent.
 type Agent interface {
 	GetName() string
 	GetInstructions() string
+	RenderInstructions(contextVariables map[string]interface{}) (string, error)
 	GetModel() LLM
 	GetValue(key string) any
 	GetFunctions() []AgentFunction
 	GetMemory() *MemoryStore
+	GetToolErrorPolicy() *ToolErrorPolicy
+	GetConfig() *ClientConfig
+	GetGenerationSettings() GenerationSettings
+	GetParallelToolCalls() bool
+	GetInputGuardrails() []InputGuardrail
+	GetOutputGuardrails() []OutputGuardrail
 
 	SetName(string)
 	SetInstructions(string)
@@ -25,15 +37,20 @@ type Agent interface {
 
 // BaseAgent is a basic implementation of the Agent interface.
 type BaseAgent struct {
-	name              string          // The model identifier.
-	model             LLM             // The LLM provider to use.
-	Config            *ClientConfig   // Provider-specific configuration.
-	instructions      string          // Static instructions for the agent.
-	Functions         []AgentFunction // A list of functions the agent can perform.
-	memory            *MemoryStore    // Memory store for the agent.
-	ParallelToolCalls bool
+	name              string           // The model identifier.
+	model             LLM              // The LLM provider to use.
+	Config            *ClientConfig    // Provider-specific configuration.
+	instructions      string           // Static instructions for the agent.
+	instructionsFunc  InstructionsFunc // Computes the instructions per request when set.
+	Functions         []AgentFunction  // A list of functions the agent can perform.
+	memory            *MemoryStore     // Memory store for the agent.
+	ParallelToolCalls bool             // Run the tool calls of one message concurrently.
 	instructionVars   map[string]interface{}
 	agentVars         map[string]interface{}
+	toolErrorPolicy   *ToolErrorPolicy   // Overrides the Swarm's tool error policy when set.
+	generation        GenerationSettings // Sampling settings sent with every request.
+	inputGuardrails   []InputGuardrail   // Checked before the agent's first completion in a run.
+	outputGuardrails  []OutputGuardrail  // Checked on the agent's final answer.
 }
 
 // Ensure BaseAgent implements the Agent interface.
@@ -62,6 +79,39 @@ func (a *BaseAgent) GetInstructions() string {
 	return result.String()
 }
 
+// RenderInstructions returns the instructions for a request. The
+// InstructionsFunc is used when set. Otherwise the instructions are rendered
+// as a text/template against the instruction variables, the agent's values
+// and the run's context variables, later sources taking precedence.
+func (a *BaseAgent) RenderInstructions(contextVariables map[string]interface{}) (string, error) {
+	if a.instructionsFunc != nil {
+		return a.instructionsFunc(contextVariables)
+	}
+
+	tmpl, err := template.New("instructions").Parse(a.instructions)
+	if err != nil {
+		return "", fmt.Errorf("failed to parse instructions of agent %s: %w", a.name, err)
+	}
+
+	data := make(map[string]interface{}, len(a.instructionVars)+len(a.agentVars)+len(contextVariables))
+	for _, vars := range []map[string]interface{}{a.instructionVars, a.agentVars, contextVariables} {
+		for k, v := range vars {
+			data[k] = v
+		}
+	}
+
+	var result strings.Builder
+	if err := tmpl.Execute(&result, data); err != nil {
+		return "", fmt.Errorf("failed to render instructions of agent %s: %w", a.name, err)
+	}
+	return result.String(), nil
+}
+
+// SetInstructionsFunc sets a function that computes the instructions per request.
+func (a *BaseAgent) SetInstructionsFunc(fn InstructionsFunc) {
+	a.instructionsFunc = fn
+}
+
 // GetModel returns the LLM model used by the agent.
 func (a *BaseAgent) GetModel() LLM {
 	return a.model
@@ -129,6 +179,57 @@ func (a *BaseAgent) GetFunctions() []AgentFunction {
 	return a.Functions
 }
 
+// GetParallelToolCalls reports whether the agent's tool calls may run concurrently.
+func (a *BaseAgent) GetParallelToolCalls() bool {
+	return a.ParallelToolCalls
+}
+
+// GetConfig returns the agent's client configuration, or nil to resolve the
+// client from its LLM settings.
+func (a *BaseAgent) GetConfig() *ClientConfig {
+	return a.Config
+}
+
+// GetToolErrorPolicy returns the agent's tool error policy, or nil to use the Swarm default.
+func (a *BaseAgent) GetToolErrorPolicy() *ToolErrorPolicy {
+	return a.toolErrorPolicy
+}
+
+// SetToolErrorPolicy overrides the Swarm's tool error policy for this agent.
+func (a *BaseAgent) SetToolErrorPolicy(policy *ToolErrorPolicy) {
+	a.toolErrorPolicy = policy
+}
+
+// GetGenerationSettings returns the agent's generation settings.
+func (a *BaseAgent) GetGenerationSettings() GenerationSettings {
+	return a.generation
+}
+
+// SetGenerationSettings sets the generation settings used for the agent's requests.
+func (a *BaseAgent) SetGenerationSettings(settings GenerationSettings) {
+	a.generation = settings
+}
+
+// GetInputGuardrails returns the agent's input guardrails.
+func (a *BaseAgent) GetInputGuardrails() []InputGuardrail {
+	return a.inputGuardrails
+}
+
+// AddInputGuardrail adds a guardrail checked before the agent's first completion in a run.
+func (a *BaseAgent) AddInputGuardrail(guardrail InputGuardrail) {
+	a.inputGuardrails = append(a.inputGuardrails, guardrail)
+}
+
+// GetOutputGuardrails returns the agent's output guardrails.
+func (a *BaseAgent) GetOutputGuardrails() []OutputGuardrail {
+	return a.outputGuardrails
+}
+
+// AddOutputGuardrail adds a guardrail checked on the agent's final answer.
+func (a *BaseAgent) AddOutputGuardrail(guardrail OutputGuardrail) {
+	a.outputGuardrails = append(a.outputGuardrails, guardrail)
+}
+
 // NewBaseAgent creates a new BaseAgent with initialized memory store.
 func NewBaseAgent(name string, instructions string, model LLM) *BaseAgent {
 	ag := &BaseAgent{
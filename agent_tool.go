@@ -0,0 +1,131 @@
+package swarmgo
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+
+	"github.com/wlevene/swarmgo/llm"
+)
+
+// SubRun records a nested run made by an agent tool
+type SubRun struct {
+	Agent      string      // Name of the agent that was run
+	ToolCallID string      // Tool call that started the run
+	Input      llm.Message // Message the nested run started with
+	Response   Response    // Messages, usage and nested runs of the run
+}
+
+// runScope carries the Swarm and options of a run to the tools it executes
+type runScope struct {
+	swarm *Swarm
+	opts  RunOptions
+}
+
+type runScopeKey struct{}
+
+// withRunScope returns ctx carrying the Swarm and options of the current run
+func withRunScope(ctx context.Context, s *Swarm, opts RunOptions) context.Context {
+	return context.WithValue(ctx, runScopeKey{}, runScope{swarm: s, opts: opts})
+}
+
+// AgentTool runs an agent as a tool. Each call starts a nested run with its
+// own history and returns the agent's final answer as the tool result;
+// control stays with the calling agent. The nested run shares the caller's
+// budget, middleware and approver, and its usage counts towards the caller's.
+type AgentTool struct {
+	BaseFunction
+	Agent Agent
+}
+
+var _ AgentFunction = (*AgentTool)(nil)
+
+// NewAgentTool wraps agent as a tool taking a single free-form input
+func NewAgentTool(agent Agent, description string) *AgentTool {
+	return newAgentTool(agent, description, map[string]interface{}{
+		"type": "object",
+		"properties": map[string]interface{}{
+			"input": map[string]interface{}{
+				"type":        "string",
+				"description": "Task for " + agent.GetName(),
+			},
+		},
+		"required": []interface{}{"input"},
+	}, false)
+}
+
+// NewAgentToolFor wraps agent as a tool whose parameters are derived from T.
+// The arguments are sent to the agent as a JSON user message.
+func NewAgentToolFor[T any](agent Agent, description string) (*AgentTool, error) {
+	format, err := ResponseFormatFor[T]()
+	if err != nil {
+		return nil, err
+	}
+	return newAgentTool(agent, description, format.Schema, true), nil
+}
+
+func newAgentTool(agent Agent, description string, parameters map[string]interface{}, structured bool) *AgentTool {
+	tool := &AgentTool{
+		BaseFunction: BaseFunction{
+			id:          "AgentTool",
+			name:        fmt.Sprintf("Ask%s", agent.GetName()),
+			description: description,
+			parameters:  parameters,
+		},
+		Agent: agent,
+	}
+	tool.ctxFn = func(ctx context.Context, call ToolCallInfo, args map[string]interface{}, contextVariables map[string]interface{}) Result {
+		return tool.run(ctx, call, args, contextVariables, structured)
+	}
+	return tool
+}
+
+// SetName renames the tool, e.g. to match the caller's instructions
+func (t *AgentTool) SetName(name string) *AgentTool {
+	t.name = name
+	return t
+}
+
+func (t *AgentTool) run(ctx context.Context, call ToolCallInfo, args map[string]interface{}, contextVariables map[string]interface{}, structured bool) Result {
+	scope, ok := ctx.Value(runScopeKey{}).(runScope)
+	if !ok {
+		return Result{Error: fmt.Errorf("agent tool %s must be called from a Swarm run", t.name)}
+	}
+
+	input := llm.Message{Role: llm.RoleUser}
+	if structured {
+		data, err := json.Marshal(args)
+		if err != nil {
+			return Result{Error: err}
+		}
+		input.Content = string(data)
+	} else {
+		input.Content = fmt.Sprint(args["input"])
+	}
+
+	// The nested run reads the caller's context variables but does not change them
+	nestedVariables := make(map[string]interface{}, len(contextVariables))
+	mergeContextVariables(nestedVariables, contextVariables)
+
+	parent := scope.opts
+	opts := defaultRunOptions()
+	opts.ContextVariables = nestedVariables
+	opts.Debug = parent.Debug
+	opts.LLMMiddleware = parent.LLMMiddleware
+	opts.ToolMiddleware = parent.ToolMiddleware
+	opts.Budget = parent.Budget
+	opts.ContextWindow = parent.ContextWindow
+	opts.Approval = parent.Approval
+
+	resp, err := scope.swarm.run(ctx, t.Agent, []llm.Message{input}, opts)
+	subRun := &SubRun{
+		Agent:      t.Agent.GetName(),
+		ToolCallID: call.ToolCallID,
+		Input:      input,
+		Response:   resp,
+	}
+	if err != nil {
+		return Result{Error: fmt.Errorf("agent %s failed: %w", t.Agent.GetName(), err), SubRun: subRun}
+	}
+	return Result{Success: true, Data: finalContent(resp.Messages), SubRun: subRun}
+}
@@ -0,0 +1,205 @@
+package swarmgo
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"strings"
+	"sync"
+
+	"github.com/wlevene/swarmgo/llm"
+)
+
+// ApprovalAction is the outcome of an approval request
+type ApprovalAction int
+
+const (
+	// ApprovalApprove runs the tool with the requested arguments
+	ApprovalApprove ApprovalAction = iota
+	// ApprovalReject skips the tool and reports the reason to the model
+	ApprovalReject
+	// ApprovalEdit runs the tool with replaced arguments
+	ApprovalEdit
+)
+
+// ApprovalRequest describes a tool call waiting for approval
+type ApprovalRequest struct {
+	Agent      Agent
+	ToolName   string
+	ToolCallID string
+	Args       map[string]interface{}
+}
+
+// ApprovalDecision answers an ApprovalRequest
+type ApprovalDecision struct {
+	Action ApprovalAction
+	Reason string                 // Sent to the model when the call is rejected
+	Args   map[string]interface{} // Arguments used instead of the requested ones with ApprovalEdit
+}
+
+// Approve approves a tool call as requested
+func Approve() ApprovalDecision {
+	return ApprovalDecision{Action: ApprovalApprove}
+}
+
+// Reject rejects a tool call; reason is reported to the model
+func Reject(reason string) ApprovalDecision {
+	return ApprovalDecision{Action: ApprovalReject, Reason: reason}
+}
+
+// EditArgs approves a tool call with replaced arguments
+func EditArgs(args map[string]interface{}) ApprovalDecision {
+	return ApprovalDecision{Action: ApprovalEdit, Args: args}
+}
+
+// ApprovalFunc decides on tool calls to functions that require approval. An
+// error stops the run.
+type ApprovalFunc func(ctx context.Context, req ApprovalRequest) (ApprovalDecision, error)
+
+// SetApprovalFunc sets how tool calls that require approval are approved.
+// Without one, such calls are rejected.
+func (s *Swarm) SetApprovalFunc(approve ApprovalFunc) {
+	s.approval = approve
+}
+
+// PendingApproval is an ApprovalRequest delivered over a channel. Exactly one
+// call to Respond is expected.
+type PendingApproval struct {
+	ApprovalRequest
+	reply chan ApprovalDecision
+}
+
+// Respond answers the pending request
+func (p *PendingApproval) Respond(decision ApprovalDecision) {
+	p.reply <- decision
+}
+
+// ApprovalChannel returns an ApprovalFunc that sends each request to requests
+// and waits for its Respond call, or for the run's context to be done.
+func ApprovalChannel(requests chan<- *PendingApproval) ApprovalFunc {
+	return func(ctx context.Context, req ApprovalRequest) (ApprovalDecision, error) {
+		pending := &PendingApproval{ApprovalRequest: req, reply: make(chan ApprovalDecision, 1)}
+		select {
+		case requests <- pending:
+		case <-ctx.Done():
+			return ApprovalDecision{}, ctx.Err()
+		}
+		select {
+		case decision := <-pending.reply:
+			return decision, nil
+		case <-ctx.Done():
+			return ApprovalDecision{}, ctx.Err()
+		}
+	}
+}
+
+// PromptApproval returns an ApprovalFunc that asks on out and reads the answer
+// from in: y approves, n rejects with an optional reason and edit reads new
+// JSON arguments. Prompts are serialized, so it is safe with parallel tool calls.
+func PromptApproval(in *bufio.Reader, out io.Writer) ApprovalFunc {
+	var mu sync.Mutex
+	readLine := func() (string, error) {
+		line, err := in.ReadString('\n')
+		if err != nil && (err != io.EOF || line == "") {
+			return "", err
+		}
+		return strings.TrimSpace(line), nil
+	}
+
+	return func(ctx context.Context, req ApprovalRequest) (ApprovalDecision, error) {
+		mu.Lock()
+		defer mu.Unlock()
+
+		args, _ := json.Marshal(req.Args)
+		for {
+			fmt.Fprintf(out, "\033[93mApprove %s(%s)?\033[0m [y/n/edit]: ", req.ToolName, args)
+			answer, err := readLine()
+			if err != nil {
+				return ApprovalDecision{}, fmt.Errorf("failed to read approval: %w", err)
+			}
+
+			switch strings.ToLower(answer) {
+			case "y", "yes":
+				return Approve(), nil
+			case "n", "no":
+				fmt.Fprint(out, "Reason (optional): ")
+				reason, err := readLine()
+				if err != nil {
+					return ApprovalDecision{}, fmt.Errorf("failed to read approval: %w", err)
+				}
+				if reason == "" {
+					reason = "rejected by the user"
+				}
+				return Reject(reason), nil
+			case "e", "edit":
+				fmt.Fprint(out, "New arguments (JSON): ")
+				line, err := readLine()
+				if err != nil {
+					return ApprovalDecision{}, fmt.Errorf("failed to read approval: %w", err)
+				}
+				var edited map[string]interface{}
+				if err := json.Unmarshal([]byte(line), &edited); err != nil {
+					fmt.Fprintf(out, "Invalid JSON: %v\n", err)
+					continue
+				}
+				return EditArgs(edited), nil
+			}
+		}
+	}
+}
+
+// approveToolCall consults approve when fn requires approval. It returns the
+// arguments to call fn with, or a non-empty reason when the call is rejected.
+// Edited arguments are written back to toolCall, so the history shows the
+// call that actually ran.
+func approveToolCall(ctx context.Context, approve ApprovalFunc, agent Agent, fn AgentFunction, toolCall *llm.ToolCall, args map[string]interface{}) (map[string]interface{}, string, error) {
+	if !requiresApproval(fn) {
+		return args, "", nil
+	}
+	if approve == nil {
+		return nil, "no approver is configured for this tool", nil
+	}
+
+	decision, err := approve(ctx, ApprovalRequest{
+		Agent:      agent,
+		ToolName:   fn.GetName(),
+		ToolCallID: toolCall.ID,
+		Args:       args,
+	})
+	if err != nil {
+		return nil, "", fmt.Errorf("approval of tool %s failed: %w", fn.GetName(), err)
+	}
+
+	switch decision.Action {
+	case ApprovalApprove:
+		return args, "", nil
+	case ApprovalEdit:
+		edited, err := json.Marshal(decision.Args)
+		if err != nil {
+			return nil, "", fmt.Errorf("invalid edited arguments for tool %s: %w", fn.GetName(), err)
+		}
+		toolCall.Function.Arguments = string(edited)
+		return decision.Args, "", nil
+	default:
+		reason := decision.Reason
+		if reason == "" {
+			reason = "rejected"
+		}
+		return nil, reason, nil
+	}
+}
+
+// rejectionContent renders a rejected tool call as the tool result sent to the model
+func rejectionContent(toolName, reason string) string {
+	content, err := json.Marshal(map[string]interface{}{
+		"rejected": true,
+		"tool":     toolName,
+		"reason":   reason,
+	})
+	if err != nil {
+		return fmt.Sprintf("Rejected: %s", reason)
+	}
+	return string(content)
+}
@@ -0,0 +1,180 @@
+package swarmgo
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/wlevene/swarmgo/llm"
+)
+
+// ErrBudgetExceeded is matched by the error returned when a run crosses a
+// limit of its Budget. Use errors.As with *BudgetExceededError for details.
+var ErrBudgetExceeded = errors.New("budget exceeded")
+
+// ErrUnpricedModel is returned when a Budget with a MaxCost is charged for a
+// model missing from its Pricing, since that cost cannot be checked
+var ErrUnpricedModel = errors.New("model missing from budget pricing")
+
+// BudgetLimit names a limit of a Budget
+type BudgetLimit string
+
+const (
+	BudgetTokens    BudgetLimit = "tokens"
+	BudgetCost      BudgetLimit = "cost"
+	BudgetDuration  BudgetLimit = "duration"
+	BudgetToolCalls BudgetLimit = "tool_calls"
+)
+
+// BudgetExceededError reports which limit a run crossed
+type BudgetExceededError struct {
+	Limit BudgetLimit
+	Used  float64 // Tokens, cost, seconds or tool calls, depending on Limit
+	Max   float64
+}
+
+func (e *BudgetExceededError) Error() string {
+	return fmt.Sprintf("%v: %s used %g of %g", ErrBudgetExceeded, e.Limit, e.Used, e.Max)
+}
+
+// Is makes errors.Is(err, ErrBudgetExceeded) match
+func (e *BudgetExceededError) Is(target error) bool {
+	return target == ErrBudgetExceeded
+}
+
+// BudgetLimits configures a Budget. Zero values mean no limit.
+type BudgetLimits struct {
+	MaxTokens    int
+	MaxCost      float64
+	Pricing      PricingTable // Prices used to estimate cost for MaxCost; every model used must be listed
+	MaxDuration  time.Duration
+	MaxToolCalls int
+}
+
+// Budget tracks the tokens, estimated cost, wall-clock time and tool calls
+// spent by the runs it is attached to. A budget may be shared by several runs,
+// e.g. every run of one tenant. Limits are checked before each completion and
+// before each turn's tool calls, and after each completion's usage is
+// recorded. The wall-clock limit counts from the budget's first use and also
+// cancels completions and tools still in progress when it runs out.
+type Budget struct {
+	mu        sync.Mutex
+	limits    BudgetLimits
+	started   time.Time
+	usage     UsageReport
+	toolCalls int
+}
+
+// NewBudget creates a budget with the given limits
+func NewBudget(limits BudgetLimits) *Budget {
+	return &Budget{limits: limits}
+}
+
+// Usage returns the usage recorded so far
+func (b *Budget) Usage() UsageReport {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	var usage UsageReport
+	usage.Merge(b.usage)
+	return usage
+}
+
+// ToolCalls returns the number of tool calls recorded so far
+func (b *Budget) ToolCalls() int {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.toolCalls
+}
+
+// Check returns a *BudgetExceededError if any limit has been crossed
+func (b *Budget) Check() error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.check()
+}
+
+// deadline starts the budget's clock and returns when MaxDuration runs out
+func (b *Budget) deadline() (time.Time, bool) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.started.IsZero() {
+		b.started = time.Now()
+	}
+	if b.limits.MaxDuration <= 0 {
+		return time.Time{}, false
+	}
+	return b.started.Add(b.limits.MaxDuration), true
+}
+
+// durationExceeded reports the crossed MaxDuration
+func (b *Budget) durationExceeded() error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return &BudgetExceededError{Limit: BudgetDuration, Used: time.Since(b.started).Seconds(), Max: b.limits.MaxDuration.Seconds()}
+}
+
+// checkModel fails when a completion with model could not be priced
+func (b *Budget) checkModel(model string) error {
+	if b.limits.MaxCost <= 0 {
+		return nil
+	}
+	if _, ok := b.limits.Pricing[model]; !ok {
+		return fmt.Errorf("%w: %q", ErrUnpricedModel, model)
+	}
+	return nil
+}
+
+// recordCompletion adds the usage of a completion, then checks the limits
+func (b *Budget) recordCompletion(agent, model string, usage llm.Usage) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.usage.Record(agent, model, usage)
+	return b.check()
+}
+
+// reserveToolCalls records n tool calls about to be made. It fails without
+// recording them if they would cross MaxToolCalls.
+func (b *Budget) reserveToolCalls(n int) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if err := b.check(); err != nil {
+		return err
+	}
+	if max := b.limits.MaxToolCalls; max > 0 && b.toolCalls+n > max {
+		return &BudgetExceededError{Limit: BudgetToolCalls, Used: float64(b.toolCalls + n), Max: float64(max)}
+	}
+	b.toolCalls += n
+	return nil
+}
+
+func (b *Budget) check() error {
+	if b.started.IsZero() {
+		b.started = time.Now()
+	}
+
+	limits := b.limits
+	if limits.MaxTokens > 0 && b.usage.Total.TotalTokens > limits.MaxTokens {
+		return &BudgetExceededError{Limit: BudgetTokens, Used: float64(b.usage.Total.TotalTokens), Max: float64(limits.MaxTokens)}
+	}
+	if limits.MaxCost > 0 {
+		estimate := b.usage.EstimateCost(limits.Pricing)
+		if len(estimate.Unpriced) > 0 {
+			return fmt.Errorf("%w: %s", ErrUnpricedModel, strings.Join(estimate.Unpriced, ", "))
+		}
+		if estimate.Total > limits.MaxCost {
+			return &BudgetExceededError{Limit: BudgetCost, Used: estimate.Total, Max: limits.MaxCost}
+		}
+	}
+	if limits.MaxDuration > 0 {
+		if elapsed := time.Since(b.started); elapsed > limits.MaxDuration {
+			return &BudgetExceededError{Limit: BudgetDuration, Used: elapsed.Seconds(), Max: limits.MaxDuration.Seconds()}
+		}
+	}
+	if limits.MaxToolCalls > 0 && b.toolCalls > limits.MaxToolCalls {
+		return &BudgetExceededError{Limit: BudgetToolCalls, Used: float64(b.toolCalls), Max: float64(limits.MaxToolCalls)}
+	}
+	return nil
+}
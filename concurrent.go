@@ -17,6 +17,7 @@ type ConcurrentResult struct {
 // ConcurrentSwarm manages concurrent execution of multiple agents
 type ConcurrentSwarm struct {
 	*Swarm
+	maxConcurrency int // Runs executed at the same time; zero means no limit
 }
 
 // NewConcurrentSwarm creates a new ConcurrentSwarm instance
@@ -26,6 +27,24 @@ func NewConcurrentSwarm(apiKey string, provider llm.LLMProvider) *ConcurrentSwar
 	}
 }
 
+// NewConcurrentSwarmFromConfig creates a new ConcurrentSwarm whose default client is built from cfg
+func NewConcurrentSwarmFromConfig(cfg ClientConfig) (*ConcurrentSwarm, error) {
+	swarm, err := NewSwarmFromConfig(cfg)
+	if err != nil {
+		return nil, err
+	}
+	return &ConcurrentSwarm{
+		Swarm: swarm,
+	}, nil
+}
+
+// SetMaxConcurrency limits how many agents RunConcurrent executes at the same
+// time; the others wait for a slot. Zero removes the limit. Provider rate
+// limits are set on the ProviderRegistry and hold across runs.
+func (cs *ConcurrentSwarm) SetMaxConcurrency(n int) {
+	cs.maxConcurrency = n
+}
+
 // AgentConfig holds the configuration for a single agent execution
 type AgentConfig struct {
 	Agent            Agent
@@ -36,6 +55,19 @@ type AgentConfig struct {
 	Debug            bool
 	MaxTurns         int
 	ExecuteTools     bool
+	Options          []RunOption // Applied after the fields above
+}
+
+// runOptions converts the config to run options
+func (c AgentConfig) runOptions() []RunOption {
+	return append([]RunOption{
+		WithContextVariables(c.ContextVariables),
+		WithModelOverride(c.ModelOverride),
+		WithStream(c.Stream),
+		WithDebug(c.Debug),
+		WithMaxTurns(c.MaxTurns),
+		WithExecuteTools(c.ExecuteTools),
+	}, c.Options...)
 }
 
 // RunConcurrent executes multiple agents concurrently and returns their results
@@ -49,27 +81,28 @@ func (cs *ConcurrentSwarm) RunConcurrent(ctx context.Context, configs map[string
 	// Create a channel for results to handle potential context cancellation
 	resultChan := make(chan ConcurrentResult, len(configs))
 
+	var slots chan struct{}
+	if cs.maxConcurrency > 0 {
+		slots = make(chan struct{}, cs.maxConcurrency)
+	}
+
 	// Start each agent in its own goroutine
 	for name, config := range configs {
 		wg.Add(1)
 		go func(name string, cfg AgentConfig) {
 			defer wg.Done()
 
-			resp, err := cs.Run(
-				ctx,
-				cfg.Agent,
-				cfg.Messages,
-				cfg.ContextVariables,
-				cfg.ModelOverride,
-				cfg.Stream,
-				cfg.Debug,
-				cfg.MaxTurns,
-				cfg.ExecuteTools,
-			)
-			result := ConcurrentResult{
-				AgentName: name,
-				Response:  resp,
-				Error:     err,
+			result := ConcurrentResult{AgentName: name}
+			if slots != nil {
+				select {
+				case slots <- struct{}{}:
+					defer func() { <-slots }()
+				case <-ctx.Done():
+					result.Error = ctx.Err()
+				}
+			}
+			if result.Error == nil {
+				result.Response, result.Error = cs.RunWithOptions(ctx, cfg.Agent, cfg.Messages, cfg.runOptions()...)
 			}
 
 			select {
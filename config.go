@@ -19,4 +19,23 @@ type ClientConfig struct {
 	HTTPClient         *http.Client
 	EmptyMessagesLimit uint
 	Options            map[string]interface{} // Additional provider-specific options
+	Retry              *llm.RetryPolicy       // Retries failed requests; nil disables retries
+	RateLimiter        *llm.RateLimiter       // Overrides the registry's shared limiter for the provider and key
+}
+
+// llmConfig converts the configuration to the settings used by the llm package
+func (c *ClientConfig) llmConfig() llm.Config {
+	return llm.Config{
+		APIKey:             c.AuthToken,
+		BaseURL:            c.BaseURL,
+		OrgID:              c.OrgID,
+		APIVersion:         c.APIVersion,
+		AssistantVersion:   c.AssistantVersion,
+		HTTPClient:         c.HTTPClient,
+		ModelMapperFunc:    c.ModelMapperFunc,
+		EmptyMessagesLimit: c.EmptyMessagesLimit,
+		Options:            c.Options,
+		Retry:              c.Retry,
+		RateLimiter:        c.RateLimiter,
+	}
 }
@@ -0,0 +1,313 @@
+package swarmgo
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"sync"
+
+	"github.com/wlevene/swarmgo/llm"
+)
+
+// DefaultContextReserve is the number of tokens kept free for the completion
+// when neither the request nor the ContextWindow sets one.
+const DefaultContextReserve = 1024
+
+// TokenEstimator estimates the number of tokens messages take up
+type TokenEstimator func(messages []llm.Message) int
+
+// EstimateTokens is the default TokenEstimator. It assumes about four
+// characters per token plus a small overhead per message, which is close
+// enough for English text to keep requests under the limit.
+func EstimateTokens(messages []llm.Message) int {
+	tokens := 0
+	for _, msg := range messages {
+		chars := len(msg.Content) + len(msg.Name)
+		for _, call := range msg.ToolCalls {
+			chars += len(call.Function.Name) + len(call.Function.Arguments)
+		}
+		tokens += chars/4 + 4
+	}
+	return tokens
+}
+
+// ContextStrategy shrinks the messages of a request to fit within limit
+// tokens. Messages start with the system prompt. A strategy may return
+// messages that still exceed the limit when it can shrink them no further.
+type ContextStrategy interface {
+	Fit(ctx context.Context, messages []llm.Message, limit int, estimate TokenEstimator) ([]llm.Message, error)
+}
+
+// ContextWindow configures automatic context-window management. Before each
+// request, histories that exceed the model's limit are shrunk by Strategy.
+type ContextWindow struct {
+	Limits        map[string]int  // Context size in tokens per model
+	DefaultLimit  int             // Used for models missing from Limits; zero leaves them unmanaged
+	ReserveTokens int             // Kept free for the completion when the request sets no MaxTokens
+	Strategy      ContextStrategy // Defaults to SlidingWindow
+	Estimator     TokenEstimator  // Defaults to EstimateTokens
+}
+
+// SetContextWindow enables context-window management for every run
+func (s *Swarm) SetContextWindow(window *ContextWindow) {
+	s.contextWindow = window
+}
+
+// fit shrinks req.Messages to the context limit of req.Model
+func (w *ContextWindow) fit(ctx context.Context, req *llm.ChatCompletionRequest) error {
+	limit, ok := w.Limits[req.Model]
+	if !ok {
+		limit = w.DefaultLimit
+	}
+	if limit <= 0 {
+		return nil
+	}
+
+	estimate := w.Estimator
+	if estimate == nil {
+		estimate = EstimateTokens
+	}
+	strategy := w.Strategy
+	if strategy == nil {
+		strategy = SlidingWindow{}
+	}
+
+	reserve := req.MaxTokens
+	if reserve == 0 {
+		reserve = w.ReserveTokens
+	}
+	if reserve == 0 {
+		reserve = DefaultContextReserve
+	}
+	if len(req.Tools) > 0 {
+		// Tool definitions count against the window too
+		if data, err := json.Marshal(req.Tools); err == nil {
+			reserve += len(data) / 4
+		}
+	}
+
+	available := limit - reserve
+	if estimate(req.Messages) <= available {
+		return nil
+	}
+	messages, err := strategy.Fit(ctx, req.Messages, available, estimate)
+	if err != nil {
+		return fmt.Errorf("failed to fit context window: %w", err)
+	}
+	req.Messages = messages
+	return nil
+}
+
+// splitSystem splits the leading system messages from the conversation
+func splitSystem(messages []llm.Message) (system, rest []llm.Message) {
+	i := 0
+	for i < len(messages) && messages[i].Role == llm.RoleSystem {
+		i++
+	}
+	return messages[:i], messages[i:]
+}
+
+// join returns system followed by rest in a new slice
+func join(system, rest []llm.Message) []llm.Message {
+	return append(append(make([]llm.Message, 0, len(system)+len(rest)), system...), rest...)
+}
+
+// SlidingWindow keeps the system prompt and the most recent turns that fit,
+// dropping the oldest. A turn starts at a user message, so tool results are
+// never separated from the calls they answer. When even the latest turn does
+// not fit, Fit fails with an error matching llm.ErrContextLength, so it
+// belongs last in ChainStrategies.
+type SlidingWindow struct{}
+
+// Fit implements ContextStrategy
+func (SlidingWindow) Fit(ctx context.Context, messages []llm.Message, limit int, estimate TokenEstimator) ([]llm.Message, error) {
+	system, rest := splitSystem(messages)
+
+	// Try each turn start, oldest first, and keep the longest tail that fits
+	last := -1
+	for i, msg := range rest {
+		if msg.Role != llm.RoleUser {
+			continue
+		}
+		last = i
+		if candidate := join(system, rest[i:]); estimate(candidate) <= limit {
+			return candidate, nil
+		}
+	}
+	smallest := messages
+	if last >= 0 {
+		smallest = join(system, rest[last:])
+	}
+	return nil, fmt.Errorf("the latest turn needs about %d tokens, more than the %d available: %w",
+		estimate(smallest), limit, llm.ErrContextLength)
+}
+
+// DropToolOutputs replaces the content of the oldest tool results with
+// Placeholder until the messages fit. Results of the current turn, after the
+// last user message, are kept.
+type DropToolOutputs struct {
+	Placeholder string // Defaults to "[tool output removed]"
+}
+
+// Fit implements ContextStrategy
+func (d DropToolOutputs) Fit(ctx context.Context, messages []llm.Message, limit int, estimate TokenEstimator) ([]llm.Message, error) {
+	placeholder := d.Placeholder
+	if placeholder == "" {
+		placeholder = "[tool output removed]"
+	}
+
+	lastUser := -1
+	for i, msg := range messages {
+		if msg.Role == llm.RoleUser {
+			lastUser = i
+		}
+	}
+
+	fitted := join(nil, messages)
+	for i := 0; i < lastUser && estimate(fitted) > limit; i++ {
+		if fitted[i].Role == llm.RoleTool || fitted[i].Role == llm.RoleFunction {
+			fitted[i].Content = placeholder
+		}
+	}
+	return fitted, nil
+}
+
+// maxCachedSummaries bounds the summaries a SummarizeOlder keeps
+const maxCachedSummaries = 64
+
+// SummarizeOlder replaces older turns with a summary written by a separate,
+// typically cheaper, model. The summary is appended to the system prompt.
+// Summaries are cached by the messages they cover: later requests of the same
+// conversation reuse a summary while the rest fits, and otherwise only
+// summarize it together with the messages added since. Use a *SummarizeOlder
+// so requests share the cache.
+type SummarizeOlder struct {
+	Client     llm.LLM
+	Model      string
+	KeepRecent int    // Messages kept verbatim; defaults to 6
+	Prompt     string // Instructions for the summarizer
+
+	mu        sync.Mutex
+	summaries map[[sha256.Size]byte]string // By the prefixHashes entry of the messages summarized
+}
+
+// Fit implements ContextStrategy
+func (s *SummarizeOlder) Fit(ctx context.Context, messages []llm.Message, limit int, estimate TokenEstimator) ([]llm.Message, error) {
+	keep := s.KeepRecent
+	if keep <= 0 {
+		keep = 6
+	}
+
+	system, rest := splitSystem(messages)
+	cut := len(rest) - keep
+	// Never start the kept messages with tool results
+	for cut > 0 && (rest[cut].Role == llm.RoleTool || rest[cut].Role == llm.RoleFunction) {
+		cut--
+	}
+	if cut <= 0 {
+		return messages, nil
+	}
+
+	// Start from the summary of the longest prefix summarized before
+	hashes := prefixHashes(rest)
+	start, summary := 0, ""
+	s.mu.Lock()
+	for i := len(rest); i > 0; i-- {
+		if cached, ok := s.summaries[hashes[i]]; ok {
+			start, summary = i, cached
+			break
+		}
+	}
+	s.mu.Unlock()
+	if start > 0 {
+		if fitted := withSummary(system, summary, rest[start:]); start >= cut || estimate(fitted) <= limit {
+			return fitted, nil
+		}
+	}
+
+	prompt := s.Prompt
+	if prompt == "" {
+		prompt = "Summarize the conversation so far. Keep facts, decisions, open questions and tool results that later turns may need."
+	}
+
+	var transcript strings.Builder
+	if summary != "" {
+		fmt.Fprintf(&transcript, "Summary of the earlier conversation: %s\n", summary)
+	}
+	for _, msg := range rest[start:cut] {
+		fmt.Fprintf(&transcript, "%s: %s\n", msg.Role, msg.Content)
+		for _, call := range msg.ToolCalls {
+			fmt.Fprintf(&transcript, "%s called %s(%s)\n", msg.Role, call.Function.Name, call.Function.Arguments)
+		}
+	}
+
+	resp, err := s.Client.CreateChatCompletion(ctx, llm.ChatCompletionRequest{
+		Model: s.Model,
+		Messages: []llm.Message{
+			{Role: llm.RoleSystem, Content: prompt},
+			{Role: llm.RoleUser, Content: transcript.String()},
+		},
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to summarize history: %w", err)
+	}
+	if len(resp.Choices) == 0 {
+		return nil, fmt.Errorf("failed to summarize history: no choices in response")
+	}
+	summary = resp.Choices[0].Message.Content
+
+	s.mu.Lock()
+	if s.summaries == nil || len(s.summaries) >= maxCachedSummaries {
+		s.summaries = make(map[[sha256.Size]byte]string)
+	}
+	s.summaries[hashes[cut]] = summary
+	s.mu.Unlock()
+
+	return withSummary(system, summary, rest[cut:]), nil
+}
+
+// prefixHashes returns a hash of every prefix of messages: entry i covers
+// the first i messages
+func prefixHashes(messages []llm.Message) [][sha256.Size]byte {
+	hashes := make([][sha256.Size]byte, len(messages)+1)
+	for i, msg := range messages {
+		data, _ := json.Marshal(msg)
+		hashes[i+1] = sha256.Sum256(append(hashes[i][:], data...))
+	}
+	return hashes
+}
+
+// withSummary appends summary to the system prompt, followed by rest
+func withSummary(system []llm.Message, summary string, rest []llm.Message) []llm.Message {
+	summary = "Summary of the earlier conversation:\n" + summary
+	system = join(nil, system)
+	if len(system) == 0 {
+		system = []llm.Message{{Role: llm.RoleSystem, Content: summary}}
+	} else {
+		system[0].Content += "\n\n" + summary
+	}
+	return join(system, rest)
+}
+
+// ChainStrategies applies strategies in order until the messages fit
+func ChainStrategies(strategies ...ContextStrategy) ContextStrategy {
+	return chainedStrategy(strategies)
+}
+
+type chainedStrategy []ContextStrategy
+
+// Fit implements ContextStrategy
+func (c chainedStrategy) Fit(ctx context.Context, messages []llm.Message, limit int, estimate TokenEstimator) ([]llm.Message, error) {
+	for _, strategy := range c {
+		if estimate(messages) <= limit {
+			break
+		}
+		var err error
+		if messages, err = strategy.Fit(ctx, messages, limit, estimate); err != nil {
+			return nil, err
+		}
+	}
+	return messages, nil
+}
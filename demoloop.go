@@ -18,13 +18,22 @@ func RunDemoLoop(client *Swarm, agent Agent) {
 	// Print a starting message to the console
 	fmt.Println("Starting Swarm CLI ")
 
-	// Initialize a slice to store chat messages
-	messages := []llm.Message{}
+	// The session keeps the history, including tool calls, and the active agent
+	session, err := client.OpenSession(ctx, NewMemorySessionStore(), "demo", agent)
+	if err != nil {
+		log.Printf("Error: %v", err)
+		return
+	}
 
 	// Create a new reader to read user input from the standard input
 	reader := bufio.NewReader(os.Stdin)
 
-	activeAgent := agent
+	// Ask on the console before sensitive tools run, unless the Swarm has its own approver
+	approve := client.approval
+	if approve == nil {
+		approve = PromptApproval(reader, os.Stdout)
+	}
+	session.SetRunOptions(WithMaxTurns(5), WithApproval(approve))
 
 	for {
 		// Prompt the user for input
@@ -36,41 +45,27 @@ func RunDemoLoop(client *Swarm, agent Agent) {
 		// Trim any leading or trailing whitespace from the input
 		userInput = strings.TrimSpace(userInput)
 
-		// Append the user's input as a new message to the messages slice
-		messages = append(messages, llm.Message{
-			Role:    llm.RoleUser,
-			Content: userInput,
-		})
-
-		response, err := client.Run(ctx, activeAgent, messages, nil, "", false, false, 5, true)
+		activeAgent := session.Agent()
+		response, err := session.Send(ctx, userInput)
 		if err != nil {
 			log.Printf("Error: %v", err)
 			continue
 		}
 
 		// Process the response and print it to the console
-		var lastAssistantMessage llm.Message
-		var functionMessages []llm.Message
 		for _, msg := range response.Messages {
 			switch msg.Role {
 			case llm.RoleAssistant:
 				if msg.Content != "" {
 					fmt.Printf("\033[94m%s\033[0m: %s\n", response.Agent.GetName(), msg.Content)
-					lastAssistantMessage = msg
 				}
-			case llm.RoleFunction:
+			case llm.RoleFunction, llm.RoleTool:
 				fmt.Printf("\033[92m%s function Result\033[0m: %s\n", msg.Name, msg.Content)
-				functionMessages = append(functionMessages, msg)
 			}
 		}
 
-		// Add function results to history first, then the assistant message
-		messages = append(messages, functionMessages...)
-		messages = append(messages, lastAssistantMessage)
-
-		if response.Agent != nil && response.Agent.GetName() != activeAgent.GetName() {
-			fmt.Printf("Transferring conversation to %s.\n", response.Agent.GetName())
-			activeAgent = response.Agent
+		if session.Agent().GetName() != activeAgent.GetName() {
+			fmt.Printf("Transferring conversation to %s.\n", session.Agent().GetName())
 		}
 	}
 }
@@ -82,6 +82,7 @@ func NewSendEmailFn() (*sendEmailFn, error) {
 	}
 	fn.BaseFunction = *baseFn
 	fn.BaseFunction.SetFunction(sendEmail)
+	fn.BaseFunction.SetRequiresApproval(true)
 	return fn, nil
 }
 
@@ -52,6 +52,8 @@ func NewSaveResultsFunction() *SaveResultsFunction {
 	}
 	fn.BaseFunction = *baseFn
 	fn.BaseFunction.SetFunction(fn.work)
+	// 写文件前需要用户确认
+	fn.BaseFunction.SetRequiresApproval(true)
 	return fn
 }
 
@@ -1,7 +1,9 @@
 package swarmgo
 
 import (
+	"context"
 	"fmt"
+	"time"
 
 	"reflect"
 
@@ -10,8 +12,20 @@ import (
 
 type (
 	Function func(args map[string]interface{}, contextVariables map[string]interface{}) Result
+
+	// ContextFunction is a Function that observes the run's context, e.g. to
+	// stop an HTTP request when the run is cancelled or the call times out.
+	ContextFunction func(ctx context.Context, call ToolCallInfo, args map[string]interface{}, contextVariables map[string]interface{}) Result
 )
 
+// ToolCallInfo describes the tool call a ContextFunction is serving
+type ToolCallInfo struct {
+	Agent      string // Name of the agent that requested the call
+	ToolName   string
+	ToolCallID string
+	Turn       int // Zero-based completion turn of the run that requested the call
+}
+
 type AgentFunction interface {
 	GetID() string
 	GetName() string
@@ -24,6 +38,48 @@ type AgentFunction interface {
 	Work(args map[string]interface{}, contextVariables map[string]interface{}) Result
 }
 
+// ApprovalRequirer is implemented by functions whose calls may need approval
+// before they run. It is optional, so AgentFunction implementations written
+// before approvals existed keep working; BaseFunction implements it.
+type ApprovalRequirer interface {
+	RequiresApproval() bool
+}
+
+// ContextFunctionProvider is implemented by functions with a context-aware
+// implementation, which is called instead of GetFunction. It is optional;
+// BaseFunction implements it.
+type ContextFunctionProvider interface {
+	GetContextFunction() ContextFunction
+}
+
+// TimeoutProvider is implemented by functions that limit a single
+// invocation. It is optional; BaseFunction implements it.
+type TimeoutProvider interface {
+	GetTimeout() time.Duration
+}
+
+// contextFunction returns the context-aware implementation of fn, if any
+func contextFunction(fn AgentFunction) ContextFunction {
+	if p, ok := fn.(ContextFunctionProvider); ok {
+		return p.GetContextFunction()
+	}
+	return nil
+}
+
+// functionTimeout returns the limit on a single invocation of fn; zero means none
+func functionTimeout(fn AgentFunction) time.Duration {
+	if p, ok := fn.(TimeoutProvider); ok {
+		return p.GetTimeout()
+	}
+	return 0
+}
+
+// requiresApproval reports whether calls to fn must be approved
+func requiresApproval(fn AgentFunction) bool {
+	r, ok := fn.(ApprovalRequirer)
+	return ok && r.RequiresApproval()
+}
+
 // FunctionToDefinition converts an AgentFunction to a llm.Function
 func FunctionToDefinition(af AgentFunction) llm.Function {
 	return llm.Function{
@@ -39,6 +95,9 @@ type BaseFunction struct {
 	description string
 	parameters  map[string]interface{}
 	fn          Function
+	ctxFn       ContextFunction // Takes precedence over fn when set
+	approval    bool            // Calls wait for approval before they run
+	timeout     time.Duration   // Limit on a single invocation; zero means none
 }
 
 var _ AgentFunction = (*BaseFunction)(nil)
@@ -107,6 +166,42 @@ func (f *BaseFunction) SetFunction(fn Function) {
 	f.fn = fn
 }
 
+// GetContextFunction returns the context-aware implementation, if any
+func (f *BaseFunction) GetContextFunction() ContextFunction {
+	return f.ctxFn
+}
+
+// SetContextFunction sets a context-aware implementation, used instead of the
+// Function set with SetFunction
+func (f *BaseFunction) SetContextFunction(fn ContextFunction) {
+	f.ctxFn = fn
+}
+
+// GetTimeout returns the limit on a single invocation
+func (f *BaseFunction) GetTimeout() time.Duration {
+	return f.timeout
+}
+
+// SetTimeout limits how long a single invocation may take. A call that times
+// out is reported to the model as a failed tool call. A ContextFunction sees
+// its context cancelled; a plain Function cannot be stopped and is abandoned,
+// and its later changes to the context variables are discarded.
+func (f *BaseFunction) SetTimeout(timeout time.Duration) {
+	f.timeout = timeout
+}
+
+// RequiresApproval reports whether calls must be approved before they run
+func (f *BaseFunction) RequiresApproval() bool {
+	return f.approval
+}
+
+// SetRequiresApproval marks the function as sensitive, e.g. because it sends
+// emails or writes files. Its calls are then approved through the Swarm's
+// ApprovalFunc first.
+func (f *BaseFunction) SetRequiresApproval(required bool) {
+	f.approval = required
+}
+
 func (f *BaseFunction) Work(args map[string]interface{}, contextVariables map[string]interface{}) Result {
 	result := Result{}
 	return result
@@ -0,0 +1,67 @@
+package swarmgo
+
+import "github.com/wlevene/swarmgo/llm"
+
+// GenerationSettings controls how the model samples a completion. Unset
+// fields leave the provider default in place; use llm.Ptr to set the
+// pointer fields, e.g. Temperature: llm.Ptr(float32(0)).
+type GenerationSettings struct {
+	Temperature      *float32        // Sampling temperature; an explicit 0 asks for deterministic output.
+	TopP             *float32        // Nucleus sampling probability mass.
+	MaxTokens        int             // Maximum tokens to generate.
+	Stop             []string        // Sequences that end generation.
+	PresencePenalty  float32         // Penalizes tokens that already appeared.
+	FrequencyPenalty float32         // Penalizes tokens by how often they appeared.
+	Seed             *int            // Seed for providers that support reproducible sampling.
+	ToolChoice       *llm.ToolChoice // Whether the model may, must or must not call tools; see WithToolChoice.
+}
+
+// Merge returns g with every field set in override taking precedence
+func (g GenerationSettings) Merge(override GenerationSettings) GenerationSettings {
+	if override.Temperature != nil {
+		g.Temperature = override.Temperature
+	}
+	if override.TopP != nil {
+		g.TopP = override.TopP
+	}
+	if override.MaxTokens != 0 {
+		g.MaxTokens = override.MaxTokens
+	}
+	if override.Stop != nil {
+		g.Stop = override.Stop
+	}
+	if override.PresencePenalty != 0 {
+		g.PresencePenalty = override.PresencePenalty
+	}
+	if override.FrequencyPenalty != 0 {
+		g.FrequencyPenalty = override.FrequencyPenalty
+	}
+	if override.Seed != nil {
+		g.Seed = override.Seed
+	}
+	if override.ToolChoice != nil {
+		g.ToolChoice = override.ToolChoice
+	}
+	return g
+}
+
+// apply copies the settings onto req
+func (g GenerationSettings) apply(req *llm.ChatCompletionRequest) {
+	req.Temperature = g.Temperature
+	req.TopP = g.TopP
+	req.MaxTokens = g.MaxTokens
+	req.Stop = g.Stop
+	req.PresencePenalty = g.PresencePenalty
+	req.FrequencyPenalty = g.FrequencyPenalty
+	req.Seed = g.Seed
+	req.ToolChoice = g.ToolChoice
+}
+
+// generationFor returns the agent's settings with the per-call overrides applied in order
+func generationFor(agent Agent, overrides []GenerationSettings) GenerationSettings {
+	settings := agent.GetGenerationSettings()
+	for _, override := range overrides {
+		settings = settings.Merge(override)
+	}
+	return settings
+}
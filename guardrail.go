@@ -0,0 +1,199 @@
+package swarmgo
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/wlevene/swarmgo/llm"
+)
+
+// ErrGuardrailTripped is matched by the error returned when a guardrail stops
+// a run. Use errors.As with *GuardrailTrippedError for the verdict.
+var ErrGuardrailTripped = errors.New("guardrail tripped")
+
+// GuardrailStage tells whether a guardrail checked input or output
+type GuardrailStage string
+
+const (
+	GuardrailInput  GuardrailStage = "input"
+	GuardrailOutput GuardrailStage = "output"
+)
+
+// GuardrailVerdict is the outcome of a guardrail check
+type GuardrailVerdict struct {
+	Tripped bool                   // Whether the run must stop
+	Reason  string                 // Why the guardrail tripped, or passed
+	Details map[string]interface{} // Extra information, e.g. classifier scores
+}
+
+// GuardrailTrippedError is returned by Run when a guardrail trips
+type GuardrailTrippedError struct {
+	Guardrail string
+	Stage     GuardrailStage
+	Agent     string
+	Verdict   GuardrailVerdict
+}
+
+func (e *GuardrailTrippedError) Error() string {
+	return fmt.Sprintf("%v: %s guardrail %s of agent %s: %s", ErrGuardrailTripped, e.Stage, e.Guardrail, e.Agent, e.Verdict.Reason)
+}
+
+// Is makes errors.Is(err, ErrGuardrailTripped) match
+func (e *GuardrailTrippedError) Is(target error) bool {
+	return target == ErrGuardrailTripped
+}
+
+// InputGuardrail checks the conversation before an agent's first completion
+// in a run, e.g. to reject off-topic or unsafe requests.
+type InputGuardrail interface {
+	Name() string
+	CheckInput(ctx context.Context, agent Agent, messages []llm.Message) (GuardrailVerdict, error)
+}
+
+// OutputGuardrail checks the last assistant message a run returns, e.g. to
+// block responses that leak internal data. The message may carry tool calls
+// when the run ends before a final answer, including runs that fail.
+type OutputGuardrail interface {
+	Name() string
+	CheckOutput(ctx context.Context, agent Agent, message llm.Message) (GuardrailVerdict, error)
+}
+
+type inputGuardrailFunc struct {
+	name string
+	fn   func(ctx context.Context, agent Agent, messages []llm.Message) (GuardrailVerdict, error)
+}
+
+func (g inputGuardrailFunc) Name() string { return g.name }
+
+func (g inputGuardrailFunc) CheckInput(ctx context.Context, agent Agent, messages []llm.Message) (GuardrailVerdict, error) {
+	return g.fn(ctx, agent, messages)
+}
+
+// NewInputGuardrail creates an InputGuardrail from a function
+func NewInputGuardrail(name string, fn func(ctx context.Context, agent Agent, messages []llm.Message) (GuardrailVerdict, error)) InputGuardrail {
+	return inputGuardrailFunc{name: name, fn: fn}
+}
+
+type outputGuardrailFunc struct {
+	name string
+	fn   func(ctx context.Context, agent Agent, message llm.Message) (GuardrailVerdict, error)
+}
+
+func (g outputGuardrailFunc) Name() string { return g.name }
+
+func (g outputGuardrailFunc) CheckOutput(ctx context.Context, agent Agent, message llm.Message) (GuardrailVerdict, error) {
+	return g.fn(ctx, agent, message)
+}
+
+// NewOutputGuardrail creates an OutputGuardrail from a function
+func NewOutputGuardrail(name string, fn func(ctx context.Context, agent Agent, message llm.Message) (GuardrailVerdict, error)) OutputGuardrail {
+	return outputGuardrailFunc{name: name, fn: fn}
+}
+
+// LLMGuardrail classifies text with a model, typically a small and cheap
+// one. It can be used as an input and as an output guardrail.
+type LLMGuardrail struct {
+	GuardrailName string
+	Client        llm.LLM
+	Model         string
+	Policy        string // Describes what must trip the guardrail, e.g. "requests unrelated to billing"
+}
+
+// Name implements InputGuardrail and OutputGuardrail
+func (g *LLMGuardrail) Name() string {
+	return g.GuardrailName
+}
+
+// CheckInput classifies the latest user message
+func (g *LLMGuardrail) CheckInput(ctx context.Context, agent Agent, messages []llm.Message) (GuardrailVerdict, error) {
+	for i := len(messages) - 1; i >= 0; i-- {
+		if messages[i].Role == llm.RoleUser {
+			return g.classify(ctx, "user input", messages[i].Content)
+		}
+	}
+	return GuardrailVerdict{}, nil
+}
+
+// CheckOutput classifies the assistant's answer
+func (g *LLMGuardrail) CheckOutput(ctx context.Context, agent Agent, message llm.Message) (GuardrailVerdict, error) {
+	return g.classify(ctx, "assistant output", message.Content)
+}
+
+var guardrailVerdictFormat = &llm.ResponseFormat{
+	Type: llm.ResponseFormatJSONSchema,
+	Name: "guardrail_verdict",
+	Schema: map[string]interface{}{
+		"type": "object",
+		"properties": map[string]interface{}{
+			"tripped": map[string]interface{}{"type": "boolean"},
+			"reason":  map[string]interface{}{"type": "string"},
+		},
+		"required":             []interface{}{"tripped", "reason"},
+		"additionalProperties": false,
+	},
+}
+
+func (g *LLMGuardrail) classify(ctx context.Context, kind, text string) (GuardrailVerdict, error) {
+	prompt := fmt.Sprintf("You are a guardrail. Decide whether the %s below matches this policy: %s\n"+
+		`Answer with only a JSON object {"tripped": true|false, "reason": "..."}; tripped is true when the policy matches.`,
+		kind, g.Policy)
+
+	resp, err := g.Client.CreateChatCompletion(ctx, llm.ChatCompletionRequest{
+		Model: g.Model,
+		Messages: []llm.Message{
+			{Role: llm.RoleSystem, Content: prompt},
+			{Role: llm.RoleUser, Content: text},
+		},
+		Temperature:    llm.Ptr(float32(0)),
+		ResponseFormat: guardrailVerdictFormat,
+	})
+	if err != nil {
+		return GuardrailVerdict{}, fmt.Errorf("guardrail %s: %w", g.GuardrailName, err)
+	}
+	if len(resp.Choices) == 0 {
+		return GuardrailVerdict{}, fmt.Errorf("guardrail %s: no choices in response", g.GuardrailName)
+	}
+
+	content := strings.TrimSpace(resp.Choices[0].Message.Content)
+	var verdict struct {
+		Tripped bool   `json:"tripped"`
+		Reason  string `json:"reason"`
+	}
+	if err := json.Unmarshal([]byte(content), &verdict); err != nil {
+		return GuardrailVerdict{}, fmt.Errorf("guardrail %s: invalid verdict %q: %w", g.GuardrailName, content, err)
+	}
+	return GuardrailVerdict{Tripped: verdict.Tripped, Reason: verdict.Reason}, nil
+}
+
+// checkInputGuardrails runs the agent's input guardrails in order and
+// returns a *GuardrailTrippedError for the first one that trips
+func checkInputGuardrails(ctx context.Context, agent Agent, messages []llm.Message) error {
+	for _, guardrail := range agent.GetInputGuardrails() {
+		verdict, err := guardrail.CheckInput(ctx, agent, messages)
+		if err != nil {
+			return fmt.Errorf("input guardrail %s failed: %w", guardrail.Name(), err)
+		}
+		if verdict.Tripped {
+			return &GuardrailTrippedError{Guardrail: guardrail.Name(), Stage: GuardrailInput, Agent: agent.GetName(), Verdict: verdict}
+		}
+	}
+	return nil
+}
+
+// checkOutputGuardrails runs the agent's output guardrails in order and
+// returns a *GuardrailTrippedError for the first one that trips
+func checkOutputGuardrails(ctx context.Context, agent Agent, message llm.Message) error {
+	for _, guardrail := range agent.GetOutputGuardrails() {
+		verdict, err := guardrail.CheckOutput(ctx, agent, message)
+		if err != nil {
+			return fmt.Errorf("output guardrail %s failed: %w", guardrail.Name(), err)
+		}
+		if verdict.Tripped {
+			return &GuardrailTrippedError{Guardrail: guardrail.Name(), Stage: GuardrailOutput, Agent: agent.GetName(), Verdict: verdict}
+		}
+	}
+	return nil
+}
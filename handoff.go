@@ -0,0 +1,175 @@
+package swarmgo
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"strings"
+
+	"github.com/wlevene/swarmgo/llm"
+)
+
+// HandoffPayloadKey is the context variable holding the arguments of the
+// latest handoff made through a TransferFunction with a payload schema
+const HandoffPayloadKey = "handoff_payload"
+
+// DecodeHandoffPayload decodes the payload of the latest handoff into v. It
+// reports false when the context variables hold no payload.
+func DecodeHandoffPayload(contextVariables map[string]interface{}, v interface{}) (bool, error) {
+	payload, ok := contextVariables[HandoffPayloadKey]
+	if !ok {
+		return false, nil
+	}
+	data, err := json.Marshal(payload)
+	if err != nil {
+		return true, err
+	}
+	if err := json.Unmarshal(data, v); err != nil {
+		return true, fmt.Errorf("invalid handoff payload: %w", err)
+	}
+	return true, nil
+}
+
+// HandoffInputFilter shapes the history an agent sees after a handoff. The
+// Response still contains every message of the run.
+type HandoffInputFilter func(ctx context.Context, messages []llm.Message) ([]llm.Message, error)
+
+// StripToolCalls removes tool calls and tool results, keeping the
+// conversation between the user and the agents
+func StripToolCalls() HandoffInputFilter {
+	return func(ctx context.Context, messages []llm.Message) ([]llm.Message, error) {
+		var filtered []llm.Message
+		for _, msg := range messages {
+			switch {
+			case msg.Role == llm.RoleTool || msg.Role == llm.RoleFunction:
+			case len(msg.ToolCalls) > 0:
+				if msg.Content != "" {
+					msg.ToolCalls = nil
+					filtered = append(filtered, msg)
+				}
+			default:
+				filtered = append(filtered, msg)
+			}
+		}
+		return filtered, nil
+	}
+}
+
+// KeepLastMessages keeps the last n messages. Tool results whose calls were
+// dropped are removed as well.
+func KeepLastMessages(n int) HandoffInputFilter {
+	return func(ctx context.Context, messages []llm.Message) ([]llm.Message, error) {
+		start := len(messages) - n
+		if start < 0 {
+			start = 0
+		}
+		for start < len(messages) && (messages[start].Role == llm.RoleTool || messages[start].Role == llm.RoleFunction) {
+			start++
+		}
+		return append([]llm.Message{}, messages[start:]...), nil
+	}
+}
+
+// SummarizeHandoff replaces the history with a single user message holding a
+// summary written by model, followed by the latest user request verbatim
+func SummarizeHandoff(client llm.LLM, model string) HandoffInputFilter {
+	return func(ctx context.Context, messages []llm.Message) ([]llm.Message, error) {
+		var transcript strings.Builder
+		latest := ""
+		for _, msg := range messages {
+			fmt.Fprintf(&transcript, "%s: %s\n", msg.Role, msg.Content)
+			for _, call := range msg.ToolCalls {
+				fmt.Fprintf(&transcript, "%s called %s(%s)\n", msg.Role, call.Function.Name, call.Function.Arguments)
+			}
+			if msg.Role == llm.RoleUser {
+				latest = msg.Content
+			}
+		}
+
+		resp, err := client.CreateChatCompletion(ctx, llm.ChatCompletionRequest{
+			Model: model,
+			Messages: []llm.Message{
+				{Role: llm.RoleSystem, Content: "Summarize the conversation below for the agent taking it over. Keep the user's goal, facts and decisions; leave out internal tool chatter."},
+				{Role: llm.RoleUser, Content: transcript.String()},
+			},
+		})
+		if err != nil {
+			return nil, fmt.Errorf("failed to summarize history: %w", err)
+		}
+		if len(resp.Choices) == 0 {
+			return nil, fmt.Errorf("failed to summarize history: no choices in response")
+		}
+
+		content := "Summary of the conversation so far:\n" + resp.Choices[0].Message.Content
+		if latest != "" {
+			content += "\n\nLatest request:\n" + latest
+		}
+		return []llm.Message{{Role: llm.RoleUser, Content: content}}, nil
+	}
+}
+
+// ChainInputFilters applies filters in order
+func ChainInputFilters(filters ...HandoffInputFilter) HandoffInputFilter {
+	return func(ctx context.Context, messages []llm.Message) ([]llm.Message, error) {
+		for _, filter := range filters {
+			var err error
+			if messages, err = filter(ctx, messages); err != nil {
+				return nil, err
+			}
+		}
+		return messages, nil
+	}
+}
+
+// HandoffMode tells how the Agent of a Result takes over the conversation
+type HandoffMode int
+
+const (
+	// HandoffTransfer is a one-way transfer to the new agent
+	HandoffTransfer HandoffMode = iota
+	// HandoffCall pushes the calling agent onto the run's call stack. The new
+	// agent gets a return_to_caller tool that pops back with a result.
+	HandoffCall
+
+	handoffReturn // Pops the call stack; used by return_to_caller
+)
+
+// ReturnToCallerTool is the name of the tool given to agents that were
+// called with HandoffCall
+const ReturnToCallerTool = "return_to_caller"
+
+// newReturnToCallerFunction builds the return_to_caller tool that hands the
+// conversation back to caller
+func newReturnToCallerFunction(caller Agent) *BaseFunction {
+	return &BaseFunction{
+		name:        ReturnToCallerTool,
+		description: fmt.Sprintf("Return control to %s with the result of the delegated task.", caller.GetName()),
+		parameters: map[string]interface{}{
+			"type": "object",
+			"properties": map[string]interface{}{
+				"result": map[string]interface{}{
+					"type":        "string",
+					"description": "Outcome of the task, for " + caller.GetName(),
+				},
+			},
+			"required": []interface{}{"result"},
+		},
+		fn: func(args map[string]interface{}, contextVariables map[string]interface{}) Result {
+			return Result{
+				Agent:       caller,
+				Data:        fmt.Sprintf("Returned to %s with result: %v", caller.GetName(), args["result"]),
+				HandoffMode: handoffReturn,
+			}
+		},
+	}
+}
+
+// functionsFor returns the functions available to agent in a run, including
+// return_to_caller while the call stack is not empty
+func functionsFor(agent Agent, opts RunOptions) []AgentFunction {
+	functions := agent.GetFunctions()
+	if opts.returnFunction != nil {
+		functions = append(append([]AgentFunction{}, functions...), opts.returnFunction)
+	}
+	return functions
+}
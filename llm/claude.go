@@ -25,19 +25,49 @@ func NewClaudeLLM(apiKey string) *ClaudeLLM {
 	return &ClaudeLLM{client: client}
 }
 
-// convertToClaudeMessages converts our generic Message type to Claude's message format
+// NewClaudeLLMWithConfig creates a Claude client from cfg
+func NewClaudeLLMWithConfig(cfg Config) *ClaudeLLM {
+	opts := []option.RequestOption{option.WithAPIKey(cfg.APIKey)}
+	if cfg.BaseURL != "" {
+		opts = append(opts, option.WithBaseURL(cfg.BaseURL))
+	}
+	if cfg.HTTPClient != nil {
+		opts = append(opts, option.WithHTTPClient(cfg.HTTPClient))
+	}
+	if cfg.APIVersion != "" {
+		opts = append(opts, option.WithHeader("anthropic-version", cfg.APIVersion))
+	}
+	// The SDK's own retries would multiply the attempts of WithRetry and
+	// bypass the RateLimiter
+	if cfg.Retry != nil || cfg.RateLimiter != nil {
+		opts = append(opts, option.WithMaxRetries(0))
+	}
+
+	return &ClaudeLLM{client: anthropic.NewClient(opts...)}
+}
+
+// convertToClaudeMessages converts our generic Message type to Claude's message format.
+// Tool calls become tool_use blocks on the assistant turn, and consecutive tool
+// results are grouped into a single user turn of tool_result blocks.
 func convertToClaudeMessages(messages []Message) []anthropic.MessageParam {
 	var claudeMessages []anthropic.MessageParam
+	var toolResults []anthropic.ContentBlockParamUnion
 
-	// First pass: collect tool calls and their results
-	toolCallMap := make(map[string]string) // map[tool_id]result
-	for _, msg := range messages {
-		if msg.Role == RoleFunction {
-			toolCallMap[msg.Name] = msg.Content
+	flushToolResults := func() {
+		if len(toolResults) > 0 {
+			claudeMessages = append(claudeMessages, anthropic.NewUserMessage(toolResults...))
+			toolResults = nil
 		}
 	}
 
 	for i, msg := range messages {
+		if isToolResult(msg) {
+			toolResults = append(toolResults,
+				anthropic.NewToolResultBlock(resolveToolCallID(messages, i), msg.Content, false))
+			continue
+		}
+		flushToolResults()
+
 		switch msg.Role {
 		case RoleSystem:
 			// Claude handles system messages differently - we'll add it as a system prompt
@@ -45,44 +75,23 @@ func convertToClaudeMessages(messages []Message) []anthropic.MessageParam {
 		case RoleUser:
 			claudeMessages = append(claudeMessages, anthropic.NewUserMessage(anthropic.NewTextBlock(msg.Content)))
 		case RoleAssistant:
-			// Skip assistant messages that are the last message when there are tool calls
-			if len(msg.ToolCalls) > 0 && i == len(messages)-1 {
-				continue
+			var blocks []anthropic.ContentBlockParamUnion
+			if msg.Content != "" {
+				blocks = append(blocks, anthropic.NewTextBlock(msg.Content))
 			}
-			
-			// If there are tool calls, we need to split this into multiple messages
-			if len(msg.ToolCalls) > 0 {
-				// First message: just the text content if any
-				if msg.Content != "" {
-					claudeMessages = append(claudeMessages, anthropic.NewAssistantMessage(anthropic.NewTextBlock(msg.Content)))
+			for _, tc := range msg.ToolCalls {
+				var args interface{}
+				if err := json.Unmarshal([]byte(tc.Function.Arguments), &args); err != nil {
+					args = map[string]interface{}{}
 				}
-				
-				// Then for each tool call, create a tool use message
-				for _, tc := range msg.ToolCalls {
-					var args interface{}
-					if err := json.Unmarshal([]byte(tc.Function.Arguments), &args); err == nil {
-						// Create the tool use message
-						toolMsg := anthropic.NewAssistantMessage(
-							anthropic.NewToolUseBlockParam(tc.ID, tc.Function.Name, args))
-						claudeMessages = append(claudeMessages, toolMsg)
-						
-						// Add the tool result immediately after if available
-						if result, ok := toolCallMap[tc.Function.Name]; ok {
-							toolResult := anthropic.NewUserMessage(
-								anthropic.NewToolResultBlock(tc.ID, result, false))
-							claudeMessages = append(claudeMessages, toolResult)
-						}
-					}
-				}
-			} else {
-				// No tool calls, just add the content
-				claudeMessages = append(claudeMessages, anthropic.NewAssistantMessage(anthropic.NewTextBlock(msg.Content)))
+				blocks = append(blocks, anthropic.NewToolUseBlockParam(tc.ID, tc.Function.Name, args))
+			}
+			if len(blocks) > 0 {
+				claudeMessages = append(claudeMessages, anthropic.NewAssistantMessage(blocks...))
 			}
-		case RoleFunction:
-			// Function messages are handled with tool calls
-			continue
 		}
 	}
+	flushToolResults()
 
 	return claudeMessages
 }
@@ -138,6 +147,69 @@ func convertToClaudeTools(tools []Tool) []anthropic.ToolParam {
 	return claudeTools
 }
 
+// convertToClaudeToolChoice converts a tool choice to Claude's tool_choice
+func convertToClaudeToolChoice(choice *ToolChoice) anthropic.ToolChoiceUnionParam {
+	switch choice.Mode {
+	case ToolChoiceRequired:
+		return anthropic.ToolChoiceAnyParam{Type: anthropic.F(anthropic.ToolChoiceAnyTypeAny)}
+	case ToolChoiceFunction:
+		return anthropic.ToolChoiceToolParam{
+			Type: anthropic.F(anthropic.ToolChoiceToolTypeTool),
+			Name: anthropic.F(choice.Function),
+		}
+	case ToolChoiceNone:
+		// The SDK predates the "none" choice, but the API accepts it
+		return anthropic.ToolChoiceParam{Type: anthropic.F(anthropic.ToolChoiceType(ToolChoiceNone))}
+	default:
+		return anthropic.ToolChoiceAutoParam{Type: anthropic.F(anthropic.ToolChoiceAutoTypeAuto)}
+	}
+}
+
+// applyClaudeResponseFormat adds a tool for the requested output to claudeReq
+// and requires Claude to use a tool. Without other tools Claude must call the
+// output tool; otherwise it may call the agent's tools first. It returns the
+// name of the output tool.
+func applyClaudeResponseFormat(claudeReq *anthropic.MessageNewParams, req ChatCompletionRequest) string {
+	name := req.ResponseFormat.name()
+	var schema interface{} = req.ResponseFormat.Schema
+	if req.ResponseFormat.Schema == nil {
+		schema = map[string]interface{}{"type": "object"}
+	}
+
+	tools := append(convertToClaudeTools(req.Tools), anthropic.ToolParam{
+		Name:        anthropic.F(name),
+		Description: anthropic.F("Respond with the final answer as the input of this tool."),
+		InputSchema: anthropic.F(schema),
+	})
+	claudeReq.Tools = anthropic.F(tools)
+
+	if len(req.Tools) == 0 {
+		claudeReq.ToolChoice = anthropic.F[anthropic.ToolChoiceUnionParam](anthropic.ToolChoiceToolParam{
+			Type: anthropic.F(anthropic.ToolChoiceToolTypeTool),
+			Name: anthropic.F(name),
+		})
+	} else {
+		claudeReq.ToolChoice = anthropic.F[anthropic.ToolChoiceUnionParam](anthropic.ToolChoiceAnyParam{
+			Type: anthropic.F(anthropic.ToolChoiceAnyTypeAny),
+		})
+	}
+	return name
+}
+
+// extractClaudeOutput turns a call of the output tool into the message content
+func extractClaudeOutput(message Message, outputTool string) Message {
+	var toolCalls []ToolCall
+	for _, call := range message.ToolCalls {
+		if call.Function.Name == outputTool {
+			message.Content = call.Function.Arguments
+			continue
+		}
+		toolCalls = append(toolCalls, call)
+	}
+	message.ToolCalls = toolCalls
+	return message
+}
+
 // convertFromClaudeMessage converts Claude's message type to our generic Message type
 func convertFromClaudeMessage(msg anthropic.Message) Message {
 	var content string
@@ -201,18 +273,37 @@ func (c *ClaudeLLM) CreateChatCompletion(ctx context.Context, req ChatCompletion
 		})
 	}
 
-	if req.Temperature > 0 {
-		claudeReq.Temperature = anthropic.F(float64(req.Temperature))
+	if req.Temperature != nil {
+		claudeReq.Temperature = anthropic.F(float64(*req.Temperature))
+	}
+	if req.TopP != nil {
+		claudeReq.TopP = anthropic.F(float64(*req.TopP))
+	}
+	if len(req.Stop) > 0 {
+		claudeReq.StopSequences = anthropic.F(req.Stop)
+	}
+	if len(req.Tools) > 0 && req.ToolChoice != nil {
+		claudeReq.ToolChoice = anthropic.F(convertToClaudeToolChoice(req.ToolChoice))
+	}
+
+	// Claude has no JSON mode, so structured output is requested by making it
+	// call a tool whose input schema is the output schema
+	var outputTool string
+	if req.ResponseFormat.wantsJSON() {
+		outputTool = applyClaudeResponseFormat(&claudeReq, req)
 	}
 
 	// Make request to Claude API
 	resp, err := c.client.Messages.New(ctx, claudeReq)
 	if err != nil {
-		return ChatCompletionResponse{}, fmt.Errorf("claude API error: %v", err)
+		return ChatCompletionResponse{}, fmt.Errorf("claude API error: %w", classifyError(Claude, err))
 	}
 
 	// Convert response
 	message := convertFromClaudeMessage(*resp)
+	if outputTool != "" {
+		message = extractClaudeOutput(message, outputTool)
+	}
 
 	return ChatCompletionResponse{
 		ID: resp.ID,
@@ -264,8 +355,17 @@ func (c *ClaudeLLM) CreateChatCompletionStream(ctx context.Context, req ChatComp
 		})
 	}
 
-	if req.Temperature > 0 {
-		claudeReq.Temperature = anthropic.F(float64(req.Temperature))
+	if req.Temperature != nil {
+		claudeReq.Temperature = anthropic.F(float64(*req.Temperature))
+	}
+	if req.TopP != nil {
+		claudeReq.TopP = anthropic.F(float64(*req.TopP))
+	}
+	if len(req.Stop) > 0 {
+		claudeReq.StopSequences = anthropic.F(req.Stop)
+	}
+	if len(req.Tools) > 0 && req.ToolChoice != nil {
+		claudeReq.ToolChoice = anthropic.F(convertToClaudeToolChoice(req.ToolChoice))
 	}
 
 	// Create streaming response
@@ -290,7 +390,7 @@ type claudeStreamWrapper struct {
 func (w *claudeStreamWrapper) Recv() (ChatCompletionResponse, error) {
 	if !w.stream.Next() {
 		if err := w.stream.Err(); err != nil {
-			return ChatCompletionResponse{}, err
+			return ChatCompletionResponse{}, classifyError(Claude, err)
 		}
 		return ChatCompletionResponse{}, io.EOF
 	}
@@ -0,0 +1,75 @@
+package llm
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+)
+
+// Config holds the connection settings used to build a provider client.
+// Fields a provider has no use for are ignored.
+type Config struct {
+	APIKey             string
+	BaseURL            string                    // Custom endpoint, e.g. a proxy or self-hosted gateway
+	OrgID              string                    // OpenAI organization
+	APIVersion         string                    // Azure API version, or the anthropic-version header for Claude
+	AssistantVersion   string                    // OpenAI assistants API version
+	HTTPClient         *http.Client              // Used for every request, e.g. to go through a corporate proxy
+	ModelMapperFunc    func(model string) string // Maps a model name to a provider-specific deployment name
+	EmptyMessagesLimit uint                      // Empty stream lines tolerated before a stream fails
+	Options            map[string]interface{}    // Provider-specific options; Ollama sends them as model options
+	Retry              *RetryPolicy              // Retries failed requests; nil disables retries
+	RateLimiter        *RateLimiter              // Limits requests and tokens, shared by the clients using it; nil means unlimited
+}
+
+// NewLLM builds a client for provider from cfg
+func NewLLM(provider LLMProvider, cfg Config) (LLM, error) {
+	var client LLM
+	var err error
+
+	switch provider {
+	case OpenAI, Azure, AzureAD, CloudflareAzure:
+		client = NewOpenAILLMWithConfig(provider, cfg)
+	case Gemini:
+		client, err = NewGeminiLLMWithConfig(cfg)
+	case Claude:
+		client = NewClaudeLLMWithConfig(cfg)
+	case Ollama:
+		client, err = NewOllamaLLMWithConfig(cfg)
+	case DeepSeek:
+		client = NewDeepSeekLLMWithConfig(cfg)
+	default:
+		return nil, fmt.Errorf("unsupported provider: %s", provider)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if cfg.ModelMapperFunc != nil {
+		client = &modelMappingLLM{LLM: client, mapper: cfg.ModelMapperFunc}
+	}
+	// Limited inside the retries, so every attempt waits for capacity
+	if cfg.RateLimiter != nil {
+		client = WithRateLimiter(client, cfg.RateLimiter)
+	}
+	if cfg.Retry != nil {
+		client = WithRetry(client, *cfg.Retry)
+	}
+	return client, nil
+}
+
+// modelMappingLLM rewrites the requested model before delegating
+type modelMappingLLM struct {
+	LLM
+	mapper func(model string) string
+}
+
+func (m *modelMappingLLM) CreateChatCompletion(ctx context.Context, req ChatCompletionRequest) (ChatCompletionResponse, error) {
+	req.Model = m.mapper(req.Model)
+	return m.LLM.CreateChatCompletion(ctx, req)
+}
+
+func (m *modelMappingLLM) CreateChatCompletionStream(ctx context.Context, req ChatCompletionRequest) (ChatCompletionStream, error) {
+	req.Model = m.mapper(req.Model)
+	return m.LLM.CreateChatCompletionStream(ctx, req)
+}
@@ -8,22 +8,48 @@ import (
 	"fmt"
 	"io"
 	"net/http"
+	"strings"
 )
 
-const deepseekAPIEndpoint = "https://api.deepseek.com/chat/completions"
+const (
+	deepseekAPIEndpoint = "https://api.deepseek.com/chat/completions"
+
+	// deepseekEmptyMessagesLimit is the default number of empty stream lines tolerated
+	deepseekEmptyMessagesLimit = 300
+)
 
 // DeepSeekLLM implements the LLM interface for DeepSeek
 type DeepSeekLLM struct {
-	apiKey string
-	client *http.Client
+	apiKey             string
+	endpoint           string
+	client             *http.Client
+	emptyMessagesLimit uint
 }
 
 // NewDeepSeekLLM creates a new DeepSeek LLM client
 func NewDeepSeekLLM(apiKey string) *DeepSeekLLM {
 	return &DeepSeekLLM{
-		apiKey: apiKey,
-		client: &http.Client{},
+		apiKey:             apiKey,
+		endpoint:           deepseekAPIEndpoint,
+		client:             &http.Client{},
+		emptyMessagesLimit: deepseekEmptyMessagesLimit,
+	}
+}
+
+// NewDeepSeekLLMWithConfig creates a DeepSeek client from cfg. BaseURL replaces
+// the API root, e.g. "https://api.deepseek.com".
+func NewDeepSeekLLMWithConfig(cfg Config) *DeepSeekLLM {
+	l := NewDeepSeekLLM(cfg.APIKey)
+	if cfg.BaseURL != "" {
+		l.endpoint = strings.TrimSuffix(cfg.BaseURL, "/") + "/chat/completions"
 	}
+	if cfg.HTTPClient != nil {
+		l.client = cfg.HTTPClient
+	}
+	if cfg.EmptyMessagesLimit > 0 {
+		l.emptyMessagesLimit = cfg.EmptyMessagesLimit
+	}
+	return l
 }
 
 type deepseekMessage struct {
@@ -37,38 +63,82 @@ type deepseekMessage struct {
 // Convert Message to deepseekMessage
 func convertToDeepSeekMessage(msg Message) deepseekMessage {
 	dsMsg := deepseekMessage{
-		Role:      convertToDeepSeekRole(msg.Role),
-		Content:   msg.Content,
-		Name:      msg.Name,
-		ToolCalls: msg.ToolCalls,
+		Role:       convertToDeepSeekRole(msg.Role),
+		Content:    msg.Content,
+		Name:       msg.Name,
+		ToolCalls:  msg.ToolCalls,
+		ToolCallID: msg.ToolCallID,
 	}
 	return dsMsg
 }
 
+// convertToDeepSeekMessages converts a conversation to DeepSeek format, tying
+// every tool result to its tool call
+func convertToDeepSeekMessages(messages []Message) ([]deepseekMessage, error) {
+	var deepseekMessages []deepseekMessage
+	var lastToolCalls []ToolCall
+
+	for i, msg := range messages {
+		dsMsg := convertToDeepSeekMessage(msg)
+		if isToolResult(msg) {
+			dsMsg.ToolCallID = resolveToolCallID(messages, i)
+			if dsMsg.ToolCallID == "" {
+				// If we can't find a tool call ID, skip this message
+				continue
+			}
+			// Tool messages are identified by tool_call_id rather than name
+			dsMsg.Name = ""
+		} else if msg.Role == RoleAssistant && len(msg.ToolCalls) > 0 {
+			lastToolCalls = msg.ToolCalls
+		}
+		deepseekMessages = append(deepseekMessages, dsMsg)
+	}
+
+	// Every tool call of the last assistant turn must have a response
+	for _, toolCall := range lastToolCalls {
+		found := false
+		for _, msg := range deepseekMessages {
+			if msg.Role == "tool" && msg.ToolCallID == toolCall.ID {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return nil, fmt.Errorf("missing tool responses")
+		}
+	}
+
+	return deepseekMessages, nil
+}
+
 // Convert deepseekMessage to Message
 func convertFromDeepSeekMessage(msg deepseekMessage) Message {
 	return Message{
-		Role:      convertFromDeepSeekRole(msg.Role),
-		Content:   msg.Content,
-		Name:      msg.Name,
-		ToolCalls: msg.ToolCalls,
+		Role:       convertFromDeepSeekRole(msg.Role),
+		Content:    msg.Content,
+		Name:       msg.Name,
+		ToolCalls:  msg.ToolCalls,
+		ToolCallID: msg.ToolCallID,
 	}
 }
 
+type deepseekResponseFormat struct {
+	Type string `json:"type"`
+}
+
 type deepseekRequest struct {
-	Model            string            `json:"model"`
-	Messages         []deepseekMessage `json:"messages"`
-	FrequencyPenalty float32           `json:"frequency_penalty,omitempty"`
-	MaxTokens        int               `json:"max_tokens,omitempty"`
-	PresencePenalty  float32           `json:"presence_penalty,omitempty"`
-	ResponseFormat   *struct {
-		Type string `json:"type"`
-	} `json:"response_format,omitempty"`
-	Stream      bool     `json:"stream,omitempty"`
-	Temperature float32  `json:"temperature,omitempty"`
-	TopP        float32  `json:"top_p,omitempty"`
-	Tools       []Tool   `json:"tools,omitempty"`
-	Stop        []string `json:"stop,omitempty"`
+	Model            string                  `json:"model"`
+	Messages         []deepseekMessage       `json:"messages"`
+	FrequencyPenalty float32                 `json:"frequency_penalty,omitempty"`
+	MaxTokens        int                     `json:"max_tokens,omitempty"`
+	PresencePenalty  float32                 `json:"presence_penalty,omitempty"`
+	ResponseFormat   *deepseekResponseFormat `json:"response_format,omitempty"`
+	Stream           bool                    `json:"stream,omitempty"`
+	Temperature      *float32                `json:"temperature,omitempty"`
+	TopP             *float32                `json:"top_p,omitempty"`
+	Tools            []Tool                  `json:"tools,omitempty"`
+	Stop             []string                `json:"stop,omitempty"`
+	ToolChoice       interface{}             `json:"tool_choice,omitempty"`
 }
 
 type deepseekResponse struct {
@@ -83,78 +153,32 @@ type deepseekStreamResponse struct {
 	Usage   Usage          `json:"usage"`
 }
 
+// convertToDeepSeekResponseFormat maps JSON output requests to DeepSeek's
+// JSON mode, which takes no schema
+func convertToDeepSeekResponseFormat(format *ResponseFormat) *deepseekResponseFormat {
+	if !format.wantsJSON() {
+		return nil
+	}
+	return &deepseekResponseFormat{Type: string(ResponseFormatJSONObject)}
+}
+
 func convertToDeepSeekRole(role Role) string {
 	if role == RoleFunction {
-		return "tool"
+		return string(RoleTool)
 	}
 	return string(role)
 }
 
 func convertFromDeepSeekRole(role string) Role {
-	if role == "tool" {
-		return RoleFunction
-	}
 	return Role(role)
 }
 
 // CreateChatCompletion implements the LLM interface for DeepSeek
 func (l *DeepSeekLLM) CreateChatCompletion(ctx context.Context, req ChatCompletionRequest) (ChatCompletionResponse, error) {
 	// Convert messages to DeepSeek format
-	var deepseekMessages []deepseekMessage
-	var lastToolCalls []ToolCall
-
-	for i, msg := range req.Messages {
-		if msg.Role == RoleFunction {
-			// For function responses, we need to find the corresponding tool call
-			var toolCallID string
-			for j := i - 1; j >= 0; j-- {
-				if req.Messages[j].Role == RoleAssistant && len(req.Messages[j].ToolCalls) > 0 {
-					for _, toolCall := range req.Messages[j].ToolCalls {
-						if toolCall.Function.Name == msg.Name {
-							toolCallID = toolCall.ID
-							break
-						}
-					}
-					if toolCallID != "" {
-						break
-					}
-				}
-			}
-			if toolCallID == "" {
-				// If we can't find a tool call ID, skip this message
-				continue
-			}
-			dsMsg := convertToDeepSeekMessage(msg)
-			dsMsg.ToolCallID = toolCallID
-			deepseekMessages = append(deepseekMessages, dsMsg)
-		} else {
-			dsMsg := convertToDeepSeekMessage(msg)
-			deepseekMessages = append(deepseekMessages, dsMsg)
-			if msg.Role == RoleAssistant && len(msg.ToolCalls) > 0 {
-				lastToolCalls = msg.ToolCalls
-			}
-		}
-	}
-
-	// If the last message had tool calls but no responses, skip the follow-up
-	if len(lastToolCalls) > 0 {
-		hasAllResponses := true
-		for _, toolCall := range lastToolCalls {
-			found := false
-			for _, msg := range deepseekMessages {
-				if msg.Role == "tool" && msg.ToolCallID == toolCall.ID {
-					found = true
-					break
-				}
-			}
-			if !found {
-				hasAllResponses = false
-				break
-			}
-		}
-		if !hasAllResponses {
-			return ChatCompletionResponse{}, fmt.Errorf("missing tool responses")
-		}
+	deepseekMessages, err := convertToDeepSeekMessages(req.Messages)
+	if err != nil {
+		return ChatCompletionResponse{}, err
 	}
 
 	deepseekReq := deepseekRequest{
@@ -167,19 +191,20 @@ func (l *DeepSeekLLM) CreateChatCompletion(ctx context.Context, req ChatCompleti
 		TopP:             req.TopP,
 		Tools:            req.Tools,
 		Stop:             req.Stop,
+		ResponseFormat:   convertToDeepSeekResponseFormat(req.ResponseFormat),
+		ToolChoice:       req.ToolChoice.openAIToolChoice(),
 	}
 
-	// For follow-up responses after tool calls, disable tools to prevent loops
-	if len(req.Messages) > 0 && req.Messages[len(req.Messages)-1].Role == RoleFunction {
-		deepseekReq.Tools = nil
+	if len(deepseekReq.Tools) == 0 {
+		deepseekReq.ToolChoice = nil
 	}
 
 	// Set default values if not provided
-	if deepseekReq.Temperature == 0 {
-		deepseekReq.Temperature = 0.7
+	if deepseekReq.Temperature == nil {
+		deepseekReq.Temperature = Ptr(float32(0.7))
 	}
-	if deepseekReq.TopP == 0 {
-		deepseekReq.TopP = 0.95
+	if deepseekReq.TopP == nil {
+		deepseekReq.TopP = Ptr(float32(0.95))
 	}
 	if deepseekReq.MaxTokens == 0 {
 		deepseekReq.MaxTokens = 2000
@@ -190,7 +215,7 @@ func (l *DeepSeekLLM) CreateChatCompletion(ctx context.Context, req ChatCompleti
 		return ChatCompletionResponse{}, fmt.Errorf("failed to marshal request: %w", err)
 	}
 
-	httpReq, err := http.NewRequestWithContext(ctx, "POST", deepseekAPIEndpoint, bytes.NewReader(body))
+	httpReq, err := http.NewRequestWithContext(ctx, "POST", l.endpoint, bytes.NewReader(body))
 	if err != nil {
 		return ChatCompletionResponse{}, fmt.Errorf("failed to create request: %w", err)
 	}
@@ -205,8 +230,7 @@ func (l *DeepSeekLLM) CreateChatCompletion(ctx context.Context, req ChatCompleti
 	defer resp.Body.Close()
 
 	if resp.StatusCode != http.StatusOK {
-		body, _ := io.ReadAll(resp.Body)
-		return ChatCompletionResponse{}, fmt.Errorf("request failed with status %d: %s", resp.StatusCode, string(body))
+		return ChatCompletionResponse{}, deepseekError(resp)
 	}
 
 	var deepseekResp deepseekResponse
@@ -222,19 +246,21 @@ func (l *DeepSeekLLM) CreateChatCompletion(ctx context.Context, req ChatCompleti
 }
 
 type deepseekStreamWrapper struct {
-	ctx             context.Context
-	reader          *bufio.Reader
-	response        *http.Response
-	currentToolCall *ToolCall
-	toolCallBuffer  map[string]*ToolCall
+	ctx                context.Context
+	reader             *bufio.Reader
+	response           *http.Response
+	currentToolCall    *ToolCall
+	toolCallBuffer     map[string]*ToolCall
+	emptyMessagesLimit uint
 }
 
-func newDeepseekStreamWrapper(ctx context.Context, response *http.Response) *deepseekStreamWrapper {
+func newDeepseekStreamWrapper(ctx context.Context, response *http.Response, emptyMessagesLimit uint) *deepseekStreamWrapper {
 	return &deepseekStreamWrapper{
-		ctx:            ctx,
-		reader:         bufio.NewReader(response.Body),
-		response:       response,
-		toolCallBuffer: make(map[string]*ToolCall),
+		ctx:                ctx,
+		reader:             bufio.NewReader(response.Body),
+		response:           response,
+		toolCallBuffer:     make(map[string]*ToolCall),
+		emptyMessagesLimit: emptyMessagesLimit,
 	}
 }
 
@@ -249,17 +275,29 @@ func (s *deepseekStreamWrapper) Recv() (ChatCompletionResponse, error) {
 	default:
 	}
 
-	line, err := s.reader.ReadBytes('\n')
-	if err != nil {
-		if err == io.EOF {
-			return ChatCompletionResponse{}, io.EOF
+	// Skip the blank lines separating server-sent events
+	var line []byte
+	var emptyMessages uint
+	for {
+		raw, err := s.reader.ReadBytes('\n')
+		if err != nil {
+			if err == io.EOF {
+				return ChatCompletionResponse{}, io.EOF
+			}
+			return ChatCompletionResponse{}, fmt.Errorf("failed to read stream: %w", err)
 		}
-		return ChatCompletionResponse{}, fmt.Errorf("failed to read stream: %w", err)
-	}
 
-	// Remove "data: " prefix
-	line = bytes.TrimPrefix(line, []byte("data: "))
-	line = bytes.TrimSpace(line)
+		// Remove "data: " prefix
+		line = bytes.TrimSpace(bytes.TrimPrefix(raw, []byte("data: ")))
+		if len(line) > 0 && !bytes.HasPrefix(line, []byte(":")) {
+			break
+		}
+
+		emptyMessages++
+		if emptyMessages > s.emptyMessagesLimit {
+			return ChatCompletionResponse{}, fmt.Errorf("stream has sent too many empty messages")
+		}
+	}
 
 	// Check for stream end
 	if bytes.Equal(line, []byte("[DONE]")) {
@@ -281,61 +319,9 @@ func (s *deepseekStreamWrapper) Recv() (ChatCompletionResponse, error) {
 // CreateChatCompletionStream implements the LLM interface for DeepSeek streaming
 func (l *DeepSeekLLM) CreateChatCompletionStream(ctx context.Context, req ChatCompletionRequest) (ChatCompletionStream, error) {
 	// Convert messages to DeepSeek format
-	var deepseekMessages []deepseekMessage
-	var lastToolCalls []ToolCall
-
-	for i, msg := range req.Messages {
-		if msg.Role == RoleFunction {
-			// For function responses, we need to find the corresponding tool call
-			var toolCallID string
-			for j := i - 1; j >= 0; j-- {
-				if req.Messages[j].Role == RoleAssistant && len(req.Messages[j].ToolCalls) > 0 {
-					for _, toolCall := range req.Messages[j].ToolCalls {
-						if toolCall.Function.Name == msg.Name {
-							toolCallID = toolCall.ID
-							break
-						}
-					}
-					if toolCallID != "" {
-						break
-					}
-				}
-			}
-			if toolCallID == "" {
-				// If we can't find a tool call ID, skip this message
-				continue
-			}
-			dsMsg := convertToDeepSeekMessage(msg)
-			dsMsg.ToolCallID = toolCallID
-			deepseekMessages = append(deepseekMessages, dsMsg)
-		} else {
-			dsMsg := convertToDeepSeekMessage(msg)
-			deepseekMessages = append(deepseekMessages, dsMsg)
-			if msg.Role == RoleAssistant && len(msg.ToolCalls) > 0 {
-				lastToolCalls = msg.ToolCalls
-			}
-		}
-	}
-
-	// If the last message had tool calls but no responses, skip the follow-up
-	if len(lastToolCalls) > 0 {
-		hasAllResponses := true
-		for _, toolCall := range lastToolCalls {
-			found := false
-			for _, msg := range deepseekMessages {
-				if msg.Role == "tool" && msg.ToolCallID == toolCall.ID {
-					found = true
-					break
-				}
-			}
-			if !found {
-				hasAllResponses = false
-				break
-			}
-		}
-		if !hasAllResponses {
-			return nil, fmt.Errorf("missing tool responses")
-		}
+	deepseekMessages, err := convertToDeepSeekMessages(req.Messages)
+	if err != nil {
+		return nil, err
 	}
 
 	req.Stream = true
@@ -349,20 +335,21 @@ func (l *DeepSeekLLM) CreateChatCompletionStream(ctx context.Context, req ChatCo
 		TopP:             req.TopP,
 		Tools:            req.Tools,
 		Stop:             req.Stop,
+		ResponseFormat:   convertToDeepSeekResponseFormat(req.ResponseFormat),
+		ToolChoice:       req.ToolChoice.openAIToolChoice(),
 		Stream:           true,
 	}
 
-	// For follow-up responses after tool calls, disable tools to prevent loops
-	if len(req.Messages) > 0 && req.Messages[len(req.Messages)-1].Role == RoleFunction {
-		deepseekReq.Tools = nil
+	if len(deepseekReq.Tools) == 0 {
+		deepseekReq.ToolChoice = nil
 	}
 
 	// Set default values if not provided
-	if deepseekReq.Temperature == 0 {
-		deepseekReq.Temperature = 0.7
+	if deepseekReq.Temperature == nil {
+		deepseekReq.Temperature = Ptr(float32(0.7))
 	}
-	if deepseekReq.TopP == 0 {
-		deepseekReq.TopP = 0.95
+	if deepseekReq.TopP == nil {
+		deepseekReq.TopP = Ptr(float32(0.95))
 	}
 	if deepseekReq.MaxTokens == 0 {
 		deepseekReq.MaxTokens = 2000
@@ -373,7 +360,7 @@ func (l *DeepSeekLLM) CreateChatCompletionStream(ctx context.Context, req ChatCo
 		return nil, fmt.Errorf("failed to marshal request: %w", err)
 	}
 
-	httpReq, err := http.NewRequestWithContext(ctx, "POST", deepseekAPIEndpoint, bytes.NewReader(body))
+	httpReq, err := http.NewRequestWithContext(ctx, "POST", l.endpoint, bytes.NewReader(body))
 	if err != nil {
 		return nil, fmt.Errorf("failed to create request: %w", err)
 	}
@@ -387,12 +374,11 @@ func (l *DeepSeekLLM) CreateChatCompletionStream(ctx context.Context, req ChatCo
 	}
 
 	if resp.StatusCode != http.StatusOK {
-		resp.Body.Close()
-		body, _ := io.ReadAll(resp.Body)
-		return nil, fmt.Errorf("request failed with status %d: %s", resp.StatusCode, string(body))
+		defer resp.Body.Close()
+		return nil, deepseekError(resp)
 	}
 
-	return newDeepseekStreamWrapper(ctx, resp), nil
+	return newDeepseekStreamWrapper(ctx, resp, l.emptyMessagesLimit), nil
 }
 
 func convertStreamChoicesToChoices(streamChoices []StreamChoice) []Choice {
@@ -410,3 +396,18 @@ func convertStreamChoicesToChoices(streamChoices []StreamChoice) []Choice {
 	}
 	return choices
 }
+
+// deepseekError reads a failed response into an *APIError
+func deepseekError(resp *http.Response) error {
+	body, _ := io.ReadAll(resp.Body)
+	message := string(body)
+	var payload struct {
+		Error struct {
+			Message string `json:"message"`
+		} `json:"error"`
+	}
+	if json.Unmarshal(body, &payload) == nil && payload.Error.Message != "" {
+		message = payload.Error.Message
+	}
+	return newAPIError(DeepSeek, resp.StatusCode, resp.Header, message, nil)
+}
@@ -0,0 +1,296 @@
+package llm
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/anthropics/anthropic-sdk-go"
+	"github.com/google/generative-ai-go/genai"
+	"github.com/googleapis/gax-go/v2/apierror"
+	"github.com/ollama/ollama/api"
+	"github.com/sashabaranov/go-openai"
+	"google.golang.org/api/googleapi"
+	"google.golang.org/grpc/codes"
+)
+
+// Errors every provider maps its failures into. Match them with errors.Is;
+// use errors.As with *APIError for the status code and provider message.
+var (
+	ErrRateLimited     = errors.New("rate limited")
+	ErrContextLength   = errors.New("context length exceeded")
+	ErrAuth            = errors.New("authentication failed")
+	ErrServer          = errors.New("server error")
+	ErrContentFiltered = errors.New("content filtered")
+)
+
+// APIError is a failed provider request
+type APIError struct {
+	Provider   LLMProvider
+	StatusCode int           // HTTP status; zero when unknown
+	Kind       error         // One of the Err* values above; nil when unclassified
+	Message    string        // Message returned by the provider
+	RetryAfter time.Duration // Delay requested by the provider before retrying
+	Err        error         // Original error, if any
+}
+
+func (e *APIError) Error() string {
+	if e.Err != nil {
+		return fmt.Sprintf("%s: %v", e.Provider, e.Err)
+	}
+	return fmt.Sprintf("%s: request failed with status %d: %s", e.Provider, e.StatusCode, e.Message)
+}
+
+// Unwrap makes errors.Is match both Kind and the original error
+func (e *APIError) Unwrap() []error {
+	var errs []error
+	if e.Kind != nil {
+		errs = append(errs, e.Kind)
+	}
+	if e.Err != nil {
+		errs = append(errs, e.Err)
+	}
+	return errs
+}
+
+// newAPIError builds an *APIError from an HTTP status, headers and message
+func newAPIError(provider LLMProvider, statusCode int, header http.Header, message string, err error) *APIError {
+	return &APIError{
+		Provider:   provider,
+		StatusCode: statusCode,
+		Kind:       errorKind(statusCode, message),
+		Message:    message,
+		RetryAfter: parseRetryAfter(header),
+		Err:        err,
+	}
+}
+
+// errorKind classifies a failed request by status code, then by message
+func errorKind(statusCode int, message string) error {
+	switch {
+	case statusCode == http.StatusUnauthorized || statusCode == http.StatusForbidden:
+		return ErrAuth
+	case statusCode == http.StatusTooManyRequests:
+		return ErrRateLimited
+	case statusCode >= 500:
+		return ErrServer
+	}
+
+	message = strings.ToLower(message)
+	for _, hint := range []string{"context length", "context_length", "maximum context", "prompt is too long", "too many tokens", "exceeds the maximum number of tokens"} {
+		if strings.Contains(message, hint) {
+			return ErrContextLength
+		}
+	}
+	for _, hint := range []string{"content_filter", "content filter", "content management policy", "safety"} {
+		if strings.Contains(message, hint) {
+			return ErrContentFiltered
+		}
+	}
+	return nil
+}
+
+// parseRetryAfter reads a Retry-After header given in seconds or as an HTTP date
+func parseRetryAfter(header http.Header) time.Duration {
+	value := header.Get("Retry-After")
+	if value == "" {
+		return 0
+	}
+	if seconds, err := strconv.Atoi(value); err == nil && seconds > 0 {
+		return time.Duration(seconds) * time.Second
+	}
+	if at, err := http.ParseTime(value); err == nil {
+		if d := time.Until(at); d > 0 {
+			return d
+		}
+	}
+	return 0
+}
+
+// responseCapture records the status and headers of the response to a
+// request, for SDKs whose errors do not carry them
+type responseCapture struct {
+	mu         sync.Mutex
+	statusCode int
+	header     http.Header
+}
+
+type responseCaptureKey struct{}
+
+// withResponseCapture returns ctx recording the responses that a
+// capturingTransport receives for requests made with it
+func withResponseCapture(ctx context.Context) (context.Context, *responseCapture) {
+	capture := &responseCapture{}
+	return context.WithValue(ctx, responseCaptureKey{}, capture), capture
+}
+
+func (c *responseCapture) response() (int, http.Header) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.statusCode, c.header
+}
+
+// capturingTransport records responses in the responseCapture of the request's context
+type capturingTransport struct {
+	base http.RoundTripper
+}
+
+func (t capturingTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	resp, err := t.base.RoundTrip(req)
+	if capture, ok := req.Context().Value(responseCaptureKey{}).(*responseCapture); ok && resp != nil {
+		capture.mu.Lock()
+		capture.statusCode = resp.StatusCode
+		capture.header = resp.Header.Clone()
+		capture.mu.Unlock()
+	}
+	return resp, err
+}
+
+// withCapturingTransport returns a copy of client whose transport records responses
+func withCapturingTransport(client *http.Client) *http.Client {
+	captured := &http.Client{}
+	if client != nil {
+		*captured = *client
+	}
+	base := captured.Transport
+	if base == nil {
+		base = http.DefaultTransport
+	}
+	captured.Transport = capturingTransport{base: base}
+	return captured
+}
+
+// classifyCapturedError is classifyError completed with the status and
+// headers recorded by capture. SDKs such as go-openai drop the headers, so
+// Retry-After would be lost, and report error pages that are not JSON, such
+// as a proxy's, as plain errors without a status.
+func classifyCapturedError(provider LLMProvider, err error, capture *responseCapture) error {
+	err = classifyError(provider, err)
+	if err == nil {
+		return nil
+	}
+	statusCode, header := capture.response()
+
+	var apiErr *APIError
+	if errors.As(err, &apiErr) {
+		if apiErr.StatusCode == 0 && statusCode >= 400 {
+			apiErr.StatusCode = statusCode
+			if apiErr.Kind == nil {
+				apiErr.Kind = errorKind(statusCode, apiErr.Message)
+			}
+		}
+		if apiErr.RetryAfter == 0 {
+			apiErr.RetryAfter = parseRetryAfter(header)
+		}
+		return err
+	}
+	if statusCode >= 400 {
+		return newAPIError(provider, statusCode, header, err.Error(), err)
+	}
+	return err
+}
+
+// classifyError maps an error returned by a provider SDK to an *APIError.
+// Errors without provider details are returned unchanged.
+func classifyError(provider LLMProvider, err error) error {
+	if err == nil {
+		return nil
+	}
+
+	var apiErr *APIError
+	if errors.As(err, &apiErr) {
+		return err
+	}
+
+	var openaiErr *openai.APIError
+	if errors.As(err, &openaiErr) {
+		message := openaiErr.Message
+		if code, ok := openaiErr.Code.(string); ok {
+			message = code + ": " + message
+		}
+		if openaiErr.InnerError != nil && openaiErr.InnerError.Code == "ResponsibleAIPolicyViolation" {
+			message = "content_filter: " + message
+		}
+		return newAPIError(provider, openaiErr.HTTPStatusCode, nil, message, err)
+	}
+	var requestErr *openai.RequestError
+	if errors.As(err, &requestErr) {
+		return newAPIError(provider, requestErr.HTTPStatusCode, nil, string(requestErr.Body), err)
+	}
+
+	var claudeErr *anthropic.Error
+	if errors.As(err, &claudeErr) {
+		var header http.Header
+		if claudeErr.Response != nil {
+			header = claudeErr.Response.Header
+		}
+		return newAPIError(provider, claudeErr.StatusCode, header, claudeErr.JSON.RawJSON(), err)
+	}
+
+	var ollamaErr api.StatusError
+	if errors.As(err, &ollamaErr) {
+		return newAPIError(provider, ollamaErr.StatusCode, nil, ollamaErr.ErrorMessage, err)
+	}
+
+	var blockedErr *genai.BlockedError
+	if errors.As(err, &blockedErr) {
+		return &APIError{Provider: provider, Kind: ErrContentFiltered, Message: blockedErr.Error(), Err: err}
+	}
+	var googleErr *googleapi.Error
+	if errors.As(err, &googleErr) {
+		return newAPIError(provider, googleErr.Code, googleErr.Header, googleErr.Message, err)
+	}
+	var gapicErr *apierror.APIError
+	if errors.As(err, &gapicErr) {
+		statusCode := gapicErr.HTTPCode()
+		if statusCode <= 0 && gapicErr.GRPCStatus() != nil {
+			statusCode = grpcToHTTPStatus(gapicErr.GRPCStatus().Code())
+		}
+		return newAPIError(provider, statusCode, nil, gapicErr.Error(), err)
+	}
+
+	return err
+}
+
+// grpcToHTTPStatus maps the gRPC codes that matter for classification
+func grpcToHTTPStatus(code codes.Code) int {
+	switch code {
+	case codes.Unauthenticated:
+		return http.StatusUnauthorized
+	case codes.PermissionDenied:
+		return http.StatusForbidden
+	case codes.ResourceExhausted:
+		return http.StatusTooManyRequests
+	case codes.InvalidArgument:
+		return http.StatusBadRequest
+	case codes.Unavailable:
+		return http.StatusServiceUnavailable
+	case codes.Internal, codes.Unknown, codes.DataLoss:
+		return http.StatusInternalServerError
+	}
+	return 0
+}
+
+// IsTransient reports whether err is a network failure that may not recur,
+// such as a reset connection or a timed-out dial
+func IsTransient(err error) bool {
+	if errors.Is(err, io.ErrUnexpectedEOF) || errors.Is(err, syscall.ECONNRESET) || errors.Is(err, syscall.ECONNREFUSED) {
+		return true
+	}
+	var netErr net.Error
+	return errors.As(err, &netErr) && netErr.Timeout()
+}
+
+// IsRetryable reports whether a request that failed with err may succeed
+// when sent again: rate limits, server errors and transient network failures
+func IsRetryable(err error) bool {
+	return errors.Is(err, ErrRateLimited) || errors.Is(err, ErrServer) || IsTransient(err)
+}
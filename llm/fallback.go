@@ -0,0 +1,176 @@
+package llm
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// Backend is one entry of a FallbackLLM chain
+type Backend struct {
+	Name     string        // Reported in ResponseMetadata; defaults to "<provider>/<model>"
+	Provider LLMProvider   // Informational; the Client does the work
+	Model    string        // Replaces the requested model; empty keeps it
+	Client   LLM           // Serves the requests
+	Timeout  time.Duration // Limit on a single attempt before failing over; zero means none
+}
+
+// NewBackend builds a Backend serving model with a client for provider
+func NewBackend(provider LLMProvider, model string, cfg Config) (Backend, error) {
+	client, err := NewLLM(provider, cfg)
+	if err != nil {
+		return Backend{}, err
+	}
+	return Backend{Provider: provider, Model: model, Client: client}, nil
+}
+
+func (b Backend) name() string {
+	if b.Name != "" {
+		return b.Name
+	}
+	return fmt.Sprintf("%s/%s", b.Provider, b.Model)
+}
+
+// BackendError is the failure of one backend of a FallbackLLM
+type BackendError struct {
+	Backend string
+	Err     error
+}
+
+// FallbackError is returned when every backend of a FallbackLLM failed
+type FallbackError struct {
+	Errors []BackendError
+}
+
+func (e *FallbackError) Error() string {
+	parts := make([]string, len(e.Errors))
+	for i, failure := range e.Errors {
+		parts[i] = fmt.Sprintf("%s: %v", failure.Backend, failure.Err)
+	}
+	return "all backends failed: " + strings.Join(parts, "; ")
+}
+
+// Unwrap makes errors.Is match the error of any backend
+func (e *FallbackError) Unwrap() []error {
+	errs := make([]error, len(e.Errors))
+	for i, failure := range e.Errors {
+		errs[i] = failure.Err
+	}
+	return errs
+}
+
+// ShouldFailover is the default failover decision: rate limits, server
+// errors, transient network failures, timed-out attempts and requests too
+// long for the backend's context window move on to the next backend.
+// Authentication failures and filtered content do not.
+func ShouldFailover(err error) bool {
+	return IsRetryable(err) || errors.Is(err, ErrContextLength) || errors.Is(err, context.DeadlineExceeded)
+}
+
+// FallbackLLM tries an ordered chain of backends, e.g. a primary Claude
+// model, then OpenAI, then a local Ollama model, and fails over on errors
+// accepted by Failover. The backend that served a request is recorded in
+// the response's Metadata. Streams fail over only until they are established.
+//
+// A Swarm uses a FallbackLLM like any client, e.g. through a
+// ProviderRegistry factory for a provider name of your choice.
+type FallbackLLM struct {
+	Backends []Backend
+	Failover func(error) bool // Defaults to ShouldFailover
+}
+
+// NewFallbackLLM creates a chain trying backends in order
+func NewFallbackLLM(backends ...Backend) *FallbackLLM {
+	return &FallbackLLM{Backends: backends}
+}
+
+// try calls fn with each backend until one succeeds or fails with an error
+// that is not failed over
+func (f *FallbackLLM) try(ctx context.Context, req ChatCompletionRequest, fn func(ctx context.Context, backend Backend, req ChatCompletionRequest) error) (ResponseMetadata, error) {
+	failover := f.Failover
+	if failover == nil {
+		failover = ShouldFailover
+	}
+
+	var failures []BackendError
+	for _, backend := range f.Backends {
+		backendReq := req
+		if backend.Model != "" {
+			backendReq.Model = backend.Model
+		}
+
+		attemptCtx, cancel := ctx, context.CancelFunc(func() {})
+		if backend.Timeout > 0 {
+			attemptCtx, cancel = context.WithTimeout(ctx, backend.Timeout)
+		}
+		err := fn(attemptCtx, backend, backendReq)
+		cancel()
+
+		if err == nil {
+			return ResponseMetadata{
+				Backend:  backend.name(),
+				Provider: backend.Provider,
+				Model:    backendReq.Model,
+				Failures: failures,
+			}, nil
+		}
+		failures = append(failures, BackendError{Backend: backend.name(), Err: err})
+		if ctx.Err() != nil || !failover(err) {
+			break
+		}
+	}
+
+	if len(failures) == 0 {
+		return ResponseMetadata{}, errors.New("fallback chain has no backends")
+	}
+	if len(failures) == 1 {
+		return ResponseMetadata{}, failures[0].Err
+	}
+	return ResponseMetadata{}, &FallbackError{Errors: failures}
+}
+
+// CreateChatCompletion implements LLM
+func (f *FallbackLLM) CreateChatCompletion(ctx context.Context, req ChatCompletionRequest) (ChatCompletionResponse, error) {
+	var resp ChatCompletionResponse
+	metadata, err := f.try(ctx, req, func(ctx context.Context, backend Backend, req ChatCompletionRequest) error {
+		var err error
+		resp, err = backend.Client.CreateChatCompletion(ctx, req)
+		return err
+	})
+	if err != nil {
+		return ChatCompletionResponse{}, err
+	}
+	resp.Metadata = metadata
+	return resp, nil
+}
+
+// CreateChatCompletionStream implements LLM. A Backend's Timeout does not
+// apply to streams, which outlive the call that creates them.
+func (f *FallbackLLM) CreateChatCompletionStream(ctx context.Context, req ChatCompletionRequest) (ChatCompletionStream, error) {
+	var stream ChatCompletionStream
+	metadata, err := f.try(ctx, req, func(_ context.Context, backend Backend, req ChatCompletionRequest) error {
+		var err error
+		stream, err = backend.Client.CreateChatCompletionStream(ctx, req)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &fallbackStream{ChatCompletionStream: stream, metadata: metadata}, nil
+}
+
+// fallbackStream adds the serving backend to every streamed response
+type fallbackStream struct {
+	ChatCompletionStream
+	metadata ResponseMetadata
+}
+
+func (s *fallbackStream) Recv() (ChatCompletionResponse, error) {
+	resp, err := s.ChatCompletionStream.Recv()
+	if err == nil {
+		resp.Metadata = s.metadata
+	}
+	return resp, err
+}
@@ -3,10 +3,14 @@ package llm
 import (
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
+	"net/http"
 	"strings"
 
 	"github.com/google/generative-ai-go/genai"
+	"google.golang.org/api/iterator"
 	"google.golang.org/api/option"
 )
 
@@ -35,78 +39,160 @@ func NewGeminiLLM(apiKey string, opts ...GeminiOptions) (*GeminiLLM, error) {
 	}, nil
 }
 
-// convertToGeminiMessages converts our generic Message type to Gemini's content type
-func convertToGeminiMessages(messages []Message) []genai.Part {
-	var parts []genai.Part
+// NewGeminiLLMWithConfig creates a Gemini client from cfg
+func NewGeminiLLMWithConfig(cfg Config) (*GeminiLLM, error) {
+	opts := []option.ClientOption{option.WithAPIKey(cfg.APIKey)}
+	if cfg.BaseURL != "" {
+		opts = append(opts, option.WithEndpoint(cfg.BaseURL))
+	}
+	if cfg.HTTPClient != nil {
+		// A custom HTTP client bypasses WithAPIKey, so the key is added per request
+		httpClient := *cfg.HTTPClient
+		httpClient.Transport = &geminiAPIKeyTransport{apiKey: cfg.APIKey, base: cfg.HTTPClient.Transport}
+		opts = append(opts, option.WithHTTPClient(&httpClient))
+	}
 
-	for _, msg := range messages {
-		content := strings.TrimSpace(msg.Content)
-		if content == "" {
-			continue // Skip empty messages
+	client, err := genai.NewClient(context.Background(), opts...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create Gemini client: %v", err)
+	}
+
+	return &GeminiLLM{
+		client: client,
+	}, nil
+}
+
+// geminiAPIKeyTransport adds the API key header to every request
+type geminiAPIKeyTransport struct {
+	apiKey string
+	base   http.RoundTripper
+}
+
+func (t *geminiAPIKeyTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	base := t.base
+	if base == nil {
+		base = http.DefaultTransport
+	}
+	req = req.Clone(req.Context())
+	req.Header.Set("x-goog-api-key", t.apiKey)
+	return base.RoundTrip(req)
+}
+
+// convertToGeminiContents converts our generic messages to Gemini chat history.
+// System messages are returned separately for use as the system instruction,
+// and consecutive tool results are grouped into one turn of function responses.
+func convertToGeminiContents(messages []Message) (*genai.Content, []*genai.Content) {
+	var system *genai.Content
+	var contents []*genai.Content
+	var toolResults *genai.Content
+
+	flushToolResults := func() {
+		if toolResults != nil {
+			contents = append(contents, toolResults)
+			toolResults = nil
+		}
+	}
+
+	for i, msg := range messages {
+		if isToolResult(msg) {
+			if toolResults == nil {
+				toolResults = &genai.Content{Role: "user"}
+			}
+			toolResults.Parts = append(toolResults.Parts, genai.FunctionResponse{
+				Name:     resolveToolCallName(messages, i),
+				Response: map[string]any{"content": msg.Content},
+			})
+			continue
 		}
+		flushToolResults()
 
+		content := strings.TrimSpace(msg.Content)
 		switch msg.Role {
 		case RoleSystem:
-			parts = append(parts, genai.Text(fmt.Sprintf("[System]\n%s", content)))
-		case "function":
-			if msg.Name != "" {
-				parts = append(parts, genai.Text(fmt.Sprintf("[Function: %s]\n%s", msg.Name, content)))
-			} else {
-				parts = append(parts, genai.Text(fmt.Sprintf("[Function Result]\n%s", content)))
+			if content == "" {
+				continue
 			}
-		case RoleAssistant:
-			parts = append(parts, genai.Text(fmt.Sprintf("[Assistant]\n%s", content)))
+			if system == nil {
+				system = &genai.Content{}
+			}
+			system.Parts = append(system.Parts, genai.Text(content))
 		case RoleUser:
-			parts = append(parts, genai.Text(fmt.Sprintf("[User]\n%s", content)))
+			if content == "" {
+				continue // Skip empty messages
+			}
+			contents = append(contents, genai.NewUserContent(genai.Text(content)))
+		case RoleAssistant:
+			modelContent := &genai.Content{Role: "model"}
+			if content != "" {
+				modelContent.Parts = append(modelContent.Parts, genai.Text(content))
+			}
+			for _, tc := range msg.ToolCalls {
+				args := make(map[string]any)
+				if err := json.Unmarshal([]byte(tc.Function.Arguments), &args); err != nil {
+					args = make(map[string]any)
+				}
+				modelContent.Parts = append(modelContent.Parts, genai.FunctionCall{
+					Name: tc.Function.Name,
+					Args: args,
+				})
+			}
+			if len(modelContent.Parts) > 0 {
+				contents = append(contents, modelContent)
+			}
 		}
 	}
+	flushToolResults()
 
-	return parts
+	return system, contents
 }
 
-// convertFromGeminiResponse converts Gemini's response to our generic Message type
-func convertFromGeminiResponse(resp *genai.GenerateContentResponse) Message {
-	if resp == nil || len(resp.Candidates) == 0 {
-		return Message{Role: RoleAssistant, Content: ""}
+// resolveToolCallName returns the function name answered by messages[i].
+// Gemini correlates function responses by name rather than ID.
+func resolveToolCallName(messages []Message, i int) string {
+	if messages[i].Name != "" {
+		return messages[i].Name
+	}
+	id := messages[i].ToolCallID
+	for j := i - 1; j >= 0; j-- {
+		for _, toolCall := range messages[j].ToolCalls {
+			if toolCall.ID == id {
+				return toolCall.Function.Name
+			}
+		}
 	}
+	return ""
+}
 
-	content := resp.Candidates[0].Content
-	if content == nil || len(content.Parts) == 0 {
-		return Message{Role: RoleAssistant, Content: ""}
+// convertFromGeminiCandidate converts a Gemini candidate to our generic Message type
+func convertFromGeminiCandidate(c *genai.Candidate) Message {
+	msg := Message{Role: RoleAssistant}
+	if c == nil || c.Content == nil {
+		return msg
 	}
 
 	var textParts []string
-	var toolCalls []ToolCall
-
-	for _, part := range content.Parts {
+	for _, part := range c.Content.Parts {
 		switch p := part.(type) {
 		case genai.Text:
-			text := string(p)
-			// Remove role prefixes if present
-			text = strings.TrimPrefix(text, "[Assistant]\n")
-			text = strings.TrimSpace(text)
-			if text != "" {
-				textParts = append(textParts, text)
-			}
+			textParts = append(textParts, string(p))
 		case genai.FunctionCall:
 			args, err := json.Marshal(p.Args)
-			if err == nil {
-				toolCalls = append(toolCalls, ToolCall{
-					Type: "function",
-					Function: ToolCallFunction{
-						Name:      p.Name,
-						Arguments: string(args),
-					},
-				})
+			if err != nil {
+				continue
 			}
+			msg.ToolCalls = append(msg.ToolCalls, ToolCall{
+				ID:   newToolCallID(), // Gemini doesn't assign IDs to function calls
+				Type: "function",
+				Function: ToolCallFunction{
+					Name:      p.Name,
+					Arguments: string(args),
+				},
+			})
 		}
 	}
+	msg.Content = strings.Join(textParts, "")
 
-	return Message{
-		Role:      RoleAssistant,
-		Content:   strings.Join(textParts, "\n"),
-		ToolCalls: toolCalls,
-	}
+	return msg
 }
 
 // convertToGeminiTools converts our generic Tool type to Gemini's tool type
@@ -117,35 +203,10 @@ func convertToGeminiTools(tools []Tool) []*genai.Tool {
 
 	geminiTools := make([]*genai.Tool, len(tools))
 	for i, tool := range tools {
-		schema := &genai.Schema{
-			Type: genai.TypeObject,
-		}
-
-		schema.Properties = make(map[string]*genai.Schema)
-
-		if properties, ok := tool.Function.Parameters["properties"].(map[string]interface{}); ok {
-			for name, prop := range properties {
-				if propMap, ok := prop.(map[string]interface{}); ok {
-					propSchema := &genai.Schema{}
-					if typ, ok := propMap["type"].(string); ok {
-						propSchema.Type = convertSchemaType(typ)
-					}
-					if desc, ok := propMap["description"].(string); ok {
-						propSchema.Description = desc
-					}
-					schema.Properties[name] = propSchema
-				}
-			}
-		}
-
-		if required, ok := tool.Function.Parameters["required"].([]interface{}); ok {
-			reqFields := make([]string, len(required))
-			for i, r := range required {
-				if str, ok := r.(string); ok {
-					reqFields[i] = str
-				}
-			}
-			schema.Required = reqFields
+		schema := convertToGeminiSchema(tool.Function.Parameters)
+		schema.Type = genai.TypeObject
+		if schema.Properties == nil {
+			schema.Properties = make(map[string]*genai.Schema)
 		}
 
 		geminiTools[i] = &genai.Tool{
@@ -161,6 +222,68 @@ func convertToGeminiTools(tools []Tool) []*genai.Tool {
 	return geminiTools
 }
 
+// convertToGeminiSchema converts a JSON schema object to Gemini's schema type.
+// Keywords Gemini does not support are dropped.
+func convertToGeminiSchema(jsonSchema map[string]interface{}) *genai.Schema {
+	schema := &genai.Schema{}
+	if typ, ok := jsonSchema["type"].(string); ok {
+		schema.Type = convertSchemaType(typ)
+	}
+	if desc, ok := jsonSchema["description"].(string); ok {
+		schema.Description = desc
+	}
+	if format, ok := jsonSchema["format"].(string); ok {
+		schema.Format = format
+	}
+	if enum, ok := jsonSchema["enum"].([]interface{}); ok {
+		for _, v := range enum {
+			if str, ok := v.(string); ok {
+				schema.Enum = append(schema.Enum, str)
+			}
+		}
+	}
+	if items, ok := jsonSchema["items"].(map[string]interface{}); ok {
+		schema.Items = convertToGeminiSchema(items)
+	}
+	if properties, ok := jsonSchema["properties"].(map[string]interface{}); ok {
+		schema.Properties = make(map[string]*genai.Schema, len(properties))
+		for name, prop := range properties {
+			if propMap, ok := prop.(map[string]interface{}); ok {
+				schema.Properties[name] = convertToGeminiSchema(propMap)
+			}
+		}
+	}
+	switch required := jsonSchema["required"].(type) {
+	case []interface{}:
+		for _, r := range required {
+			if str, ok := r.(string); ok {
+				schema.Required = append(schema.Required, str)
+			}
+		}
+	case []string:
+		schema.Required = append(schema.Required, required...)
+	}
+	return schema
+}
+
+// convertToGeminiToolConfig converts a tool choice to Gemini's function calling config
+func convertToGeminiToolConfig(choice *ToolChoice) *genai.ToolConfig {
+	if choice == nil {
+		return nil
+	}
+	config := &genai.FunctionCallingConfig{Mode: genai.FunctionCallingAuto}
+	switch choice.Mode {
+	case ToolChoiceNone:
+		config.Mode = genai.FunctionCallingNone
+	case ToolChoiceRequired:
+		config.Mode = genai.FunctionCallingAny
+	case ToolChoiceFunction:
+		config.Mode = genai.FunctionCallingAny
+		config.AllowedFunctionNames = []string{choice.Function}
+	}
+	return &genai.ToolConfig{FunctionCallingConfig: config}
+}
+
 // convertSchemaType converts a JSON Schema type to Gemini schema type
 func convertSchemaType(typ string) genai.Type {
 	switch typ {
@@ -181,160 +304,65 @@ func convertSchemaType(typ string) genai.Type {
 	}
 }
 
-// convertFromGeminiToolCalls converts Gemini's tool calls to our generic type
-func convertFromGeminiToolCalls(parts []genai.Part) []ToolCall {
-	var calls []ToolCall
-
-	for _, part := range parts {
-		if fc, ok := part.(genai.FunctionCall); ok {
-			args, _ := json.Marshal(fc.Args)
-			calls = append(calls, ToolCall{
-				Type: "function",
-				Function: ToolCallFunction{
-					Name:      fc.Name,
-					Arguments: string(args),
-				},
-			})
-		}
-	}
-
-	return calls
-}
-
-// CreateChatCompletion implements the LLM interface for Gemini
-func (g *GeminiLLM) CreateChatCompletion(ctx context.Context, req ChatCompletionRequest) (ChatCompletionResponse, error) {
-	// Create model and configure settings
+// newChatSession configures a model for req and loads all but the last
+// message into a chat session. The last message's parts are returned so the
+// caller can send them.
+func (g *GeminiLLM) newChatSession(req ChatCompletionRequest) (*genai.ChatSession, []genai.Part, error) {
 	model := g.client.GenerativeModel(req.Model)
 
-	if req.Temperature > 0 {
-		model.SetTemperature(float32(req.Temperature))
+	if req.Temperature != nil {
+		model.SetTemperature(*req.Temperature)
 	}
-	if req.TopP > 0 {
-		model.SetTopP(float32(req.TopP))
+	if req.TopP != nil {
+		model.SetTopP(*req.TopP)
 	}
 	if req.MaxTokens > 0 {
 		model.SetMaxOutputTokens(int32(req.MaxTokens))
 	}
-
-	// Check if we're in a function calling cycle
-	inFunctionCall := false
-	if len(req.Messages) > 0 {
-		lastMsg := req.Messages[len(req.Messages)-1]
-		inFunctionCall = lastMsg.Role == "function"
+	if len(req.Stop) > 0 {
+		model.StopSequences = req.Stop
 	}
-
-	// Only set tools if we're not in a function calling cycle
-	if len(req.Tools) > 0 && !inFunctionCall {
+	if len(req.Tools) > 0 {
 		model.Tools = convertToGeminiTools(req.Tools)
+		model.ToolConfig = convertToGeminiToolConfig(req.ToolChoice)
+	} else if req.ResponseFormat.wantsJSON() {
+		// Gemini rejects JSON output together with function calling
+		model.ResponseMIMEType = "application/json"
+		if req.ResponseFormat.Schema != nil {
+			model.ResponseSchema = convertToGeminiSchema(req.ResponseFormat.Schema)
+		}
 	}
 
-	// Convert messages to Gemini format
-	parts := convertToGeminiMessages(req.Messages)
+	system, contents := convertToGeminiContents(req.Messages)
+	model.SystemInstruction = system
+	if len(contents) == 0 {
+		return nil, nil, errors.New("gemini: no messages to send")
+	}
+
+	cs := model.StartChat()
+	cs.History = contents[:len(contents)-1]
+	return cs, contents[len(contents)-1].Parts, nil
+}
+
+// CreateChatCompletion implements the LLM interface for Gemini
+func (g *GeminiLLM) CreateChatCompletion(ctx context.Context, req ChatCompletionRequest) (ChatCompletionResponse, error) {
+	cs, parts, err := g.newChatSession(req)
+	if err != nil {
+		return ChatCompletionResponse{}, err
+	}
 
 	// Generate response
-	resp, err := model.GenerateContent(ctx, parts...)
+	resp, err := cs.SendMessage(ctx, parts...)
 	if err != nil {
-		return ChatCompletionResponse{}, fmt.Errorf("failed to generate content: %v", err)
+		return ChatCompletionResponse{}, fmt.Errorf("failed to generate content: %w", classifyError(Gemini, err))
 	}
 
 	// Convert response to our format
 	choices := make([]Choice, len(resp.Candidates))
 	for i, c := range resp.Candidates {
-		msg := Message{
-			Role:    RoleAssistant,
-			Content: "",
-		}
-
-		// Handle function calls and text separately
-		var textParts []string
-		for _, part := range c.Content.Parts {
-			switch p := part.(type) {
-			case genai.Text:
-				textParts = append(textParts, string(p))
-			case genai.FunctionCall:
-				if !inFunctionCall {
-					args, err := json.Marshal(p.Args)
-					if err != nil {
-						continue
-					}
-					msg.ToolCalls = append(msg.ToolCalls, ToolCall{
-						Type: "function",
-						Function: ToolCallFunction{
-							Name:      p.Name,
-							Arguments: string(args),
-						},
-					})
-				}
-			}
-		}
-		msg.Content = strings.Join(textParts, "")
-
-		// If we have function calls and we're not in a function calling cycle
-		if len(msg.ToolCalls) > 0 && !inFunctionCall {
-			// Create new messages array with original messages plus function results
-			var newMessages []Message
-			newMessages = append(newMessages, req.Messages...)
-
-			// Add assistant's message with function calls
-			newMessages = append(newMessages, Message{
-				Role:      RoleAssistant,
-				Content:   msg.Content,
-				ToolCalls: msg.ToolCalls,
-			})
-
-			// Add function results
-			for _, toolCall := range msg.ToolCalls {
-				newMessages = append(newMessages, Message{
-					Role:    "function",
-					Content: toolCall.Function.Arguments,
-					Name:    toolCall.Function.Name,
-				})
-			}
-
-			// Create a new request for the final response
-			finalReq := ChatCompletionRequest{
-				Model:       req.Model,
-				Messages:    newMessages,
-				Temperature: req.Temperature,
-				TopP:        req.TopP,
-				MaxTokens:   req.MaxTokens,
-			}
-
-			// Create a new model instance for the final response
-			finalModel := g.client.GenerativeModel(finalReq.Model)
-			if finalReq.Temperature > 0 {
-				finalModel.SetTemperature(float32(finalReq.Temperature))
-			}
-			if finalReq.TopP > 0 {
-				finalModel.SetTopP(float32(finalReq.TopP))
-			}
-			if finalReq.MaxTokens > 0 {
-				finalModel.SetMaxOutputTokens(int32(finalReq.MaxTokens))
-			}
-
-			// Convert messages to Gemini format
-			finalParts := convertToGeminiMessages(newMessages)
-
-			// Get the final response
-			finalResp, err := finalModel.GenerateContent(ctx, finalParts...)
-			if err != nil {
-				return ChatCompletionResponse{}, fmt.Errorf("failed to generate final response: %v", err)
-			}
-
-			if len(finalResp.Candidates) > 0 {
-				var finalTextParts []string
-				for _, part := range finalResp.Candidates[0].Content.Parts {
-					if t, ok := part.(genai.Text); ok {
-						finalTextParts = append(finalTextParts, string(t))
-					}
-				}
-				msg.Content = strings.Join(finalTextParts, "")
-			}
-		}
-
 		choices[i] = Choice{
 			Index:        i,
-			Message:      msg,
+			Message:      convertFromGeminiCandidate(c),
 			FinishReason: string(c.FinishReason),
 		}
 	}
@@ -356,83 +384,28 @@ func (g *GeminiLLM) CreateChatCompletion(ctx context.Context, req ChatCompletion
 
 // geminiStreamWrapper wraps Gemini's stream to implement our ChatCompletionStream interface
 type geminiStreamWrapper struct {
-	iter            *genai.GenerateContentResponseIterator
-	client          *GeminiLLM
-	req             ChatCompletionRequest
-	ctx             context.Context
-	inFunctionCall  bool
-	currentToolCall *ToolCall
-	toolCallBuffer  map[string]*ToolCall
+	iter *genai.GenerateContentResponseIterator
 }
 
 func (w *geminiStreamWrapper) Recv() (ChatCompletionResponse, error) {
+	if w.iter == nil {
+		return ChatCompletionResponse{}, io.EOF
+	}
+
 	// Get next response from iterator
 	resp, err := w.iter.Next()
+	if err == iterator.Done {
+		return ChatCompletionResponse{}, io.EOF
+	}
 	if err != nil {
-		if w.inFunctionCall {
-			// If we're in a function call and hit the end, start a new stream for the response
-			w.inFunctionCall = false
-			w.iter = nil
-			return w.handleFunctionResponse()
-		}
-		return ChatCompletionResponse{}, err
+		return ChatCompletionResponse{}, classifyError(Gemini, err)
 	}
 
 	choices := make([]Choice, len(resp.Candidates))
 	for i, c := range resp.Candidates {
-		msg := Message{
-			Role:    RoleAssistant,
-			Content: "",
-		}
-
-		// Handle function calls and text separately
-		var textParts []string
-		for _, part := range c.Content.Parts {
-			switch p := part.(type) {
-			case genai.Text:
-				textParts = append(textParts, string(p))
-			case genai.FunctionCall:
-				if !w.inFunctionCall {
-					args, err := json.Marshal(p.Args)
-					if err != nil {
-						continue
-					}
-
-					// Create or update tool call
-					toolCall, exists := w.toolCallBuffer[p.Name]
-					if !exists {
-						toolCall = &ToolCall{
-							ID:   p.Name, // Use function name as ID since Gemini doesn't provide one
-							Type: "function",
-							Function: ToolCallFunction{
-								Name:      p.Name,
-								Arguments: "",
-							},
-						}
-						w.toolCallBuffer[p.Name] = toolCall
-						w.currentToolCall = toolCall
-					}
-
-					// Update arguments
-					toolCall.Function.Arguments += string(args)
-
-					// Try to parse the arguments to verify if it's complete JSON
-					var parsedArgs map[string]interface{}
-					if err := json.Unmarshal([]byte(toolCall.Function.Arguments), &parsedArgs); err == nil {
-						// Add to message's tool calls and remove from buffer
-						msg.ToolCalls = append(msg.ToolCalls, *toolCall)
-						delete(w.toolCallBuffer, p.Name)
-						w.currentToolCall = nil
-						w.inFunctionCall = true
-					}
-				}
-			}
-		}
-		msg.Content = strings.Join(textParts, "")
-
 		choices[i] = Choice{
 			Index:        i,
-			Message:      msg,
+			Message:      convertFromGeminiCandidate(c),
 			FinishReason: string(c.FinishReason),
 		}
 	}
@@ -442,46 +415,6 @@ func (w *geminiStreamWrapper) Recv() (ChatCompletionResponse, error) {
 	}, nil
 }
 
-func (w *geminiStreamWrapper) handleFunctionResponse() (ChatCompletionResponse, error) {
-	// Create new messages array with original messages plus function results
-	var newMessages []Message
-	newMessages = append(newMessages, w.req.Messages...)
-
-	// Add the last assistant message with function calls
-	lastAssistantMsg := w.req.Messages[len(w.req.Messages)-1]
-	newMessages = append(newMessages, lastAssistantMsg)
-
-	// Add function results from tool calls
-	for _, toolCall := range lastAssistantMsg.ToolCalls {
-		newMessages = append(newMessages, Message{
-			Role:    "function",
-			Content: toolCall.Function.Arguments,
-			Name:    toolCall.Function.Name,
-		})
-	}
-
-	// Create a new model instance for the final response
-	model := w.client.client.GenerativeModel(w.req.Model)
-	if w.req.Temperature > 0 {
-		model.SetTemperature(float32(w.req.Temperature))
-	}
-	if w.req.TopP > 0 {
-		model.SetTopP(float32(w.req.TopP))
-	}
-	if w.req.MaxTokens > 0 {
-		model.SetMaxOutputTokens(int32(w.req.MaxTokens))
-	}
-
-	// Convert messages to Gemini format
-	parts := convertToGeminiMessages(newMessages)
-
-	// Start new stream for the response
-	w.iter = model.GenerateContentStream(w.ctx, parts...)
-
-	// Get first response from new stream
-	return w.Recv()
-}
-
 func (w *geminiStreamWrapper) Close() error {
 	w.iter = nil
 	return nil
@@ -489,43 +422,13 @@ func (w *geminiStreamWrapper) Close() error {
 
 // CreateChatCompletionStream implements the LLM interface for Gemini streaming
 func (g *GeminiLLM) CreateChatCompletionStream(ctx context.Context, req ChatCompletionRequest) (ChatCompletionStream, error) {
-	// Create model and configure settings
-	model := g.client.GenerativeModel(req.Model)
-
-	if req.Temperature > 0 {
-		model.SetTemperature(float32(req.Temperature))
-	}
-	if req.TopP > 0 {
-		model.SetTopP(float32(req.TopP))
-	}
-	if req.MaxTokens > 0 {
-		model.SetMaxOutputTokens(int32(req.MaxTokens))
-	}
-
-	// Check if we're in a function calling cycle
-	inFunctionCall := false
-	if len(req.Messages) > 0 {
-		lastMsg := req.Messages[len(req.Messages)-1]
-		inFunctionCall = lastMsg.Role == "function" || (lastMsg.Role == RoleAssistant && len(lastMsg.ToolCalls) > 0)
-	}
-
-	// Only set tools if we're not in a function calling cycle
-	if len(req.Tools) > 0 && !inFunctionCall {
-		model.Tools = convertToGeminiTools(req.Tools)
+	cs, parts, err := g.newChatSession(req)
+	if err != nil {
+		return nil, err
 	}
 
-	// Convert messages to Gemini format
-	parts := convertToGeminiMessages(req.Messages)
-
 	// Generate streaming response
-	iter := model.GenerateContentStream(ctx, parts...)
-
 	return &geminiStreamWrapper{
-		iter:           iter,
-		client:         g,
-		req:            req,
-		ctx:            ctx,
-		inFunctionCall: inFunctionCall,
-		toolCallBuffer: make(map[string]*ToolCall),
+		iter: cs.SendMessageStream(ctx, parts...),
 	}, nil
 }
@@ -2,6 +2,8 @@ package llm
 
 import (
 	"context"
+	"crypto/rand"
+	"encoding/hex"
 )
 
 // Role represents the role of a message participant
@@ -29,35 +31,150 @@ const (
 	DeepSeek        LLMProvider = "DEEPSEEK"
 )
 
-// Message represents a single message in a chat conversation
+// Message represents a single message in a chat conversation.
+// Tool results use RoleTool and set ToolCallID to the ID of the ToolCall
+// they answer.
 type Message struct {
-	Role      Role       `json:"role"`
-	Content   string     `json:"content"`
-	Name      string     `json:"name,omitempty"`
-	ToolCalls []ToolCall `json:"tool_calls,omitempty"`
+	Role       Role       `json:"role"`
+	Content    string     `json:"content"`
+	Name       string     `json:"name,omitempty"`
+	ToolCalls  []ToolCall `json:"tool_calls,omitempty"`
+	ToolCallID string     `json:"tool_call_id,omitempty"`
 }
 
-// ChatCompletionRequest represents a generic request for chat completion
+// ChatCompletionRequest represents a generic request for chat completion.
+// Temperature, TopP and Seed are pointers so that an explicit zero can be
+// told apart from the provider default.
 type ChatCompletionRequest struct {
-	Model            string    `json:"model"`
-	Messages         []Message `json:"messages"`
-	Temperature      float32   `json:"temperature,omitempty"`
-	TopP             float32   `json:"top_p,omitempty"`
-	N                int       `json:"n,omitempty"`
-	Stop             []string  `json:"stop,omitempty"`
-	MaxTokens        int       `json:"max_tokens,omitempty"`
-	PresencePenalty  float32   `json:"presence_penalty,omitempty"`
-	FrequencyPenalty float32   `json:"frequency_penalty,omitempty"`
-	User             string    `json:"user,omitempty"`
-	Tools            []Tool    `json:"tools,omitempty"`
-	Stream           bool      `json:"stream,omitempty"`
+	Model            string          `json:"model"`
+	Messages         []Message       `json:"messages"`
+	Temperature      *float32        `json:"temperature,omitempty"`
+	TopP             *float32        `json:"top_p,omitempty"`
+	N                int             `json:"n,omitempty"`
+	Stop             []string        `json:"stop,omitempty"`
+	MaxTokens        int             `json:"max_tokens,omitempty"`
+	PresencePenalty  float32         `json:"presence_penalty,omitempty"`
+	FrequencyPenalty float32         `json:"frequency_penalty,omitempty"`
+	Seed             *int            `json:"seed,omitempty"`
+	User             string          `json:"user,omitempty"`
+	Tools            []Tool          `json:"tools,omitempty"`
+	Stream           bool            `json:"stream,omitempty"`
+	ResponseFormat   *ResponseFormat `json:"response_format,omitempty"`
+	ToolChoice       *ToolChoice     `json:"tool_choice,omitempty"`
+}
+
+// ToolChoiceMode controls whether the model may or must call tools
+type ToolChoiceMode string
+
+const (
+	ToolChoiceAuto     ToolChoiceMode = "auto"     // The model decides
+	ToolChoiceNone     ToolChoiceMode = "none"     // The model must not call tools
+	ToolChoiceRequired ToolChoiceMode = "required" // The model must call at least one tool
+	ToolChoiceFunction ToolChoiceMode = "function" // The model must call the named function
+)
+
+// ToolChoice controls tool use for a request. Ollama cannot force a call;
+// it only drops the tools a choice rules out.
+type ToolChoice struct {
+	Mode     ToolChoiceMode `json:"mode"`
+	Function string         `json:"function,omitempty"` // Function to call with ToolChoiceFunction
+}
+
+// ForceTool returns a choice that makes the model call the named function
+func ForceTool(name string) *ToolChoice {
+	return &ToolChoice{Mode: ToolChoiceFunction, Function: name}
+}
+
+// Forces reports whether c makes the model call a tool
+func (c *ToolChoice) Forces() bool {
+	return c != nil && (c.Mode == ToolChoiceRequired || c.Mode == ToolChoiceFunction)
+}
+
+// allowedTools returns the tools c leaves available to the model
+func (c *ToolChoice) allowedTools(tools []Tool) []Tool {
+	if c == nil {
+		return tools
+	}
+	switch c.Mode {
+	case ToolChoiceNone:
+		return nil
+	case ToolChoiceFunction:
+		for _, tool := range tools {
+			if tool.Function != nil && tool.Function.Name == c.Function {
+				return []Tool{tool}
+			}
+		}
+		return nil
+	}
+	return tools
+}
+
+// openAIToolChoice returns c in the OpenAI wire format, also used by DeepSeek
+func (c *ToolChoice) openAIToolChoice() interface{} {
+	if c == nil {
+		return nil
+	}
+	if c.Mode == ToolChoiceFunction {
+		return map[string]interface{}{
+			"type":     "function",
+			"function": map[string]string{"name": c.Function},
+		}
+	}
+	return string(c.Mode)
+}
+
+// ResponseFormatType selects the kind of output requested from the model
+type ResponseFormatType string
+
+const (
+	ResponseFormatText       ResponseFormatType = "text"
+	ResponseFormatJSONObject ResponseFormatType = "json_object"
+	ResponseFormatJSONSchema ResponseFormatType = "json_schema"
+)
+
+// ResponseFormat requests JSON output. With ResponseFormatJSONSchema the
+// output should match Schema, a JSON schema object named Name. Providers
+// without native support rely on the prompt; Claude is made to call a tool
+// named Name whose input is the output.
+type ResponseFormat struct {
+	Type   ResponseFormatType     `json:"type"`
+	Name   string                 `json:"name,omitempty"`
+	Schema map[string]interface{} `json:"schema,omitempty"`
+	Strict bool                   `json:"strict,omitempty"`
+}
+
+// wantsJSON reports whether f requests JSON output
+func (f *ResponseFormat) wantsJSON() bool {
+	return f != nil && (f.Type == ResponseFormatJSONObject || f.Type == ResponseFormatJSONSchema)
+}
+
+// name returns the schema name, defaulting to "response"
+func (f *ResponseFormat) name() string {
+	if f.Name == "" {
+		return "response"
+	}
+	return f.Name
+}
+
+// Ptr returns a pointer to v, for setting optional request fields
+func Ptr[T any](v T) *T {
+	return &v
 }
 
 // ChatCompletionResponse represents a generic response from chat completion
 type ChatCompletionResponse struct {
-	ID      string   `json:"id"`
-	Choices []Choice `json:"choices"`
-	Usage   Usage    `json:"usage"`
+	ID       string           `json:"id"`
+	Choices  []Choice         `json:"choices"`
+	Usage    Usage            `json:"usage"`
+	Metadata ResponseMetadata `json:"-"` // Set by clients that route requests, such as FallbackLLM
+}
+
+// ResponseMetadata tells which backend served a response
+type ResponseMetadata struct {
+	Backend  string
+	Provider LLMProvider
+	Model    string         // Model that served the request
+	Failures []BackendError // Backends that failed before, in order
 }
 
 // Choice represents a completion choice
@@ -125,3 +242,37 @@ type ToolCallFunction struct {
 	Name      string `json:"name"`
 	Arguments string `json:"arguments"`
 }
+
+// isToolResult reports whether msg carries the result of a tool call.
+// RoleFunction is accepted for histories built before RoleTool was used.
+func isToolResult(msg Message) bool {
+	return msg.Role == RoleTool || msg.Role == RoleFunction
+}
+
+// resolveToolCallID returns the ID of the tool call answered by messages[i].
+// Legacy results without a ToolCallID are matched by function name against
+// the closest preceding assistant message with tool calls.
+func resolveToolCallID(messages []Message, i int) string {
+	if messages[i].ToolCallID != "" {
+		return messages[i].ToolCallID
+	}
+	for j := i - 1; j >= 0; j-- {
+		if messages[j].Role != RoleAssistant || len(messages[j].ToolCalls) == 0 {
+			continue
+		}
+		for _, toolCall := range messages[j].ToolCalls {
+			if toolCall.Function.Name == messages[i].Name {
+				return toolCall.ID
+			}
+		}
+		break
+	}
+	return ""
+}
+
+// newToolCallID generates an ID for providers whose tool calls carry none.
+func newToolCallID() string {
+	b := make([]byte, 12)
+	_, _ = rand.Read(b)
+	return "call_" + hex.EncodeToString(b)
+}
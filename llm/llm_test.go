@@ -0,0 +1,456 @@
+package llm
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/google/generative-ai-go/genai"
+	"github.com/invopop/jsonschema"
+)
+
+// sameToolTwice is a history where one assistant turn calls the same function
+// twice and both results come back.
+func sameToolTwice() []Message {
+	return []Message{
+		{Role: RoleUser, Content: "weather in Paris and Rome?"},
+		{Role: RoleAssistant, ToolCalls: []ToolCall{
+			{ID: "call_paris", Type: "function", Function: ToolCallFunction{Name: "weather", Arguments: `{"city":"Paris"}`}},
+			{ID: "call_rome", Type: "function", Function: ToolCallFunction{Name: "weather", Arguments: `{"city":"Rome"}`}},
+		}},
+		{Role: RoleTool, Name: "weather", ToolCallID: "call_paris", Content: "sunny"},
+		{Role: RoleTool, Name: "weather", ToolCallID: "call_rome", Content: "rainy"},
+	}
+}
+
+func TestConvertToOpenAIMessagesKeepsToolCallIDs(t *testing.T) {
+	converted := convertToOpenAIMessages(sameToolTwice())
+
+	if got := len(converted[1].ToolCalls); got != 2 {
+		t.Fatalf("expected 2 tool calls on the assistant message, got %d", got)
+	}
+	for i, want := range []string{"call_paris", "call_rome"} {
+		msg := converted[2+i]
+		if msg.Role != "tool" || msg.ToolCallID != want {
+			t.Errorf("message %d: expected tool result for %s, got role %q id %q", 2+i, want, msg.Role, msg.ToolCallID)
+		}
+	}
+}
+
+func TestConvertToDeepSeekMessagesKeepsToolCallIDs(t *testing.T) {
+	converted, err := convertToDeepSeekMessages(sameToolTwice())
+	if err != nil {
+		t.Fatalf("convertToDeepSeekMessages returned error: %v", err)
+	}
+	if converted[2].ToolCallID != "call_paris" || converted[3].ToolCallID != "call_rome" {
+		t.Errorf("tool results lost their IDs: %q, %q", converted[2].ToolCallID, converted[3].ToolCallID)
+	}
+}
+
+func TestConvertToClaudeMessagesGroupsToolResults(t *testing.T) {
+	converted := convertToClaudeMessages(sameToolTwice())
+
+	// user, assistant(tool_use x2), user(tool_result x2)
+	if len(converted) != 3 {
+		t.Fatalf("expected 3 Claude messages, got %d", len(converted))
+	}
+	if got := len(converted[2].Content.Value); got != 2 {
+		t.Errorf("expected 2 tool_result blocks, got %d", got)
+	}
+}
+
+func TestResolveToolCallIDFallsBackToName(t *testing.T) {
+	messages := sameToolTwice()[:3]
+	messages[2] = Message{Role: RoleFunction, Name: "weather", Content: "sunny"}
+
+	if got := resolveToolCallID(messages, 2); got != "call_paris" {
+		t.Errorf("expected call_paris, got %q", got)
+	}
+}
+
+func TestNewLLMAppliesConfig(t *testing.T) {
+	var gotModel, gotAuth string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var body struct {
+			Model string `json:"model"`
+		}
+		_ = json.NewDecoder(r.Body).Decode(&body)
+		gotModel = body.Model
+		gotAuth = r.Header.Get("Authorization")
+		_, _ = w.Write([]byte(`{"id":"1","choices":[{"message":{"role":"assistant","content":"hi"}}]}`))
+	}))
+	defer server.Close()
+
+	client, err := NewLLM(DeepSeek, Config{
+		APIKey:          "secret",
+		BaseURL:         server.URL,
+		HTTPClient:      server.Client(),
+		ModelMapperFunc: func(model string) string { return "deployment-" + model },
+	})
+	if err != nil {
+		t.Fatalf("NewLLM returned error: %v", err)
+	}
+
+	resp, err := client.CreateChatCompletion(context.Background(), ChatCompletionRequest{
+		Model:    "chat",
+		Messages: []Message{{Role: RoleUser, Content: "hello"}},
+	})
+	if err != nil {
+		t.Fatalf("CreateChatCompletion returned error: %v", err)
+	}
+	if resp.Choices[0].Message.Content != "hi" {
+		t.Errorf("unexpected content %q", resp.Choices[0].Message.Content)
+	}
+	if gotModel != "deployment-chat" {
+		t.Errorf("expected mapped model, got %q", gotModel)
+	}
+	if gotAuth != "Bearer secret" {
+		t.Errorf("unexpected Authorization header %q", gotAuth)
+	}
+}
+
+func TestResponseFormatConversion(t *testing.T) {
+	format := &ResponseFormat{
+		Type: ResponseFormatJSONSchema,
+		Name: "invoice",
+		Schema: map[string]interface{}{
+			"type":       "object",
+			"properties": map[string]interface{}{"total": map[string]interface{}{"type": "number"}},
+			"required":   []interface{}{"total"},
+		},
+	}
+
+	data, err := json.Marshal(convertToOpenAIRequest(ChatCompletionRequest{ResponseFormat: format}))
+	if err != nil {
+		t.Fatalf("failed to marshal OpenAI request: %v", err)
+	}
+	var openAIReq struct {
+		ResponseFormat struct {
+			Type       string `json:"type"`
+			JSONSchema struct {
+				Name   string                 `json:"name"`
+				Schema map[string]interface{} `json:"schema"`
+			} `json:"json_schema"`
+		} `json:"response_format"`
+	}
+	if err := json.Unmarshal(data, &openAIReq); err != nil {
+		t.Fatalf("failed to unmarshal OpenAI request: %v", err)
+	}
+	if openAIReq.ResponseFormat.Type != "json_schema" || openAIReq.ResponseFormat.JSONSchema.Name != "invoice" ||
+		openAIReq.ResponseFormat.JSONSchema.Schema["type"] != "object" {
+		t.Errorf("unexpected OpenAI response format: %s", data)
+	}
+
+	if got := convertToDeepSeekResponseFormat(format); got == nil || got.Type != "json_object" {
+		t.Errorf("expected DeepSeek JSON mode, got %+v", got)
+	}
+
+	message := extractClaudeOutput(Message{
+		Role: RoleAssistant,
+		ToolCalls: []ToolCall{
+			{ID: "toolu_1", Function: ToolCallFunction{Name: "invoice", Arguments: `{"total":12.5}`}},
+		},
+	}, "invoice")
+	if message.Content != `{"total":12.5}` || len(message.ToolCalls) != 0 {
+		t.Errorf("expected the output tool call to become the content, got %+v", message)
+	}
+}
+
+func TestToolChoiceConversion(t *testing.T) {
+	tools := []Tool{
+		{Type: "function", Function: &Function{Name: "search"}},
+		{Type: "function", Function: &Function{Name: "TransferToBilling"}},
+	}
+
+	req := convertToOpenAIRequest(ChatCompletionRequest{Tools: tools, ToolChoice: ForceTool("TransferToBilling")})
+	data, _ := json.Marshal(req.ToolChoice)
+	if string(data) != `{"function":{"name":"TransferToBilling"},"type":"function"}` {
+		t.Errorf("unexpected OpenAI tool choice %s", data)
+	}
+	req = convertToOpenAIRequest(ChatCompletionRequest{Tools: tools, ToolChoice: &ToolChoice{Mode: ToolChoiceRequired}})
+	if req.ToolChoice != "required" {
+		t.Errorf("unexpected OpenAI tool choice %v", req.ToolChoice)
+	}
+
+	config := convertToGeminiToolConfig(ForceTool("search")).FunctionCallingConfig
+	if config.Mode != genai.FunctionCallingAny || len(config.AllowedFunctionNames) != 1 {
+		t.Errorf("unexpected Gemini config %+v", config)
+	}
+
+	data, _ = json.Marshal(convertToClaudeToolChoice(&ToolChoice{Mode: ToolChoiceNone}))
+	if string(data) != `{"type":"none"}` {
+		t.Errorf("unexpected Claude tool choice %s", data)
+	}
+
+	if allowed := ForceTool("search").allowedTools(tools); len(allowed) != 1 || allowed[0].Function.Name != "search" {
+		t.Errorf("expected only the forced tool to remain, got %+v", allowed)
+	}
+}
+
+func TestOllamaToolConversion(t *testing.T) {
+	// Schemas reflected from Go types have no property descriptions
+	type refund struct {
+		Reason   string   `json:"reason" jsonschema:"enum=damaged,enum=late"`
+		Amount   float64  `json:"amount"`
+		Invoices []string `json:"invoices,omitempty"`
+	}
+	reflector := jsonschema.Reflector{AllowAdditionalProperties: false, DoNotReference: true}
+	data, err := json.Marshal(reflector.Reflect(refund{}))
+	if err != nil {
+		t.Fatalf("failed to reflect schema: %v", err)
+	}
+	var schema map[string]interface{}
+	if err := json.Unmarshal(data, &schema); err != nil {
+		t.Fatalf("failed to decode schema: %v", err)
+	}
+
+	tools := convertToOllamaTools([]Tool{
+		{Type: "function", Function: &Function{Name: "refund", Parameters: schema}},
+		{Type: "function", Function: &Function{Name: "ping"}},
+		{Type: "function", Function: &Function{Name: "lookup", Parameters: map[string]interface{}{
+			"type":       "object",
+			"properties": map[string]interface{}{"id": map[string]interface{}{"type": "string"}},
+			"required":   []string{"id"},
+		}}},
+	})
+	params := tools[0].Function.Parameters
+	if params.Type != "object" || len(params.Required) != 2 || len(params.Properties) != 3 {
+		t.Errorf("unexpected parameters %+v", params)
+	}
+	if reason := params.Properties["reason"]; reason.Type != "string" || len(reason.Enum) != 2 {
+		t.Errorf("unexpected reason property %+v", reason)
+	}
+	if params := tools[1].Function.Parameters; params.Type != "object" || len(params.Properties) != 0 {
+		t.Errorf("expected an empty object schema, got %+v", params)
+	}
+	if required := tools[2].Function.Parameters.Required; len(required) != 1 || required[0] != "id" {
+		t.Errorf("expected the required list to be kept, got %v", required)
+	}
+}
+
+// scriptedServer answers each request with the next status; 200 returns a
+// minimal completion. It counts the requests it receives.
+func scriptedServer(t *testing.T, header http.Header, body string, statuses ...int) (*httptest.Server, *int) {
+	calls := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		status := statuses[len(statuses)-1]
+		if calls < len(statuses) {
+			status = statuses[calls]
+		}
+		calls++
+		if status == http.StatusOK {
+			_, _ = w.Write([]byte(`{"id":"1","object":"chat.completion","choices":[{"message":{"role":"assistant","content":"hi"}}]}`))
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		for k, v := range header {
+			w.Header()[k] = v
+		}
+		w.WriteHeader(status)
+		_, _ = w.Write([]byte(body))
+	}))
+	t.Cleanup(server.Close)
+	return server, &calls
+}
+
+func TestRetryAndErrorClassification(t *testing.T) {
+	policy := RetryPolicy{MaxRetries: 2, InitialBackoff: time.Millisecond, Jitter: 0.5, MaxRetryAfter: time.Second}
+	request := ChatCompletionRequest{Model: "chat", Messages: []Message{{Role: RoleUser, Content: "hello"}}}
+	rateLimited := `{"error":{"message":"slow down"}}`
+
+	newClient := func(provider LLMProvider, server *httptest.Server) LLM {
+		client, err := NewLLM(provider, Config{APIKey: "secret", BaseURL: server.URL, HTTPClient: server.Client(), Retry: &policy})
+		if err != nil {
+			t.Fatalf("NewLLM returned error: %v", err)
+		}
+		return client
+	}
+
+	for _, provider := range []LLMProvider{DeepSeek, OpenAI} {
+		server, calls := scriptedServer(t, nil, rateLimited, http.StatusTooManyRequests, http.StatusBadGateway, http.StatusOK)
+		resp, err := newClient(provider, server).CreateChatCompletion(context.Background(), request)
+		if err != nil || *calls != 3 || resp.Choices[0].Message.Content != "hi" {
+			t.Errorf("%s: expected success on the third attempt, got %v after %d calls", provider, err, *calls)
+		}
+
+		server, calls = scriptedServer(t, nil, `{"error":{"message":"bad key"}}`, http.StatusUnauthorized)
+		_, err = newClient(provider, server).CreateChatCompletion(context.Background(), request)
+		if !errors.Is(err, ErrAuth) || *calls != 1 {
+			t.Errorf("%s: expected ErrAuth without retries, got %v after %d calls", provider, err, *calls)
+		}
+
+		server, calls = scriptedServer(t, nil, `{"error":{"message":"boom"}}`, http.StatusInternalServerError)
+		_, err = newClient(provider, server).CreateChatCompletion(context.Background(), request)
+		var apiErr *APIError
+		if !errors.Is(err, ErrServer) || !errors.As(err, &apiErr) || apiErr.StatusCode != 500 || *calls != 3 {
+			t.Errorf("%s: expected ErrServer after every retry, got %v after %d calls", provider, err, *calls)
+		}
+	}
+
+	// Retry-After beyond the policy's limit fails at once
+	for _, provider := range []LLMProvider{DeepSeek, OpenAI, Ollama} {
+		server, calls := scriptedServer(t, http.Header{"Retry-After": {"120"}}, `{"error":"slow down"}`, http.StatusTooManyRequests)
+		_, err := newClient(provider, server).CreateChatCompletion(context.Background(), request)
+		var apiErr *APIError
+		if !errors.Is(err, ErrRateLimited) || !errors.As(err, &apiErr) || apiErr.RetryAfter != 2*time.Minute || *calls != 1 {
+			t.Errorf("%s: expected the long Retry-After to be reported, got %v after %d calls", provider, err, *calls)
+		}
+	}
+
+	// SDKs with their own retries leave them to the policy
+	for provider, status := range map[LLMProvider]int{Claude: http.StatusInternalServerError, Gemini: http.StatusServiceUnavailable} {
+		server, calls := scriptedServer(t, nil, `{"error":{"message":"boom"}}`, status)
+		_, err := newClient(provider, server).CreateChatCompletion(context.Background(), request)
+		if !errors.Is(err, ErrServer) || *calls != 3 {
+			t.Errorf("%s: expected ErrServer after the policy's attempts only, got %v after %d calls", provider, err, *calls)
+		}
+	}
+
+	// go-openai reports errors with a non-JSON body as plain text
+	server, calls := scriptedServer(t, http.Header{"Content-Type": {"text/html"}}, "<html>bad gateway</html>", http.StatusBadGateway, http.StatusOK)
+	if _, err := newClient(OpenAI, server).CreateChatCompletion(context.Background(), request); err != nil || *calls != 2 {
+		t.Errorf("expected a retry after a proxy error page, got %v after %d calls", err, *calls)
+	}
+
+	// A failed stream reports the response body
+	server, _ = scriptedServer(t, nil, `{"error":{"message":"This model's maximum context length is 64 tokens"}}`, http.StatusBadRequest)
+	_, err := newClient(DeepSeek, server).CreateChatCompletionStream(context.Background(), request)
+	if !errors.Is(err, ErrContextLength) || !strings.Contains(err.Error(), "maximum context length") {
+		t.Errorf("expected ErrContextLength with the provider message, got %v", err)
+	}
+}
+
+// stubLLM answers with a fixed response or error
+type stubLLM struct {
+	calls  int
+	models []string
+	err    error
+}
+
+func (s *stubLLM) CreateChatCompletion(ctx context.Context, req ChatCompletionRequest) (ChatCompletionResponse, error) {
+	s.calls++
+	s.models = append(s.models, req.Model)
+	if s.err != nil {
+		return ChatCompletionResponse{}, s.err
+	}
+	return ChatCompletionResponse{Choices: []Choice{{Message: Message{Role: RoleAssistant, Content: "hi"}}}}, nil
+}
+
+func (s *stubLLM) CreateChatCompletionStream(ctx context.Context, req ChatCompletionRequest) (ChatCompletionStream, error) {
+	s.calls++
+	return stubStream{}, s.err
+}
+
+// stubStream ends at once
+type stubStream struct{}
+
+func (stubStream) Recv() (ChatCompletionResponse, error) { return ChatCompletionResponse{}, io.EOF }
+func (stubStream) Close() error                          { return nil }
+
+func TestFallbackLLM(t *testing.T) {
+	overloaded := &stubLLM{err: &APIError{Provider: Claude, StatusCode: 529, Kind: ErrServer}}
+	openai := &stubLLM{}
+	local := &stubLLM{}
+	chain := NewFallbackLLM(
+		Backend{Provider: Claude, Model: "claude-3-5-sonnet", Client: overloaded},
+		Backend{Provider: OpenAI, Model: "gpt-4o", Client: openai},
+		Backend{Name: "local", Provider: Ollama, Model: "llama3", Client: local},
+	)
+
+	resp, err := chain.CreateChatCompletion(context.Background(), ChatCompletionRequest{Model: "default"})
+	if err != nil {
+		t.Fatalf("CreateChatCompletion returned error: %v", err)
+	}
+	if resp.Metadata.Backend != "OPEN_AI/gpt-4o" || resp.Metadata.Model != "gpt-4o" || len(resp.Metadata.Failures) != 1 {
+		t.Errorf("expected OpenAI to serve after one failure, got %+v", resp.Metadata)
+	}
+	if openai.models[0] != "gpt-4o" || local.calls != 0 {
+		t.Errorf("expected the backend's model and no further attempts, got %v and %d", openai.models, local.calls)
+	}
+
+	// Errors that are not failed over stop the chain
+	openai.err = &APIError{Provider: OpenAI, StatusCode: 401, Kind: ErrAuth}
+	if _, err := chain.CreateChatCompletion(context.Background(), ChatCompletionRequest{}); !errors.Is(err, ErrAuth) || local.calls != 0 {
+		t.Errorf("expected ErrAuth without reaching the local backend, got %v", err)
+	}
+
+	// When every backend fails, the error carries each failure
+	openai.err = &APIError{Provider: OpenAI, StatusCode: 429, Kind: ErrRateLimited}
+	local.err = &APIError{Provider: Ollama, StatusCode: 503, Kind: ErrServer}
+	_, err = chain.CreateChatCompletion(context.Background(), ChatCompletionRequest{})
+	var fallbackErr *FallbackError
+	if !errors.As(err, &fallbackErr) || len(fallbackErr.Errors) != 3 || !errors.Is(err, ErrRateLimited) {
+		t.Errorf("expected a FallbackError with every failure, got %v", err)
+	}
+}
+
+func TestRateLimiter(t *testing.T) {
+	waitFails := func(limiter *RateLimiter, model string, tokens int) bool {
+		ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+		defer cancel()
+		_, err := limiter.Acquire(ctx, model, tokens)
+		return errors.Is(err, context.DeadlineExceeded)
+	}
+
+	// Requests per minute
+	limiter := NewRateLimiter(RateLimits{RateLimit: RateLimit{RequestsPerMinute: 1}})
+	release, err := limiter.Acquire(context.Background(), "m", 0)
+	if err != nil {
+		t.Fatalf("Acquire returned error: %v", err)
+	}
+	release(0)
+	if !waitFails(limiter, "m", 0) {
+		t.Error("expected the second request of the minute to wait")
+	}
+
+	// Tokens per minute, reconciled with the tokens actually used
+	limiter = NewRateLimiter(RateLimits{RateLimit: RateLimit{TokensPerMinute: 100}})
+	release, _ = limiter.Acquire(context.Background(), "m", 80)
+	if !waitFails(limiter, "m", 50) {
+		t.Error("expected a request over the remaining tokens to wait")
+	}
+	release(20)
+	if waitFails(limiter, "m", 50) {
+		t.Error("expected unused tokens to be returned to the bucket")
+	}
+
+	// In-flight cap per model, on top of the limit for every request
+	limiter = NewRateLimiter(RateLimits{Models: map[string]RateLimit{"small": {MaxInFlight: 1}}})
+	release, _ = limiter.Acquire(context.Background(), "small", 0)
+	if !waitFails(limiter, "small", 0) || waitFails(limiter, "large", 0) {
+		t.Error("expected only the capped model to wait")
+	}
+	done := make(chan error)
+	go func() {
+		_, err := limiter.Acquire(context.Background(), "small", 0)
+		done <- err
+	}()
+	release(0)
+	if err := <-done; err != nil {
+		t.Errorf("expected the waiting request to proceed after release, got %v", err)
+	}
+
+	// Clients sharing a limiter share its limits; streams hold a slot until closed
+	limiter = NewRateLimiter(RateLimits{RateLimit: RateLimit{MaxInFlight: 1}})
+	first := WithRateLimiter(&stubLLM{}, limiter)
+	second := WithRateLimiter(&stubLLM{}, limiter)
+	stream, err := first.CreateChatCompletionStream(context.Background(), ChatCompletionRequest{Model: "m"})
+	if err != nil {
+		t.Fatalf("CreateChatCompletionStream returned error: %v", err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if _, err := second.CreateChatCompletion(ctx, ChatCompletionRequest{Model: "m"}); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("expected the other client to wait for the open stream, got %v", err)
+	}
+	stream.Close()
+	if _, err := second.CreateChatCompletion(context.Background(), ChatCompletionRequest{Model: "m"}); err != nil {
+		t.Errorf("expected the request to proceed once the stream closed, got %v", err)
+	}
+}
@@ -5,23 +5,22 @@ import (
 	"encoding/json"
 	"fmt"
 	"io"
+	"net/http"
 	"net/url"
 
 	"github.com/ollama/ollama/api"
+	"github.com/ollama/ollama/envconfig"
 )
 
 // OllamaLLM implements the LLM interface for Ollama
 type OllamaLLM struct {
-	client *api.Client
+	client  *api.Client
+	options map[string]interface{} // Model options sent with every request
 }
 
 // NewOllamaLLM creates a new Ollama LLM client
 func NewOllamaLLM() (*OllamaLLM, error) {
-	client, err := api.ClientFromEnvironment()
-	if err != nil {
-		return nil, fmt.Errorf("failed to create Ollama client: %w", err)
-	}
-	return &OllamaLLM{client: client}, nil
+	return &OllamaLLM{client: api.NewClient(envconfig.Host(), withCapturingTransport(http.DefaultClient))}, nil
 }
 
 // NewOllamaLLMWithURL creates a new Ollama LLM client with a custom URL
@@ -30,23 +29,88 @@ func NewOllamaLLMWithURL(baseURL string) (*OllamaLLM, error) {
 	if err != nil {
 		return nil, fmt.Errorf("failed to parse URL: %w", err)
 	}
-	client := api.NewClient(parsedURL, nil)
+	client := api.NewClient(parsedURL, withCapturingTransport(http.DefaultClient))
 	return &OllamaLLM{client: client}, nil
 }
 
+// NewOllamaLLMWithConfig creates an Ollama client from cfg. Without a BaseURL
+// the host is read from the environment.
+func NewOllamaLLMWithConfig(cfg Config) (*OllamaLLM, error) {
+	baseURL := envconfig.Host()
+	if cfg.BaseURL != "" {
+		parsedURL, err := url.Parse(cfg.BaseURL)
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse URL: %w", err)
+		}
+		baseURL = parsedURL
+	}
+	httpClient := cfg.HTTPClient
+	if httpClient == nil {
+		httpClient = http.DefaultClient
+	}
+
+	return &OllamaLLM{
+		client:  api.NewClient(baseURL, withCapturingTransport(httpClient)), // Records Retry-After of error responses
+		options: cfg.Options,
+	}, nil
+}
+
+// requestOptions returns a copy of the configured model options with the
+// generation settings of req applied on top
+func (o *OllamaLLM) requestOptions(req ChatCompletionRequest) map[string]interface{} {
+	options := make(map[string]interface{}, len(o.options))
+	for k, v := range o.options {
+		options[k] = v
+	}
+
+	if req.Temperature != nil {
+		options["temperature"] = *req.Temperature
+	}
+	if req.TopP != nil {
+		options["top_p"] = *req.TopP
+	}
+	if req.MaxTokens > 0 {
+		options["num_predict"] = req.MaxTokens
+	}
+	if len(req.Stop) > 0 {
+		options["stop"] = req.Stop
+	}
+	if req.PresencePenalty != 0 {
+		options["presence_penalty"] = req.PresencePenalty
+	}
+	if req.FrequencyPenalty != 0 {
+		options["frequency_penalty"] = req.FrequencyPenalty
+	}
+	if req.Seed != nil {
+		options["seed"] = *req.Seed
+	}
+	return options
+}
+
+// convertToOllamaFormat converts a response format to Ollama's format, either
+// "json" or a JSON schema
+func convertToOllamaFormat(format *ResponseFormat) json.RawMessage {
+	if !format.wantsJSON() {
+		return nil
+	}
+	if format.Schema != nil {
+		if schema, err := json.Marshal(format.Schema); err == nil {
+			return schema
+		}
+	}
+	return json.RawMessage(`"json"`)
+}
+
 // convertToOllamaRole converts our Role type to Ollama's role string
 func convertToOllamaRole(role Role) string {
 	if role == RoleFunction {
-		return "tool"
+		return string(RoleTool)
 	}
 	return string(role)
 }
 
 // convertFromOllamaRole converts Ollama's role string to our Role type
 func convertFromOllamaRole(role string) Role {
-	if role == "tool" {
-		return RoleFunction
-	}
 	return Role(role)
 }
 
@@ -63,7 +127,9 @@ func convertToOllamaMessages(messages []Message) []api.Message {
 	return ollamaMessages
 }
 
-// convertToOllamaTools converts our generic Tool type to Ollama's tool type
+// convertToOllamaTools converts our generic Tool type to Ollama's tool type.
+// Ollama only takes the type, description and enum of each property; other
+// schema keywords are dropped.
 func convertToOllamaTools(tools []Tool) api.Tools {
 	if len(tools) == 0 {
 		return nil
@@ -71,41 +137,31 @@ func convertToOllamaTools(tools []Tool) api.Tools {
 
 	ollamaTools := make([]api.Tool, len(tools))
 	for i, tool := range tools {
-		// Convert required array
-		required := make([]string, len(tool.Function.Parameters["required"].([]interface{})))
-		for i, v := range tool.Function.Parameters["required"].([]interface{}) {
-			required[i] = v.(string)
+		params := tool.Function.Parameters
+		paramType, _ := params["type"].(string)
+		if paramType == "" {
+			paramType = "object"
 		}
 
 		// Convert properties map
-		rawProps := tool.Function.Parameters["properties"].(map[string]interface{})
+		rawProps, _ := params["properties"].(map[string]interface{})
 		properties := make(map[string]struct {
 			Type        string   `json:"type"`
 			Description string   `json:"description"`
 			Enum        []string `json:"enum,omitempty"`
-		})
+		}, len(rawProps))
 
 		for propName, propValue := range rawProps {
-			propMap := propValue.(map[string]interface{})
+			propMap, _ := propValue.(map[string]interface{})
 			prop := struct {
 				Type        string   `json:"type"`
 				Description string   `json:"description"`
 				Enum        []string `json:"enum,omitempty"`
 			}{
-				Type:        propMap["type"].(string),
-				Description: propMap["description"].(string),
+				Enum: schemaStrings(propMap["enum"]),
 			}
-
-			// Handle optional enum field
-			if enumVal, ok := propMap["enum"]; ok {
-				enumInterface := enumVal.([]interface{})
-				enumStrings := make([]string, len(enumInterface))
-				for j, e := range enumInterface {
-					enumStrings[j] = e.(string)
-				}
-				prop.Enum = enumStrings
-			}
-
+			prop.Type, _ = propMap["type"].(string)
+			prop.Description, _ = propMap["description"].(string)
 			properties[propName] = prop
 		}
 
@@ -123,8 +179,8 @@ func convertToOllamaTools(tools []Tool) api.Tools {
 						Enum        []string `json:"enum,omitempty"`
 					} `json:"properties"`
 				}{
-					Type:       tool.Function.Parameters["type"].(string),
-					Required:   required,
+					Type:       paramType,
+					Required:   schemaStrings(params["required"]),
 					Properties: properties,
 				},
 			},
@@ -133,6 +189,25 @@ func convertToOllamaTools(tools []Tool) api.Tools {
 	return ollamaTools
 }
 
+// schemaStrings returns the strings of a JSON schema list such as required
+// or enum, which is []interface{} once decoded and may be []string when built
+// in code
+func schemaStrings(value interface{}) []string {
+	switch values := value.(type) {
+	case []string:
+		return values
+	case []interface{}:
+		strs := make([]string, 0, len(values))
+		for _, v := range values {
+			if str, ok := v.(string); ok {
+				strs = append(strs, str)
+			}
+		}
+		return strs
+	}
+	return nil
+}
+
 // convertToOllamaToolCalls converts our generic ToolCall type to Ollama's type
 func convertToOllamaToolCalls(toolCalls []ToolCall) []api.ToolCall {
 	if len(toolCalls) == 0 {
@@ -170,7 +245,7 @@ func convertFromOllamaToolCalls(toolCalls []api.ToolCall) []ToolCall {
 		// Convert api.ToolCallFunctionArguments to map[string]interface{}
 
 		calls[i] = ToolCall{
-			ID:   call.Function.Name, // Using name as ID since Ollama doesn't have a separate ID field
+			ID:   newToolCallID(), // Ollama correlates results by order, so we mint our own IDs
 			Type: "function",
 			Function: ToolCallFunction{
 				Name:      call.Function.Name,
@@ -188,13 +263,15 @@ func (o *OllamaLLM) CreateChatCompletion(ctx context.Context, req ChatCompletion
 		Model:    req.Model,
 		Messages: convertToOllamaMessages(req.Messages),
 		Stream:   &stream,
-		Tools:    convertToOllamaTools(req.Tools),
-		Options:  make(map[string]interface{}),
+		Tools:    convertToOllamaTools(req.ToolChoice.allowedTools(req.Tools)),
+		Options:  o.requestOptions(req),
+		Format:   convertToOllamaFormat(req.ResponseFormat),
 	}
 
 	var response ChatCompletionResponse
 	var finalMessage Message
 
+	ctx, capture := withResponseCapture(ctx)
 	err := o.client.Chat(ctx, ollamaReq, func(resp api.ChatResponse) error {
 		if resp.Done {
 			finalMessage = Message{
@@ -202,12 +279,17 @@ func (o *OllamaLLM) CreateChatCompletion(ctx context.Context, req ChatCompletion
 				Content:   resp.Message.Content,
 				ToolCalls: convertFromOllamaToolCalls(resp.Message.ToolCalls),
 			}
+			response.Usage = Usage{
+				PromptTokens:     resp.PromptEvalCount,
+				CompletionTokens: resp.EvalCount,
+				TotalTokens:      resp.PromptEvalCount + resp.EvalCount,
+			}
 		}
 		return nil
 	})
 
 	if err != nil {
-		return ChatCompletionResponse{}, fmt.Errorf("Ollama chat completion failed: %w", err)
+		return ChatCompletionResponse{}, fmt.Errorf("Ollama chat completion failed: %w", classifyCapturedError(Ollama, err, capture))
 	}
 
 	response.Choices = []Choice{
@@ -246,7 +328,8 @@ func (s *ollamaStreamWrapper) Recv() (ChatCompletionResponse, error) {
 	}
 
 	var response ChatCompletionResponse
-	err := s.client.Chat(s.ctx, s.req, func(resp api.ChatResponse) error {
+	ctx, capture := withResponseCapture(s.ctx)
+	err := s.client.Chat(ctx, s.req, func(resp api.ChatResponse) error {
 		if resp.Done {
 			s.done = true
 			return io.EOF
@@ -273,7 +356,7 @@ func (s *ollamaStreamWrapper) Recv() (ChatCompletionResponse, error) {
 	}
 
 	if err != nil {
-		return ChatCompletionResponse{}, fmt.Errorf("Ollama stream failed: %w", err)
+		return ChatCompletionResponse{}, fmt.Errorf("Ollama stream failed: %w", classifyCapturedError(Ollama, err, capture))
 	}
 
 	return response, nil
@@ -290,8 +373,9 @@ func (o *OllamaLLM) CreateChatCompletionStream(ctx context.Context, req ChatComp
 		Model:    req.Model,
 		Messages: convertToOllamaMessages(req.Messages),
 		Stream:   &stream,
-		Tools:    convertToOllamaTools(req.Tools),
-		Options:  make(map[string]interface{}),
+		Tools:    convertToOllamaTools(req.ToolChoice.allowedTools(req.Tools)),
+		Options:  o.requestOptions(req),
+		Format:   convertToOllamaFormat(req.ResponseFormat),
 	}
 
 	return newOllamaStreamWrapper(ctx, o.client, ollamaReq), nil
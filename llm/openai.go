@@ -7,19 +7,55 @@ import (
 	"fmt"
 	"io"
 	"log"
+	"math"
 
 	"github.com/sashabaranov/go-openai"
 )
 
 // OpenAILLM implements the LLM interface for OpenAI
 type OpenAILLM struct {
-	client *openai.Client
+	client   *openai.Client
+	provider LLMProvider // Reported in classified errors
 }
 
 // NewOpenAILLM creates a new OpenAI LLM client
 func NewOpenAILLM(apiKey string) *OpenAILLM {
-	client := openai.NewClient(apiKey)
-	return &OpenAILLM{client: client}
+	return NewOpenAILLMWithConfig(OpenAI, Config{APIKey: apiKey})
+}
+
+// NewOpenAILLMWithConfig creates an OpenAI client from cfg. The Azure
+// providers select the matching Azure API type.
+func NewOpenAILLMWithConfig(provider LLMProvider, cfg Config) *OpenAILLM {
+	config := openai.DefaultConfig(cfg.APIKey)
+	switch provider {
+	case Azure, AzureAD, CloudflareAzure:
+		config = openai.DefaultAzureConfig(cfg.APIKey, cfg.BaseURL)
+		config.APIType = openai.APIType(provider)
+		if cfg.ModelMapperFunc != nil {
+			// NewLLM already maps the model to the deployment name
+			config.AzureModelMapperFunc = func(model string) string { return model }
+		}
+	}
+
+	if cfg.BaseURL != "" {
+		config.BaseURL = cfg.BaseURL
+	}
+	if cfg.OrgID != "" {
+		config.OrgID = cfg.OrgID
+	}
+	if cfg.APIVersion != "" {
+		config.APIVersion = cfg.APIVersion
+	}
+	if cfg.AssistantVersion != "" {
+		config.AssistantVersion = cfg.AssistantVersion
+	}
+	// Error responses are recorded for their Retry-After header
+	config.HTTPClient = withCapturingTransport(cfg.HTTPClient)
+	if cfg.EmptyMessagesLimit > 0 {
+		config.EmptyMessagesLimit = cfg.EmptyMessagesLimit
+	}
+
+	return &OpenAILLM{client: openai.NewClientWithConfig(config), provider: provider}
 }
 
 // convertToOpenAIMessages converts our generic Message type to OpenAI's message type
@@ -27,20 +63,47 @@ func convertToOpenAIMessages(messages []Message) []openai.ChatCompletionMessage
 	openAIMessages := make([]openai.ChatCompletionMessage, len(messages))
 	for i, msg := range messages {
 		openAIMessages[i] = openai.ChatCompletionMessage{
-			Role:    string(msg.Role),
-			Content: msg.Content,
-			Name:    msg.Name,
+			Role:      string(msg.Role),
+			Content:   msg.Content,
+			Name:      msg.Name,
+			ToolCalls: convertToOpenAIToolCalls(msg.ToolCalls),
+		}
+		if isToolResult(msg) {
+			openAIMessages[i].Role = openai.ChatMessageRoleTool
+			openAIMessages[i].ToolCallID = resolveToolCallID(messages, i)
+			openAIMessages[i].Name = ""
 		}
 	}
 	return openAIMessages
 }
 
+// convertToOpenAIToolCalls converts our generic tool calls to OpenAI's type
+func convertToOpenAIToolCalls(toolCalls []ToolCall) []openai.ToolCall {
+	if len(toolCalls) == 0 {
+		return nil
+	}
+
+	calls := make([]openai.ToolCall, len(toolCalls))
+	for i, call := range toolCalls {
+		calls[i] = openai.ToolCall{
+			ID:   call.ID,
+			Type: openai.ToolTypeFunction,
+			Function: openai.FunctionCall{
+				Name:      call.Function.Name,
+				Arguments: call.Function.Arguments,
+			},
+		}
+	}
+	return calls
+}
+
 // convertFromOpenAIMessage converts OpenAI's message type to our generic Message type
 func convertFromOpenAIMessage(msg openai.ChatCompletionMessage) Message {
 	return Message{
-		Role:    Role(msg.Role),
-		Content: msg.Content,
-		Name:    msg.Name,
+		Role:       Role(msg.Role),
+		Content:    msg.Content,
+		Name:       msg.Name,
+		ToolCallID: msg.ToolCallID,
 	}
 }
 
@@ -91,27 +154,79 @@ func convertFromOpenAIToolCalls(toolCalls []openai.ToolCall) []ToolCall {
 	return calls
 }
 
-// CreateChatCompletion implements the LLM interface for OpenAI
-func (o *OpenAILLM) CreateChatCompletion(ctx context.Context, req ChatCompletionRequest) (ChatCompletionResponse, error) {
+// convertToOpenAIRequest converts our generic request to OpenAI's request type
+func convertToOpenAIRequest(req ChatCompletionRequest) openai.ChatCompletionRequest {
 	openAIReq := openai.ChatCompletionRequest{
-		Model:           req.Model,
-		Messages:        convertToOpenAIMessages(req.Messages),
-		Temperature:     float32(req.Temperature),
-		TopP:            float32(req.TopP),
-		N:               req.N,
-		Stop:            req.Stop,
-		MaxTokens:       req.MaxTokens,
-		PresencePenalty: req.PresencePenalty,
-		Tools:           convertToOpenAITools(req.Tools),
+		Model:            req.Model,
+		Messages:         convertToOpenAIMessages(req.Messages),
+		N:                req.N,
+		Stop:             req.Stop,
+		MaxTokens:        req.MaxTokens,
+		PresencePenalty:  req.PresencePenalty,
+		FrequencyPenalty: req.FrequencyPenalty,
+		Seed:             req.Seed,
+		User:             req.User,
+		Tools:            convertToOpenAITools(req.Tools),
 	}
+	// go-openai omits zero values, so an explicit zero is sent as the
+	// smallest non-zero float instead
+	if req.Temperature != nil {
+		openAIReq.Temperature = nonZeroFloat32(*req.Temperature)
+	}
+	if req.TopP != nil {
+		openAIReq.TopP = nonZeroFloat32(*req.TopP)
+	}
+	openAIReq.ResponseFormat = convertToOpenAIResponseFormat(req.ResponseFormat)
+	if len(openAIReq.Tools) > 0 {
+		openAIReq.ToolChoice = req.ToolChoice.openAIToolChoice()
+	}
+	return openAIReq
+}
+
+// convertToOpenAIResponseFormat converts our response format to OpenAI's type
+func convertToOpenAIResponseFormat(format *ResponseFormat) *openai.ChatCompletionResponseFormat {
+	if format == nil {
+		return nil
+	}
+	openAIFormat := &openai.ChatCompletionResponseFormat{
+		Type: openai.ChatCompletionResponseFormatType(format.Type),
+	}
+	if format.Type == ResponseFormatJSONSchema {
+		openAIFormat.JSONSchema = &openai.ChatCompletionResponseFormatJSONSchema{
+			Name:   format.name(),
+			Schema: jsonSchema(format.Schema),
+			Strict: format.Strict,
+		}
+	}
+	return openAIFormat
+}
+
+// jsonSchema adapts a schema map to json.Marshaler
+type jsonSchema map[string]interface{}
+
+func (s jsonSchema) MarshalJSON() ([]byte, error) {
+	return json.Marshal(map[string]interface{}(s))
+}
+
+func nonZeroFloat32(v float32) float32 {
+	if v == 0 {
+		return math.SmallestNonzeroFloat32
+	}
+	return v
+}
+
+// CreateChatCompletion implements the LLM interface for OpenAI
+func (o *OpenAILLM) CreateChatCompletion(ctx context.Context, req ChatCompletionRequest) (ChatCompletionResponse, error) {
+	openAIReq := convertToOpenAIRequest(req)
 
 	log.Println("---")
 	log.Printf("OpenAI Messages: %+v\n", openAIReq.Messages)
 	log.Println("---")
 
+	ctx, capture := withResponseCapture(ctx)
 	resp, err := o.client.CreateChatCompletion(ctx, openAIReq)
 	if err != nil {
-		return ChatCompletionResponse{}, err
+		return ChatCompletionResponse{}, classifyCapturedError(o.provider, err, capture)
 	}
 
 	choices := make([]Choice, len(resp.Choices))
@@ -141,11 +256,13 @@ type openAIStreamWrapper struct {
 	stream          *openai.ChatCompletionStream
 	currentToolCall *ToolCall
 	toolCallBuffer  map[string]*ToolCall
+	provider        LLMProvider
 }
 
-func newOpenAIStreamWrapper(stream *openai.ChatCompletionStream) *openAIStreamWrapper {
+func newOpenAIStreamWrapper(stream *openai.ChatCompletionStream, provider LLMProvider) *openAIStreamWrapper {
 	return &openAIStreamWrapper{
 		stream:         stream,
+		provider:       provider,
 		toolCallBuffer: make(map[string]*ToolCall),
 	}
 }
@@ -153,14 +270,10 @@ func newOpenAIStreamWrapper(stream *openai.ChatCompletionStream) *openAIStreamWr
 func (w *openAIStreamWrapper) Recv() (ChatCompletionResponse, error) {
 	resp, err := w.stream.Recv()
 	if err != nil {
-		if err == io.EOF {
-			return ChatCompletionResponse{}, err
-		}
-		var openAIErr *openai.APIError
-		if errors.As(err, &openAIErr) {
-			return ChatCompletionResponse{}, fmt.Errorf("OpenAI API error: %s - %s", openAIErr.Code, openAIErr.Message)
+		if errors.Is(err, io.EOF) {
+			return ChatCompletionResponse{}, io.EOF
 		}
-		return ChatCompletionResponse{}, fmt.Errorf("stream receive failed: %w", err)
+		return ChatCompletionResponse{}, fmt.Errorf("stream receive failed: %w", classifyError(w.provider, err))
 	}
 
 	choices := make([]Choice, len(resp.Choices))
@@ -246,27 +359,14 @@ func (w *openAIStreamWrapper) Close() error {
 
 // CreateChatCompletionStream implements the LLM interface for OpenAI streaming
 func (o *OpenAILLM) CreateChatCompletionStream(ctx context.Context, req ChatCompletionRequest) (ChatCompletionStream, error) {
-	openAIReq := openai.ChatCompletionRequest{
-		Model:           req.Model,
-		Messages:        convertToOpenAIMessages(req.Messages),
-		Temperature:     float32(req.Temperature),
-		TopP:            float32(req.TopP),
-		N:               req.N,
-		Stop:            req.Stop,
-		MaxTokens:       req.MaxTokens,
-		PresencePenalty: float32(req.PresencePenalty),
-		Tools:           convertToOpenAITools(req.Tools),
-		Stream:          true,
-	}
+	openAIReq := convertToOpenAIRequest(req)
+	openAIReq.Stream = true
 
+	ctx, capture := withResponseCapture(ctx)
 	stream, err := o.client.CreateChatCompletionStream(ctx, openAIReq)
 	if err != nil {
-		var openAIErr *openai.APIError
-		if errors.As(err, &openAIErr) {
-			return nil, fmt.Errorf("OpenAI API error: %s - %s", openAIErr.Code, openAIErr.Message)
-		}
-		return nil, fmt.Errorf("stream creation failed: %w", err)
+		return nil, fmt.Errorf("stream creation failed: %w", classifyCapturedError(o.provider, err, capture))
 	}
 
-	return newOpenAIStreamWrapper(stream), nil
+	return newOpenAIStreamWrapper(stream, o.provider), nil
 }
@@ -0,0 +1,285 @@
+package llm
+
+import (
+	"context"
+	"math"
+	"sync"
+	"time"
+)
+
+// RateLimit caps the traffic sent to a provider. Zero fields are unlimited.
+type RateLimit struct {
+	RequestsPerMinute int
+	TokensPerMinute   int // Counts prompt and completion tokens
+	MaxInFlight       int // Requests and open streams at the same time
+}
+
+// RateLimits configures a RateLimiter. The embedded RateLimit applies to
+// every request; Models adds limits for single models on top of it.
+type RateLimits struct {
+	RateLimit
+	Models map[string]RateLimit
+}
+
+// bucket is a token bucket holding up to perMinute units, refilled at
+// perMinute units per minute. Its level goes negative when requests use
+// more tokens than estimated, which delays the following requests.
+type bucket struct {
+	level float64
+	last  time.Time
+}
+
+func (b *bucket) refill(now time.Time, perMinute int) {
+	if b.last.IsZero() {
+		b.level = float64(perMinute)
+	} else {
+		b.level = math.Min(float64(perMinute), b.level+float64(perMinute)*now.Sub(b.last).Minutes())
+	}
+	b.last = now
+}
+
+// wait returns how long to wait until n units are available. Requests
+// larger than the bucket only wait for it to be full.
+func (b *bucket) wait(now time.Time, n int, perMinute int) time.Duration {
+	if perMinute <= 0 {
+		return 0
+	}
+	b.refill(now, perMinute)
+	need := math.Min(float64(n), float64(perMinute))
+	if b.level >= need {
+		return 0
+	}
+	return time.Duration(math.Ceil((need - b.level) / float64(perMinute) * float64(time.Minute)))
+}
+
+func (b *bucket) take(n int, perMinute int) {
+	if perMinute > 0 {
+		b.level = math.Min(float64(perMinute), b.level-float64(n))
+	}
+}
+
+// limitState tracks the usage of one RateLimit
+type limitState struct {
+	limit    RateLimit
+	requests bucket
+	tokens   bucket
+	inFlight int
+}
+
+// wait returns how long to wait before a request of tokens fits within the
+// limit, and false when it has to wait for a request in flight to finish
+func (s *limitState) wait(now time.Time, tokens int) (time.Duration, bool) {
+	wait := s.requests.wait(now, 1, s.limit.RequestsPerMinute)
+	if d := s.tokens.wait(now, tokens, s.limit.TokensPerMinute); d > wait {
+		wait = d
+	}
+	return wait, s.limit.MaxInFlight <= 0 || s.inFlight < s.limit.MaxInFlight
+}
+
+// RateLimiter enforces RateLimits on the clients it is attached to. Clients
+// sharing a RateLimiter share its limits, so attach one RateLimiter to every
+// client using the same provider and API key. It is safe for concurrent use.
+type RateLimiter struct {
+	mu     sync.Mutex
+	limits RateLimits
+	states map[string]*limitState // Per model; "" holds the limit for every request
+	wake   chan struct{}          // Closed when a request finishes or the limits change
+}
+
+// NewRateLimiter creates a RateLimiter enforcing limits
+func NewRateLimiter(limits RateLimits) *RateLimiter {
+	return &RateLimiter{
+		limits: limits,
+		states: make(map[string]*limitState),
+		wake:   make(chan struct{}),
+	}
+}
+
+// SetLimits replaces the limits. Requests waiting for capacity are
+// reconsidered under the new limits.
+func (l *RateLimiter) SetLimits(limits RateLimits) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.limits = limits
+	for model, state := range l.states {
+		if model == "" {
+			state.limit = limits.RateLimit
+		} else {
+			state.limit = limits.Models[model]
+		}
+	}
+	l.notify()
+}
+
+// Limits returns the current limits
+func (l *RateLimiter) Limits() RateLimits {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.limits
+}
+
+// notify wakes the waiting requests; l.mu must be held
+func (l *RateLimiter) notify() {
+	close(l.wake)
+	l.wake = make(chan struct{})
+}
+
+// statesFor returns the limits a request for model is subject to; l.mu must be held
+func (l *RateLimiter) statesFor(model string) []*limitState {
+	keys := []string{""}
+	if _, ok := l.limits.Models[model]; ok && model != "" {
+		keys = append(keys, model)
+	}
+	states := make([]*limitState, len(keys))
+	for i, key := range keys {
+		state, ok := l.states[key]
+		if !ok {
+			state = &limitState{limit: l.limits.RateLimit}
+			if key != "" {
+				state.limit = l.limits.Models[key]
+			}
+			l.states[key] = state
+		}
+		states[i] = state
+	}
+	return states
+}
+
+// Acquire waits until a request for model estimated at tokens fits within
+// the limits, or until ctx is done. The returned release function must be
+// called once the request has finished, with the tokens it actually used;
+// zero keeps the estimate.
+func (l *RateLimiter) Acquire(ctx context.Context, model string, tokens int) (release func(usedTokens int), err error) {
+	for {
+		l.mu.Lock()
+		now := time.Now()
+		states := l.statesFor(model)
+		var wait time.Duration
+		free := true
+		for _, state := range states {
+			d, ok := state.wait(now, tokens)
+			if d > wait {
+				wait = d
+			}
+			free = free && ok
+		}
+		if free && wait == 0 {
+			for _, state := range states {
+				state.requests.take(1, state.limit.RequestsPerMinute)
+				state.tokens.take(tokens, state.limit.TokensPerMinute)
+				state.inFlight++
+			}
+			l.mu.Unlock()
+			return l.releaseFunc(states, tokens), nil
+		}
+		wake := l.wake
+		l.mu.Unlock()
+
+		var timer *time.Timer
+		var elapsed <-chan time.Time
+		if wait > 0 {
+			timer = time.NewTimer(wait)
+			elapsed = timer.C
+		}
+		select {
+		case <-ctx.Done():
+			if timer != nil {
+				timer.Stop()
+			}
+			return nil, ctx.Err()
+		case <-wake:
+		case <-elapsed:
+		}
+		if timer != nil {
+			timer.Stop()
+		}
+	}
+}
+
+func (l *RateLimiter) releaseFunc(states []*limitState, estimate int) func(int) {
+	var once sync.Once
+	return func(usedTokens int) {
+		once.Do(func() {
+			l.mu.Lock()
+			defer l.mu.Unlock()
+			for _, state := range states {
+				state.inFlight--
+				if usedTokens > 0 {
+					state.tokens.take(usedTokens-estimate, state.limit.TokensPerMinute)
+				}
+			}
+			l.notify()
+		})
+	}
+}
+
+// estimateRequestTokens estimates the tokens a request uses: about four
+// characters per token for the prompt, plus the completion limit
+func estimateRequestTokens(req ChatCompletionRequest) int {
+	tokens := req.MaxTokens
+	for _, msg := range req.Messages {
+		chars := len(msg.Content) + len(msg.Name)
+		for _, call := range msg.ToolCalls {
+			chars += len(call.Function.Name) + len(call.Function.Arguments)
+		}
+		tokens += chars/4 + 4
+	}
+	return tokens
+}
+
+// rateLimitedLLM waits for capacity on its limiter before every request
+type rateLimitedLLM struct {
+	LLM
+	limiter *RateLimiter
+}
+
+// WithRateLimiter wraps client so its requests are subject to limiter
+func WithRateLimiter(client LLM, limiter *RateLimiter) LLM {
+	return &rateLimitedLLM{LLM: client, limiter: limiter}
+}
+
+func (r *rateLimitedLLM) CreateChatCompletion(ctx context.Context, req ChatCompletionRequest) (ChatCompletionResponse, error) {
+	release, err := r.limiter.Acquire(ctx, req.Model, estimateRequestTokens(req))
+	if err != nil {
+		return ChatCompletionResponse{}, err
+	}
+	resp, err := r.LLM.CreateChatCompletion(ctx, req)
+	release(resp.Usage.TotalTokens)
+	return resp, err
+}
+
+func (r *rateLimitedLLM) CreateChatCompletionStream(ctx context.Context, req ChatCompletionRequest) (ChatCompletionStream, error) {
+	release, err := r.limiter.Acquire(ctx, req.Model, estimateRequestTokens(req))
+	if err != nil {
+		return nil, err
+	}
+	stream, err := r.LLM.CreateChatCompletionStream(ctx, req)
+	if err != nil {
+		release(0)
+		return nil, err
+	}
+	return &rateLimitedStream{ChatCompletionStream: stream, release: release}, nil
+}
+
+// rateLimitedStream counts as in flight until it ends or is closed
+type rateLimitedStream struct {
+	ChatCompletionStream
+	release    func(usedTokens int)
+	usedTokens int
+}
+
+func (s *rateLimitedStream) Recv() (ChatCompletionResponse, error) {
+	resp, err := s.ChatCompletionStream.Recv()
+	if resp.Usage.TotalTokens > 0 {
+		s.usedTokens = resp.Usage.TotalTokens
+	}
+	if err != nil {
+		s.release(s.usedTokens)
+	}
+	return resp, err
+}
+
+func (s *rateLimitedStream) Close() error {
+	s.release(s.usedTokens)
+	return s.ChatCompletionStream.Close()
+}
@@ -0,0 +1,117 @@
+package llm
+
+import (
+	"context"
+	"errors"
+	"math"
+	"math/rand"
+	"time"
+)
+
+// RetryPolicy retries failed requests with exponential backoff and jitter.
+// A Retry-After requested by the provider replaces the computed delay.
+type RetryPolicy struct {
+	MaxRetries     int              // Retries after the first attempt
+	InitialBackoff time.Duration    // Delay before the first retry
+	MaxBackoff     time.Duration    // Upper bound on the computed delay; zero means none
+	Multiplier     float64          // Growth of the delay per retry; 2 when zero
+	Jitter         float64          // Fraction of the delay that is randomized, from 0 to 1
+	MaxRetryAfter  time.Duration    // Longer Retry-After delays fail at once; zero means no limit
+	Retryable      func(error) bool // Decides which errors are retried; defaults to IsRetryable
+}
+
+// DefaultRetryPolicy returns a policy suitable for interactive use
+func DefaultRetryPolicy() RetryPolicy {
+	return RetryPolicy{
+		MaxRetries:     3,
+		InitialBackoff: 500 * time.Millisecond,
+		MaxBackoff:     30 * time.Second,
+		Multiplier:     2,
+		Jitter:         0.2,
+		MaxRetryAfter:  time.Minute,
+	}
+}
+
+// delay returns how long to wait before retry number retry, counted from zero
+func (p RetryPolicy) delay(retry int, err error) (time.Duration, bool) {
+	var apiErr *APIError
+	if errors.As(err, &apiErr) && apiErr.RetryAfter > 0 {
+		if p.MaxRetryAfter > 0 && apiErr.RetryAfter > p.MaxRetryAfter {
+			return 0, false
+		}
+		return apiErr.RetryAfter, true
+	}
+
+	multiplier := p.Multiplier
+	if multiplier == 0 {
+		multiplier = 2
+	}
+	d := float64(p.InitialBackoff) * math.Pow(multiplier, float64(retry))
+	if p.MaxBackoff > 0 && d > float64(p.MaxBackoff) {
+		d = float64(p.MaxBackoff)
+	}
+	if p.Jitter > 0 {
+		d += d * p.Jitter * (2*rand.Float64() - 1)
+	}
+	return time.Duration(d), true
+}
+
+// do calls fn until it succeeds, fails with an error that is not retried,
+// runs out of retries or ctx is done
+func (p RetryPolicy) do(ctx context.Context, fn func() error) error {
+	retryable := p.Retryable
+	if retryable == nil {
+		retryable = IsRetryable
+	}
+
+	for retry := 0; ; retry++ {
+		err := fn()
+		if err == nil || retry >= p.MaxRetries || ctx.Err() != nil || !retryable(err) {
+			return err
+		}
+		wait, ok := p.delay(retry, err)
+		if !ok {
+			return err
+		}
+
+		timer := time.NewTimer(wait)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return err
+		case <-timer.C:
+		}
+	}
+}
+
+// retryingLLM retries requests of the wrapped client according to policy.
+// Streams are retried only until they are established.
+type retryingLLM struct {
+	LLM
+	policy RetryPolicy
+}
+
+// WithRetry wraps client so failed requests are retried according to policy
+func WithRetry(client LLM, policy RetryPolicy) LLM {
+	return &retryingLLM{LLM: client, policy: policy}
+}
+
+func (r *retryingLLM) CreateChatCompletion(ctx context.Context, req ChatCompletionRequest) (ChatCompletionResponse, error) {
+	var resp ChatCompletionResponse
+	err := r.policy.do(ctx, func() error {
+		var err error
+		resp, err = r.LLM.CreateChatCompletion(ctx, req)
+		return err
+	})
+	return resp, err
+}
+
+func (r *retryingLLM) CreateChatCompletionStream(ctx context.Context, req ChatCompletionRequest) (ChatCompletionStream, error) {
+	var stream ChatCompletionStream
+	err := r.policy.do(ctx, func() error {
+		var err error
+		stream, err = r.LLM.CreateChatCompletionStream(ctx, req)
+		return err
+	})
+	return stream, err
+}
@@ -0,0 +1,105 @@
+package swarmgo
+
+import (
+	"context"
+
+	"github.com/wlevene/swarmgo/llm"
+)
+
+// LLMHandler performs a chat completion on behalf of an agent
+type LLMHandler func(ctx context.Context, agent Agent, req llm.ChatCompletionRequest) (llm.ChatCompletionResponse, error)
+
+// LLMMiddleware wraps an LLMHandler, e.g. to log, cache or rewrite requests.
+// It may call next any number of times, or not at all.
+type LLMMiddleware func(next LLMHandler) LLMHandler
+
+// LLMStreamHandler opens a streaming chat completion on behalf of an agent
+type LLMStreamHandler func(ctx context.Context, agent Agent, req llm.ChatCompletionRequest) (llm.ChatCompletionStream, error)
+
+// LLMStreamMiddleware wraps an LLMStreamHandler. It may also wrap the
+// returned stream to observe or rewrite the streamed chunks.
+type LLMStreamMiddleware func(next LLMStreamHandler) LLMStreamHandler
+
+// ToolInvocation describes a single tool invocation
+type ToolInvocation struct {
+	Agent            Agent         // Agent that requested the call
+	Function         AgentFunction // Function being invoked
+	ToolCall         llm.ToolCall  // Call as requested by the model
+	Args             map[string]interface{}
+	ContextVariables map[string]interface{}
+	Turn             int // Zero-based completion turn that requested the call
+}
+
+// ToolHandler invokes a tool
+type ToolHandler func(ctx context.Context, inv ToolInvocation) Result
+
+// ToolMiddleware wraps a ToolHandler, e.g. to redact arguments or enforce a
+// policy by returning a Result with an Error instead of calling next. When a
+// tool is retried, every attempt passes through the middleware.
+type ToolMiddleware func(next ToolHandler) ToolHandler
+
+// UseLLMMiddleware adds middleware around every non-streaming completion.
+// Middleware added first runs outermost. Streamed completions go through
+// UseLLMStreamMiddleware instead.
+func (s *Swarm) UseLLMMiddleware(mw ...LLMMiddleware) {
+	s.llmMiddleware = append(s.llmMiddleware, mw...)
+}
+
+// UseLLMStreamMiddleware adds middleware around every streamed completion,
+// including the follow-up streams after tool calls. Middleware added first
+// runs outermost.
+func (s *Swarm) UseLLMStreamMiddleware(mw ...LLMStreamMiddleware) {
+	s.llmStreamMiddleware = append(s.llmStreamMiddleware, mw...)
+}
+
+// UseToolMiddleware adds middleware around every tool invocation. Middleware
+// added first runs outermost.
+func (s *Swarm) UseToolMiddleware(mw ...ToolMiddleware) {
+	s.toolMiddleware = append(s.toolMiddleware, mw...)
+}
+
+// llmHandler returns the completion handler wrapped in the Swarm's middleware,
+// then in extra
+func (s *Swarm) llmHandler(extra []LLMMiddleware) LLMHandler {
+	handler := LLMHandler(func(ctx context.Context, agent Agent, req llm.ChatCompletionRequest) (llm.ChatCompletionResponse, error) {
+		client, err := s.clientFor(agent)
+		if err != nil {
+			return llm.ChatCompletionResponse{}, err
+		}
+		return client.CreateChatCompletion(ctx, req)
+	})
+
+	middleware := append(append([]LLMMiddleware{}, s.llmMiddleware...), extra...)
+	for i := len(middleware) - 1; i >= 0; i-- {
+		handler = middleware[i](handler)
+	}
+	return handler
+}
+
+// llmStreamHandler returns the stream handler wrapped in the Swarm's middleware
+func (s *Swarm) llmStreamHandler() LLMStreamHandler {
+	handler := LLMStreamHandler(func(ctx context.Context, agent Agent, req llm.ChatCompletionRequest) (llm.ChatCompletionStream, error) {
+		client, err := s.clientFor(agent)
+		if err != nil {
+			return nil, err
+		}
+		return client.CreateChatCompletionStream(ctx, req)
+	})
+
+	for i := len(s.llmStreamMiddleware) - 1; i >= 0; i-- {
+		handler = s.llmStreamMiddleware[i](handler)
+	}
+	return handler
+}
+
+// toolHandler returns the tool handler wrapped in the Swarm's middleware,
+// then in extra
+func (s *Swarm) toolHandler(extra []ToolMiddleware) ToolHandler {
+	handler := ToolHandler(invokeFunction)
+
+	middleware := append(append([]ToolMiddleware{}, s.toolMiddleware...), extra...)
+	for i := len(middleware) - 1; i >= 0; i-- {
+		handler = middleware[i](handler)
+	}
+	return handler
+}
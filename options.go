@@ -0,0 +1,184 @@
+package swarmgo
+
+import (
+	"context"
+
+	"github.com/wlevene/swarmgo/llm"
+)
+
+// RunOptions holds the settings of a single Run. Build it with RunOption
+// values passed to RunWithOptions.
+type RunOptions struct {
+	ContextVariables map[string]interface{}
+	ModelOverride    string              // Model used instead of the agent's
+	Stream           bool                // Stream completions through the stream middleware; see WithStream
+	Debug            bool                // Log requests and tool calls
+	MaxTurns         int                 // Completions before the run stops; zero or less uses DefaultMaxTurns
+	ExecuteTools     bool                // Execute requested tool calls; true by default
+	Generation       GenerationSettings  // Overrides the active agent's generation settings
+	LLMMiddleware    []LLMMiddleware     // Wraps completions, inside the Swarm's middleware
+	ToolMiddleware   []ToolMiddleware    // Wraps tool invocations, inside the Swarm's middleware
+	Budget           *Budget             // Aborts the run with ErrBudgetExceeded when a limit is crossed
+	ContextWindow    *ContextWindow      // Overrides the Swarm's context-window management
+	ResponseFormat   *llm.ResponseFormat // Requests JSON output from the model
+	OutputRetries    int                 // Times RunTyped re-asks for output that fails to parse
+	Approval         ApprovalFunc        // Overrides the Swarm's ApprovalFunc
+	CallStack        []Agent             // Call stack the run resumes with, innermost last
+	CallerViews      [][]llm.Message     // What the CallStack agents saw when they made filtered calls
+
+	toolChoiceUsed bool          // The active agent's forced tool choice has led to a tool call
+	turn           int           // Turn whose tool calls are being executed
+	returnFunction AgentFunction // return_to_caller for the top of the call stack
+}
+
+// RunOption configures RunOptions
+type RunOption func(*RunOptions)
+
+// defaultRunOptions returns the options used when no RunOption changes them
+func defaultRunOptions() RunOptions {
+	return RunOptions{
+		MaxTurns:      DefaultMaxTurns,
+		ExecuteTools:  true,
+		OutputRetries: DefaultOutputRetries,
+	}
+}
+
+// WithContextVariables sets the context variables the run starts with
+func WithContextVariables(contextVariables map[string]interface{}) RunOption {
+	return func(o *RunOptions) {
+		o.ContextVariables = contextVariables
+	}
+}
+
+// WithModelOverride uses model instead of the active agent's model
+func WithModelOverride(model string) RunOption {
+	return func(o *RunOptions) {
+		o.ModelOverride = model
+	}
+}
+
+// WithStream makes the run request streamed completions. Each stream is opened
+// through the Swarm's LLMStreamMiddleware instead of its LLMMiddleware and is
+// collected into a complete message before tools run.
+func WithStream(stream bool) RunOption {
+	return func(o *RunOptions) {
+		o.Stream = stream
+	}
+}
+
+// WithDebug enables debug logging
+func WithDebug(debug bool) RunOption {
+	return func(o *RunOptions) {
+		o.Debug = debug
+	}
+}
+
+// WithMaxTurns limits the number of completions made by the run
+func WithMaxTurns(maxTurns int) RunOption {
+	return func(o *RunOptions) {
+		o.MaxTurns = maxTurns
+	}
+}
+
+// WithExecuteTools controls whether requested tool calls are executed
+func WithExecuteTools(executeTools bool) RunOption {
+	return func(o *RunOptions) {
+		o.ExecuteTools = executeTools
+	}
+}
+
+// WithGenerationSettings overrides the active agent's generation settings
+func WithGenerationSettings(settings GenerationSettings) RunOption {
+	return func(o *RunOptions) {
+		o.Generation = o.Generation.Merge(settings)
+	}
+}
+
+// WithToolChoice overrides the active agent's tool choice. A choice that
+// forces a tool call applies until the run first executes tools; later turns,
+// and agents taking over after a handoff, use their own choice.
+func WithToolChoice(choice *llm.ToolChoice) RunOption {
+	return func(o *RunOptions) {
+		o.Generation.ToolChoice = choice
+	}
+}
+
+// WithLLMMiddleware adds middleware around the run's completions
+func WithLLMMiddleware(mw ...LLMMiddleware) RunOption {
+	return func(o *RunOptions) {
+		o.LLMMiddleware = append(o.LLMMiddleware, mw...)
+	}
+}
+
+// WithToolMiddleware adds middleware around the run's tool invocations
+func WithToolMiddleware(mw ...ToolMiddleware) RunOption {
+	return func(o *RunOptions) {
+		o.ToolMiddleware = append(o.ToolMiddleware, mw...)
+	}
+}
+
+// WithBudget attaches a budget to the run. When a limit is crossed the run
+// returns its partial Response with an error matching ErrBudgetExceeded; the
+// last message may request tool calls that were not executed.
+func WithBudget(budget *Budget) RunOption {
+	return func(o *RunOptions) {
+		o.Budget = budget
+	}
+}
+
+// WithContextWindow manages the context window of the run's requests
+func WithContextWindow(window *ContextWindow) RunOption {
+	return func(o *RunOptions) {
+		o.ContextWindow = window
+	}
+}
+
+// WithResponseFormat requests JSON output from the model
+func WithResponseFormat(format *llm.ResponseFormat) RunOption {
+	return func(o *RunOptions) {
+		o.ResponseFormat = format
+	}
+}
+
+// WithOutputRetries sets how many times RunTyped re-asks the model for output
+// that fails to parse or validate
+func WithOutputRetries(retries int) RunOption {
+	return func(o *RunOptions) {
+		o.OutputRetries = retries
+	}
+}
+
+// WithApproval approves the run's calls to functions that require approval
+func WithApproval(approve ApprovalFunc) RunOption {
+	return func(o *RunOptions) {
+		o.Approval = approve
+	}
+}
+
+// WithCallStack resumes a run whose active agent was called with
+// HandoffCall, e.g. with the CallStack of the previous Response
+func WithCallStack(stack []Agent) RunOption {
+	return func(o *RunOptions) {
+		o.CallStack = stack
+	}
+}
+
+// WithCallerViews restores what the agents of the call stack saw when they
+// made filtered calls, e.g. with the CallerViews of the previous Response, so
+// they continue from there on return. Callers without a view continue on the
+// conversation of the agent returning to them.
+func WithCallerViews(views [][]llm.Message) RunOption {
+	return func(o *RunOptions) {
+		o.CallerViews = views
+	}
+}
+
+// RunWithOptions executes the chat interaction loop with the agent, like Run,
+// configured by opts.
+func (s *Swarm) RunWithOptions(ctx context.Context, agent Agent, messages []llm.Message, opts ...RunOption) (Response, error) {
+	options := defaultRunOptions()
+	for _, opt := range opts {
+		opt(&options)
+	}
+	return s.run(ctx, agent, messages, options)
+}
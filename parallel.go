@@ -0,0 +1,83 @@
+package swarmgo
+
+import (
+	"context"
+	"sync"
+
+	"github.com/wlevene/swarmgo/llm"
+)
+
+// DefaultMaxParallelToolCalls bounds how many tool calls of one assistant
+// message run at once when the agent enables ParallelToolCalls.
+const DefaultMaxParallelToolCalls = 4
+
+// toolCallOutcome is the result of one tool call of an assistant message
+type toolCallOutcome struct {
+	resp Response
+	err  error
+}
+
+// SetMaxParallelToolCalls sets how many tool calls may run at once for agents
+// with ParallelToolCalls enabled. Zero or less restores the default.
+func (s *Swarm) SetMaxParallelToolCalls(n int) {
+	s.maxParallelToolCalls = n
+}
+
+// handleToolCalls executes the tool calls of one assistant message and
+// returns their outcomes in call order, stopping at the first call that fails
+// the run. Calls run one after another, each seeing the context variable
+// updates of the calls before it, unless the agent enables ParallelToolCalls.
+// Parallel calls each get a snapshot of the context variables, so they should
+// report updates through Result.ContextVariables rather than by mutating the
+// map; the updates are merged in call order once all calls are done.
+func (s *Swarm) handleToolCalls(
+	ctx context.Context,
+	toolCalls []llm.ToolCall,
+	agent Agent,
+	contextVariables map[string]interface{},
+	opts RunOptions,
+) []toolCallOutcome {
+	outcomes := make([]toolCallOutcome, len(toolCalls))
+
+	if !agent.GetParallelToolCalls() || len(toolCalls) < 2 {
+		for i := range toolCalls {
+			resp, err := s.handleToolCall(ctx, &toolCalls[i], agent, contextVariables, opts)
+			outcomes[i] = toolCallOutcome{resp: resp, err: err}
+			if err != nil {
+				return outcomes[:i+1]
+			}
+			mergeContextVariables(contextVariables, resp.ContextVariables)
+		}
+		return outcomes
+	}
+
+	workers := s.maxParallelToolCalls
+	if workers <= 0 {
+		workers = DefaultMaxParallelToolCalls
+	}
+
+	var wg sync.WaitGroup
+	sem := make(chan struct{}, workers)
+	for i := range toolCalls {
+		snapshot := make(map[string]interface{}, len(contextVariables))
+		mergeContextVariables(snapshot, contextVariables)
+
+		wg.Add(1)
+		sem <- struct{}{}
+		go func(i int) {
+			defer wg.Done()
+			defer func() { <-sem }()
+			resp, err := s.handleToolCall(ctx, &toolCalls[i], agent, snapshot, opts)
+			outcomes[i] = toolCallOutcome{resp: resp, err: err}
+		}(i)
+	}
+	wg.Wait()
+
+	for i, outcome := range outcomes {
+		mergeContextVariables(contextVariables, outcome.resp.ContextVariables)
+		if outcome.err != nil {
+			return outcomes[:i+1]
+		}
+	}
+	return outcomes
+}
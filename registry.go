@@ -0,0 +1,184 @@
+package swarmgo
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+
+	"github.com/wlevene/swarmgo/llm"
+)
+
+// ErrUnknownProvider is returned when no factory is registered for a provider
+var ErrUnknownProvider = errors.New("unknown LLM provider")
+
+// ClientFactory builds an LLM client from connection settings. cfg carries
+// the registry's RateLimiter for the provider and key; factories that do not
+// call llm.NewLLM should apply it with llm.WithRateLimiter.
+type ClientFactory func(cfg llm.Config) (llm.LLM, error)
+
+// clientKey identifies a cached client. Clients built from an agent's
+// ClientConfig are keyed by that config.
+type clientKey struct {
+	provider llm.LLMProvider
+	apiKey   string
+	config   *ClientConfig
+}
+
+// limiterKey identifies the rate limiter shared by the clients of a provider and key
+type limiterKey struct {
+	provider llm.LLMProvider
+	apiKey   string
+}
+
+// ProviderRegistry resolves LLM clients by provider and API key. Clients are
+// created on first use and cached, so agents sharing a provider and key share
+// a client. Every client it builds for a provider and key, cached or not,
+// shares one RateLimiter, so the limits hold across all the Swarms,
+// Workflows and ConcurrentSwarms using the registry.
+type ProviderRegistry struct {
+	mu        sync.Mutex
+	factories map[llm.LLMProvider]ClientFactory
+	clients   map[clientKey]llm.LLM
+	limiters  map[limiterKey]*llm.RateLimiter
+}
+
+// DefaultProviderRegistry is used by NewSwarm and shared by every Swarm built with it
+var DefaultProviderRegistry = NewProviderRegistry()
+
+// NewProviderRegistry creates a registry with factories for the built-in providers
+func NewProviderRegistry() *ProviderRegistry {
+	r := &ProviderRegistry{
+		factories: make(map[llm.LLMProvider]ClientFactory),
+		clients:   make(map[clientKey]llm.LLM),
+		limiters:  make(map[limiterKey]*llm.RateLimiter),
+	}
+
+	for _, provider := range []llm.LLMProvider{
+		llm.OpenAI, llm.Azure, llm.AzureAD, llm.CloudflareAzure,
+		llm.Gemini, llm.Claude, llm.Ollama, llm.DeepSeek,
+	} {
+		provider := provider
+		r.Register(provider, func(cfg llm.Config) (llm.LLM, error) {
+			return llm.NewLLM(provider, cfg)
+		})
+	}
+
+	return r
+}
+
+// Register sets the factory used for a provider. Clients already cached for
+// the provider are dropped.
+func (r *ProviderRegistry) Register(provider llm.LLMProvider, factory ClientFactory) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.factories[provider] = factory
+	for key := range r.clients {
+		if key.provider == provider {
+			delete(r.clients, key)
+		}
+	}
+}
+
+// Client returns the cached client for provider and apiKey, creating it if needed
+func (r *ProviderRegistry) Client(provider llm.LLMProvider, apiKey string) (llm.LLM, error) {
+	return r.cachedClient(clientKey{provider: provider, apiKey: apiKey}, llm.Config{APIKey: apiKey})
+}
+
+// ClientForConfig returns the cached client built from cfg, creating it if needed
+func (r *ProviderRegistry) ClientForConfig(cfg *ClientConfig) (llm.LLM, error) {
+	return r.cachedClient(clientKey{provider: cfg.Provider, config: cfg}, cfg.llmConfig())
+}
+
+// SetRateLimits sets the limits shared by the clients of provider using
+// apiKey. Clients created before the call are limited too.
+func (r *ProviderRegistry) SetRateLimits(provider llm.LLMProvider, apiKey string, limits llm.RateLimits) {
+	r.RateLimiter(provider, apiKey).SetLimits(limits)
+}
+
+// RateLimiter returns the limiter shared by the clients of provider using
+// apiKey. It is unlimited until SetRateLimits is called.
+func (r *ProviderRegistry) RateLimiter(provider llm.LLMProvider, apiKey string) *llm.RateLimiter {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.rateLimiter(provider, apiKey)
+}
+
+// rateLimiter returns the limiter for provider and apiKey, creating it if
+// needed; r.mu must be held
+func (r *ProviderRegistry) rateLimiter(provider llm.LLMProvider, apiKey string) *llm.RateLimiter {
+	key := limiterKey{provider: provider, apiKey: apiKey}
+	limiter, ok := r.limiters[key]
+	if !ok {
+		limiter = llm.NewRateLimiter(llm.RateLimits{})
+		r.limiters[key] = limiter
+	}
+	return limiter
+}
+
+// NewClient builds an uncached client for provider from cfg
+func (r *ProviderRegistry) NewClient(provider llm.LLMProvider, cfg llm.Config) (llm.LLM, error) {
+	r.mu.Lock()
+	factory, ok := r.factories[provider]
+	if cfg.RateLimiter == nil {
+		cfg.RateLimiter = r.rateLimiter(provider, cfg.APIKey)
+	}
+	r.mu.Unlock()
+
+	if !ok {
+		return nil, fmt.Errorf("%w: %s", ErrUnknownProvider, provider)
+	}
+	client, err := factory(cfg)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create %s client: %w", provider, err)
+	}
+	return client, nil
+}
+
+func (r *ProviderRegistry) cachedClient(key clientKey, cfg llm.Config) (llm.LLM, error) {
+	r.mu.Lock()
+	client, ok := r.clients[key]
+	r.mu.Unlock()
+	if ok {
+		return client, nil
+	}
+
+	client, err := r.NewClient(key.provider, cfg)
+	if err != nil {
+		return nil, err
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	// Another caller may have created the client in the meantime
+	if existing, ok := r.clients[key]; ok {
+		return existing, nil
+	}
+	r.clients[key] = client
+	return client, nil
+}
+
+// SetProviderRegistry sets the registry used to resolve per-agent clients
+func (s *Swarm) SetProviderRegistry(registry *ProviderRegistry) {
+	s.registry = registry
+}
+
+// clientFor resolves the LLM client for an agent. An agent's ClientConfig
+// takes precedence over its LLM settings. Agents without a provider, and
+// agents on the Swarm's provider without a different key, use the Swarm's
+// default client.
+func (s *Swarm) clientFor(agent Agent) (llm.LLM, error) {
+	if cfg := agent.GetConfig(); cfg != nil && s.registry != nil {
+		return s.registry.ClientForConfig(cfg)
+	}
+
+	model := agent.GetModel()
+	provider := llm.LLMProvider(model.LLMProvider)
+	if provider == "" || s.registry == nil {
+		return s.client, nil
+	}
+	if provider == s.provider && (model.ApiKey == "" || model.ApiKey == s.apiKey) {
+		return s.client, nil
+	}
+	return s.registry.Client(provider, model.ApiKey)
+}
@@ -0,0 +1,202 @@
+package swarmgo
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/wlevene/swarmgo/llm"
+)
+
+// ErrSessionNotFound is returned by a SessionStore that has no session with the requested ID
+var ErrSessionNotFound = errors.New("session not found")
+
+// SessionState is the persisted part of a Session. The active agent is
+// stored by name and resolved against the agents known to the Session.
+type SessionState struct {
+	ID               string                 `json:"id"`
+	Messages         []llm.Message          `json:"messages"`
+	AgentName        string                 `json:"agent_name"`
+	View             []llm.Message          `json:"view,omitempty"`         // Conversation the active agent sees after a filtered handoff; nil means Messages
+	CallStack        []string               `json:"call_stack,omitempty"`   // Names of the agents waiting for a HandoffCall to return
+	CallerViews      [][]llm.Message        `json:"caller_views,omitempty"` // What the CallStack agents saw when they made filtered calls
+	ContextVariables map[string]interface{} `json:"context_variables"`
+	Usage            UsageReport            `json:"usage"`
+	UpdatedAt        time.Time              `json:"updated_at"`
+}
+
+// SessionStore persists session states keyed by session ID
+type SessionStore interface {
+	// Load returns ErrSessionNotFound when the store has no session with id
+	Load(ctx context.Context, id string) (*SessionState, error)
+	Save(ctx context.Context, state *SessionState) error
+	Delete(ctx context.Context, id string) error
+}
+
+// Session is a conversation that spans several Run calls. It keeps the full
+// history, including tool calls and their results, the active agent, the
+// context variables and the accumulated usage, and saves them to its store
+// after every turn.
+type Session struct {
+	mu         sync.Mutex
+	swarm      *Swarm
+	store      SessionStore
+	agents     map[string]Agent // Agents the active agent can be restored to, by name
+	agent      Agent
+	stack      []Agent         // Agents waiting for a HandoffCall to return
+	views      [][]llm.Message // What the stack agents saw when they made their calls
+	state      SessionState
+	runOptions []RunOption
+}
+
+// OpenSession resumes session id from store, or starts it with agent when the
+// store does not know it. agents lists the other agents the conversation can
+// be handed off to, so that a resumed session continues with the agent that
+// was active; unknown agent names fall back to agent.
+func (s *Swarm) OpenSession(ctx context.Context, store SessionStore, id string, agent Agent, agents ...Agent) (*Session, error) {
+	session := &Session{
+		swarm:  s,
+		store:  store,
+		agents: make(map[string]Agent),
+		agent:  agent,
+		state:  SessionState{ID: id},
+	}
+	for _, a := range append([]Agent{agent}, agents...) {
+		session.agents[a.GetName()] = a
+	}
+
+	state, err := store.Load(ctx, id)
+	switch {
+	case errors.Is(err, ErrSessionNotFound):
+	case err != nil:
+		return nil, fmt.Errorf("failed to load session %s: %w", id, err)
+	default:
+		session.state = *state
+		if restored, ok := session.agents[state.AgentName]; ok {
+			session.agent = restored
+		}
+		for i, name := range state.CallStack {
+			if caller, ok := session.agents[name]; ok {
+				session.stack = append(session.stack, caller)
+				var view []llm.Message
+				if i < len(state.CallerViews) {
+					view = state.CallerViews[i]
+				}
+				session.views = append(session.views, view)
+			}
+		}
+	}
+	if session.state.ContextVariables == nil {
+		session.state.ContextVariables = make(map[string]interface{})
+	}
+	return session, nil
+}
+
+// SetRunOptions sets options applied to every Run of the session
+func (ss *Session) SetRunOptions(opts ...RunOption) {
+	ss.mu.Lock()
+	defer ss.mu.Unlock()
+	ss.runOptions = opts
+}
+
+// Send adds a user message to the conversation, runs the active agent and
+// saves the session. When the run fails the session is left unchanged, so
+// the message can be sent again.
+func (ss *Session) Send(ctx context.Context, text string) (Response, error) {
+	return ss.SendMessage(ctx, llm.Message{Role: llm.RoleUser, Content: text})
+}
+
+// SendMessage is like Send for an arbitrary message
+func (ss *Session) SendMessage(ctx context.Context, message llm.Message) (Response, error) {
+	ss.mu.Lock()
+	defer ss.mu.Unlock()
+
+	// After a filtered handoff the agent continues from what the filter left
+	sent := ss.state.Messages
+	if ss.state.View != nil {
+		sent = ss.state.View
+	}
+	history := append(append([]llm.Message{}, sent...), message)
+	contextVariables := make(map[string]interface{}, len(ss.state.ContextVariables))
+	mergeContextVariables(contextVariables, ss.state.ContextVariables)
+
+	opts := append([]RunOption{WithContextVariables(contextVariables), WithCallStack(ss.stack), WithCallerViews(ss.views)}, ss.runOptions...)
+	resp, err := ss.swarm.RunWithOptions(ctx, ss.agent, history, opts...)
+	if err != nil {
+		return resp, err
+	}
+
+	state := ss.state
+	state.Messages = append(append(append([]llm.Message{}, ss.state.Messages...), message), resp.Messages...)
+	switch {
+	case resp.View != nil:
+		state.View = resp.View
+	case ss.state.View != nil:
+		state.View = append(history, resp.Messages...)
+	}
+	state.ContextVariables = resp.ContextVariables
+	state.Usage = UsageReport{}
+	state.Usage.Merge(ss.state.Usage)
+	state.Usage.Merge(resp.Usage)
+	state.UpdatedAt = time.Now()
+	agent := ss.agent
+	if resp.Agent != nil {
+		agent = resp.Agent
+		ss.agents[agent.GetName()] = agent
+	}
+	state.AgentName = agent.GetName()
+	state.CallStack = nil
+	for _, caller := range resp.CallStack {
+		ss.agents[caller.GetName()] = caller
+		state.CallStack = append(state.CallStack, caller.GetName())
+	}
+	state.CallerViews = resp.CallerViews
+
+	if err := ss.store.Save(ctx, &state); err != nil {
+		return resp, fmt.Errorf("failed to save session %s: %w", state.ID, err)
+	}
+	ss.state = state
+	ss.agent = agent
+	ss.stack = resp.CallStack
+	ss.views = resp.CallerViews
+	return resp, nil
+}
+
+// ID returns the session ID
+func (ss *Session) ID() string {
+	return ss.state.ID
+}
+
+// Agent returns the active agent
+func (ss *Session) Agent() Agent {
+	ss.mu.Lock()
+	defer ss.mu.Unlock()
+	return ss.agent
+}
+
+// Messages returns a copy of the conversation history
+func (ss *Session) Messages() []llm.Message {
+	ss.mu.Lock()
+	defer ss.mu.Unlock()
+	return append([]llm.Message{}, ss.state.Messages...)
+}
+
+// ContextVariables returns a copy of the context variables
+func (ss *Session) ContextVariables() map[string]interface{} {
+	ss.mu.Lock()
+	defer ss.mu.Unlock()
+	contextVariables := make(map[string]interface{}, len(ss.state.ContextVariables))
+	mergeContextVariables(contextVariables, ss.state.ContextVariables)
+	return contextVariables
+}
+
+// Usage returns the usage accumulated over the session
+func (ss *Session) Usage() UsageReport {
+	ss.mu.Lock()
+	defer ss.mu.Unlock()
+	var usage UsageReport
+	usage.Merge(ss.state.Usage)
+	return usage
+}
@@ -0,0 +1,178 @@
+package swarmgo
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+// MemorySessionStore keeps sessions in memory. Sessions are lost when the
+// process exits.
+type MemorySessionStore struct {
+	mu       sync.RWMutex
+	sessions map[string][]byte // Encoded states, so callers cannot share them
+}
+
+// NewMemorySessionStore creates an empty in-memory session store
+func NewMemorySessionStore() *MemorySessionStore {
+	return &MemorySessionStore{sessions: make(map[string][]byte)}
+}
+
+// Load implements SessionStore
+func (m *MemorySessionStore) Load(ctx context.Context, id string) (*SessionState, error) {
+	m.mu.RLock()
+	data, ok := m.sessions[id]
+	m.mu.RUnlock()
+	if !ok {
+		return nil, ErrSessionNotFound
+	}
+	return decodeSessionState(data)
+}
+
+// Save implements SessionStore
+func (m *MemorySessionStore) Save(ctx context.Context, state *SessionState) error {
+	data, err := json.Marshal(state)
+	if err != nil {
+		return err
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.sessions[state.ID] = data
+	return nil
+}
+
+// Delete implements SessionStore
+func (m *MemorySessionStore) Delete(ctx context.Context, id string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	delete(m.sessions, id)
+	return nil
+}
+
+// FileSessionStore keeps each session in a JSON file named after its ID
+type FileSessionStore struct {
+	dir string
+}
+
+// NewFileSessionStore creates a store writing to dir, creating it if needed
+func NewFileSessionStore(dir string) (*FileSessionStore, error) {
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, fmt.Errorf("failed to create session directory: %w", err)
+	}
+	return &FileSessionStore{dir: dir}, nil
+}
+
+// path returns the file of session id. IDs are escaped so they cannot leave the directory.
+func (f *FileSessionStore) path(id string) string {
+	return filepath.Join(f.dir, fmt.Sprintf("%x.json", id))
+}
+
+// Load implements SessionStore
+func (f *FileSessionStore) Load(ctx context.Context, id string) (*SessionState, error) {
+	data, err := os.ReadFile(f.path(id))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, ErrSessionNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	return decodeSessionState(data)
+}
+
+// Save implements SessionStore. The file is replaced atomically, so a crash
+// never leaves a truncated session behind.
+func (f *FileSessionStore) Save(ctx context.Context, state *SessionState) error {
+	data, err := json.MarshalIndent(state, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(f.dir, "session-*.tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), f.path(state.ID))
+}
+
+// Delete implements SessionStore
+func (f *FileSessionStore) Delete(ctx context.Context, id string) error {
+	if err := os.Remove(f.path(id)); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+	return nil
+}
+
+// SQLiteSessionStore keeps sessions in a SQLite table. The database is opened
+// by the caller with the driver of their choice, e.g. modernc.org/sqlite or
+// github.com/mattn/go-sqlite3; swarmgo does not import one. Saving uses an
+// upsert, which requires SQLite 3.24 or later.
+type SQLiteSessionStore struct {
+	db    *sql.DB
+	table string
+}
+
+// NewSQLiteSessionStore creates the sessions table in db if it does not exist
+func NewSQLiteSessionStore(ctx context.Context, db *sql.DB) (*SQLiteSessionStore, error) {
+	store := &SQLiteSessionStore{db: db, table: "swarmgo_sessions"}
+	_, err := db.ExecContext(ctx, `CREATE TABLE IF NOT EXISTS `+store.table+` (
+		id TEXT PRIMARY KEY,
+		state TEXT NOT NULL,
+		updated_at TIMESTAMP NOT NULL
+	)`)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create sessions table: %w", err)
+	}
+	return store, nil
+}
+
+// Load implements SessionStore
+func (q *SQLiteSessionStore) Load(ctx context.Context, id string) (*SessionState, error) {
+	var data string
+	err := q.db.QueryRowContext(ctx, `SELECT state FROM `+q.table+` WHERE id = ?`, id).Scan(&data)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, ErrSessionNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	return decodeSessionState([]byte(data))
+}
+
+// Save implements SessionStore
+func (q *SQLiteSessionStore) Save(ctx context.Context, state *SessionState) error {
+	data, err := json.Marshal(state)
+	if err != nil {
+		return err
+	}
+	_, err = q.db.ExecContext(ctx, `INSERT INTO `+q.table+` (id, state, updated_at) VALUES (?, ?, ?)
+		ON CONFLICT(id) DO UPDATE SET state = excluded.state, updated_at = excluded.updated_at`,
+		state.ID, string(data), state.UpdatedAt)
+	return err
+}
+
+// Delete implements SessionStore
+func (q *SQLiteSessionStore) Delete(ctx context.Context, id string) error {
+	_, err := q.db.ExecContext(ctx, `DELETE FROM `+q.table+` WHERE id = ?`, id)
+	return err
+}
+
+func decodeSessionState(data []byte) (*SessionState, error) {
+	var state SessionState
+	if err := json.Unmarshal(data, &state); err != nil {
+		return nil, fmt.Errorf("invalid session state: %w", err)
+	}
+	return &state, nil
+}
@@ -3,7 +3,9 @@ package swarmgo
 import (
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
 
 	"github.com/wlevene/swarmgo/llm"
 )
@@ -26,7 +28,71 @@ func (h *DefaultStreamHandler) OnToolCall(toolCall llm.ToolCall) {}
 func (h *DefaultStreamHandler) OnComplete(message llm.Message)   {}
 func (h *DefaultStreamHandler) OnError(err error)                {}
 
-// StreamingResponse handles streaming chat completions
+// streamCompletion opens a stream through the Swarm's stream middleware and
+// collects the streamed chunks into a single response
+func (s *Swarm) streamCompletion(ctx context.Context, agent Agent, req llm.ChatCompletionRequest) (llm.ChatCompletionResponse, error) {
+	stream, err := s.llmStreamHandler()(ctx, agent, req)
+	if err != nil {
+		return llm.ChatCompletionResponse{}, err
+	}
+	defer stream.Close()
+
+	var resp llm.ChatCompletionResponse
+	choice := llm.Choice{Message: llm.Message{Role: llm.RoleAssistant}}
+	var toolCalls []*llm.ToolCall
+	byID := make(map[string]*llm.ToolCall)
+	for {
+		chunk, err := stream.Recv()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			return llm.ChatCompletionResponse{}, err
+		}
+		if chunk.ID != "" {
+			resp.ID = chunk.ID
+		}
+		if chunk.Usage.TotalTokens > 0 {
+			resp.Usage = chunk.Usage
+		}
+		if chunk.Metadata.Model != "" {
+			resp.Metadata = chunk.Metadata
+		}
+		if len(chunk.Choices) == 0 {
+			continue
+		}
+
+		delta := chunk.Choices[0]
+		choice.Message.Content += delta.Message.Content
+		if delta.FinishReason != "" {
+			choice.FinishReason = delta.FinishReason
+		}
+		// Chunks without an ID continue the last tool call
+		for _, call := range delta.Message.ToolCalls {
+			current, ok := byID[call.ID]
+			if !ok && call.ID == "" && len(toolCalls) > 0 {
+				current, ok = toolCalls[len(toolCalls)-1], true
+			}
+			if !ok {
+				current = &llm.ToolCall{ID: call.ID, Type: call.Type}
+				byID[call.ID] = current
+				toolCalls = append(toolCalls, current)
+			}
+			if current.Function.Name == "" {
+				current.Function.Name = call.Function.Name
+			}
+			current.Function.Arguments += call.Function.Arguments
+		}
+	}
+	for _, call := range toolCalls {
+		choice.Message.ToolCalls = append(choice.Message.ToolCalls, *call)
+	}
+	resp.Choices = []llm.Choice{choice}
+	return resp, nil
+}
+
+// StreamingResponse handles streaming chat completions. Generation settings
+// passed here override those of the agent for this call.
 func (s *Swarm) StreamingResponse(
 	ctx context.Context,
 	agent Agent,
@@ -35,6 +101,7 @@ func (s *Swarm) StreamingResponse(
 	modelOverride string,
 	handler StreamHandler,
 	debug bool,
+	generation ...GenerationSettings,
 ) error {
 	if handler == nil {
 		handler = &DefaultStreamHandler{}
@@ -50,11 +117,24 @@ func (s *Swarm) StreamingResponse(
 		fmt.Printf("Debug: Number of tools: %d\n", len(agent.GetFunctions()))
 	}
 
+	// Output guardrails cannot hold back tokens that were already streamed,
+	// so only input guardrails apply here
+	if err := checkInputGuardrails(ctx, agent, messages); err != nil {
+		handler.OnError(err)
+		return err
+	}
+
+	policy := s.toolErrorPolicyFor(agent)
+	toolHandler := s.toolHandler(nil)
+	// Agent tools run nested runs with this Swarm
+	ctx = withRunScope(ctx, s, defaultRunOptions())
+
 	// Prepare the initial system message with agent instructions
-	instructions := agent.GetInstructions()
-	// if agent.InstructionsFunc != nil {
-	// 	instructions = agent.InstructionsFunc(contextVariables)
-	// }
+	instructions, err := agent.RenderInstructions(contextVariables)
+	if err != nil {
+		handler.OnError(err)
+		return err
+	}
 	allMessages := append([]llm.Message{
 		{
 			Role:    llm.RoleSystem,
@@ -96,8 +176,31 @@ func (s *Swarm) StreamingResponse(
 		Tools:    tools,
 		Stream:   true,
 	}
+	generationFor(agent, generation).apply(&req)
+	// Providers reject a choice that forces a function the agent does not have
+	if choice := req.ToolChoice; choice != nil && choice.Mode == llm.ToolChoiceFunction && !hasTool(tools, choice.Function) {
+		req.ToolChoice = nil
+	}
+
+	// Streams are opened through the Swarm's stream middleware
+	openStream := s.llmStreamHandler()
+
+	// fitContext shrinks the request to the model's context window
+	fitContext := func() error {
+		if s.contextWindow == nil {
+			return nil
+		}
+		if err := s.contextWindow.fit(ctx, &req); err != nil {
+			handler.OnError(err)
+			return err
+		}
+		return nil
+	}
+	if err := fitContext(); err != nil {
+		return err
+	}
 
-	stream, err := s.client.CreateChatCompletionStream(ctx, req)
+	stream, err := openStream(ctx, agent, req)
 	if err != nil {
 		if debug {
 			fmt.Printf("Debug: Stream creation error: %v\n", err)
@@ -116,6 +219,7 @@ func (s *Swarm) StreamingResponse(
 	// Track tool calls being built
 	toolCallsInProgress := make(map[string]*llm.ToolCall)
 	processedToolCalls := make(map[string]bool)
+	turn := 0 // Incremented with every follow-up stream
 
 	// createNewStream creates a new stream and handles errors
 	createNewStream := func() error {
@@ -124,7 +228,16 @@ func (s *Swarm) StreamingResponse(
 			return err
 		}
 
-		newStream, err := s.client.CreateChatCompletionStream(ctx, req)
+		if err := fitContext(); err != nil {
+			return err
+		}
+
+		// A forced tool choice would make the model call tools forever
+		if req.ToolChoice.Forces() {
+			req.ToolChoice = nil
+		}
+
+		newStream, err := openStream(ctx, agent, req)
 		if err != nil {
 			if debug {
 				fmt.Printf("Debug: Error creating new stream: %v\n", err)
@@ -133,6 +246,7 @@ func (s *Swarm) StreamingResponse(
 			return err
 		}
 		stream = newStream
+		turn++
 		return nil
 	}
 
@@ -144,17 +258,10 @@ func (s *Swarm) StreamingResponse(
 		default:
 			response, err := stream.Recv()
 			if err != nil {
-				if err.Error() == "EOF" {
+				if errors.Is(err, io.EOF) {
 					handler.OnComplete(currentMessage)
 					return nil
 				}
-				if err.Error() == "stream closed" {
-					// If stream is closed, try to create a new one
-					if err := createNewStream(); err != nil {
-						return err
-					}
-					continue
-				}
 				if debug {
 					fmt.Printf("Debug: Error receiving from stream: %v\n", err)
 				}
@@ -264,16 +371,47 @@ func (s *Swarm) StreamingResponse(
 										inProgress.Function.Name, args)
 								}
 
-								// Execute the function
-								result := fn.GetFunction()(args, contextVariables)
+								// Sensitive functions wait for approval
+								args, rejection, err := approveToolCall(ctx, s.approval, agent, fn, inProgress, args)
+								if err != nil {
+									handler.OnError(err)
+									return err
+								}
+
+								// Execute the function unless it was rejected
+								var result Result
+								var attempts int
+								if rejection == "" {
+									result, attempts = callFunction(ctx, toolHandler, ToolInvocation{
+										Agent:            agent,
+										Function:         fn,
+										ToolCall:         *inProgress,
+										Args:             args,
+										ContextVariables: contextVariables,
+										Turn:             turn,
+									}, policy)
+									mergeContextVariables(contextVariables, result.ContextVariables)
+								}
 
 								// Create function response message
 								var resultContent string
-								if result.Error != nil {
-									resultContent = fmt.Sprintf("Error: %v", result.Error)
+								if rejection != "" {
+									resultContent = rejectionContent(inProgress.Function.Name, rejection)
+								} else if result.Error != nil {
+									toolErr := &ToolError{
+										ToolName:   inProgress.Function.Name,
+										ToolCallID: inProgress.ID,
+										Attempts:   attempts,
+										Err:        result.Error,
+									}
 									if debug {
-										fmt.Printf("Debug: Function execution error: %v\n", result.Error)
+										fmt.Printf("Debug: Function execution error: %v\n", toolErr)
 									}
+									if policy.Mode == ToolErrorFail {
+										handler.OnError(toolErr)
+										return toolErr
+									}
+									resultContent = toolErrorContent(toolErr)
 								} else {
 									resultContent = fmt.Sprintf("%v", result.Data)
 									if debug {
@@ -291,9 +429,10 @@ func (s *Swarm) StreamingResponse(
 
 								// Add function response message
 								functionMessage := llm.Message{
-									Role:    llm.RoleFunction,
-									Content: resultContent,
-									Name:    inProgress.Function.Name,
+									Role:       llm.RoleTool,
+									Content:    resultContent,
+									Name:       inProgress.Function.Name,
+									ToolCallID: inProgress.ID,
 								}
 
 								// Add messages and create new stream
@@ -306,6 +445,12 @@ func (s *Swarm) StreamingResponse(
 										functionMessage.Name, functionMessage.Content)
 								}
 
+								// A terminal result ends the conversation without a follow-up
+								if result.Terminal {
+									handler.OnComplete(currentMessage)
+									return nil
+								}
+
 								if err := createNewStream(); err != nil {
 									handler.OnError(fmt.Errorf("failed to create new stream after tool call: %v", err))
 									return err
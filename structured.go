@@ -0,0 +1,216 @@
+package swarmgo
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"regexp"
+	"strings"
+
+	"github.com/invopop/jsonschema"
+	"github.com/wlevene/swarmgo/llm"
+)
+
+// DefaultOutputRetries is the number of times RunTyped re-asks the model for
+// output that fails to parse or validate.
+const DefaultOutputRetries = 2
+
+// StructuredOutputError is returned by RunTyped when the model's final
+// message cannot be parsed into the requested type after every attempt.
+type StructuredOutputError struct {
+	Attempts int    // Runs made, including re-asks
+	Content  string // Content of the last final message
+	Err      error  // Last parse or validation error
+}
+
+func (e *StructuredOutputError) Error() string {
+	return fmt.Sprintf("structured output invalid after %d attempts: %v", e.Attempts, e.Err)
+}
+
+func (e *StructuredOutputError) Unwrap() error {
+	return e.Err
+}
+
+// Validator is implemented by output types with checks beyond the schema
+type Validator interface {
+	Validate() error
+}
+
+// ResponseFormatFor returns a response format whose schema is derived from T,
+// which should be a struct.
+func ResponseFormatFor[T any]() (*llm.ResponseFormat, error) {
+	reflector := jsonschema.Reflector{
+		AllowAdditionalProperties: false,
+		DoNotReference:            true,
+	}
+	var v T
+	data, err := json.Marshal(reflector.Reflect(v))
+	if err != nil {
+		return nil, fmt.Errorf("failed to generate schema: %w", err)
+	}
+
+	var schema map[string]interface{}
+	if err := json.Unmarshal(data, &schema); err != nil {
+		return nil, fmt.Errorf("failed to generate schema: %w", err)
+	}
+	delete(schema, "$schema")
+	delete(schema, "$id")
+
+	return &llm.ResponseFormat{
+		Type:   llm.ResponseFormatJSONSchema,
+		Name:   schemaName(reflect.TypeOf(v)),
+		Schema: schema,
+	}, nil
+}
+
+var invalidSchemaName = regexp.MustCompile(`[^a-zA-Z0-9_-]`)
+
+// schemaName derives a provider-safe schema name from a type
+func schemaName(t reflect.Type) string {
+	for t != nil && t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+	if t == nil || t.Name() == "" {
+		return "response"
+	}
+	return invalidSchemaName.ReplaceAllString(t.Name(), "_")
+}
+
+// RunTyped runs agent like RunWithOptions, asking the model for JSON that
+// matches a schema derived from T, and parses the final message into T. Output
+// that fails to parse or validate is sent back to the model with the error,
+// up to OutputRetries times, after which a *StructuredOutputError is
+// returned. The Response covers every attempt.
+func RunTyped[T any](ctx context.Context, s *Swarm, agent Agent, messages []llm.Message, opts ...RunOption) (T, Response, error) {
+	var value T
+
+	options := defaultRunOptions()
+	for _, opt := range opts {
+		opt(&options)
+	}
+	if options.ResponseFormat == nil {
+		format, err := ResponseFormatFor[T]()
+		if err != nil {
+			return value, Response{}, err
+		}
+		options.ResponseFormat = format
+	}
+
+	history := append([]llm.Message{}, messages...)
+	var total Response
+	for attempt := 1; ; attempt++ {
+		resp, err := s.run(ctx, agent, history, options)
+		total = mergeResponses(total, resp)
+		if err != nil {
+			return value, total, err
+		}
+		history = append(history, resp.Messages...)
+		if total.View != nil {
+			// Keep a handoff's input filter in effect
+			history = append([]llm.Message{}, total.View...)
+		}
+
+		content := finalContent(resp.Messages)
+		var parsed T
+		parseErr := parseStructured(content, options.ResponseFormat.Schema, &parsed)
+		if parseErr == nil {
+			return parsed, total, nil
+		}
+		if attempt > options.OutputRetries {
+			return value, total, &StructuredOutputError{Attempts: attempt, Content: content, Err: parseErr}
+		}
+
+		// Re-ask the active agent with the error
+		correction := llm.Message{
+			Role:    llm.RoleUser,
+			Content: fmt.Sprintf("Your response was not valid: %v. Reply with only a JSON object matching the schema.", parseErr),
+		}
+		history = append(history, correction)
+		total.Messages = append(total.Messages, correction)
+		if total.View != nil {
+			total.View = append(total.View, correction)
+		}
+		if resp.Agent != nil {
+			agent = resp.Agent
+		}
+		options.ContextVariables = resp.ContextVariables
+		options.CallStack, options.CallerViews = resp.CallStack, resp.CallerViews
+	}
+}
+
+// mergeResponses appends the response of a follow-up run to total
+func mergeResponses(total, next Response) Response {
+	total.Messages = append(total.Messages, next.Messages...)
+	total.ToolErrors = append(total.ToolErrors, next.ToolErrors...)
+	total.SubRuns = append(total.SubRuns, next.SubRuns...)
+	total.CallStack = next.CallStack
+	total.CallerViews = next.CallerViews
+	total.Usage.Merge(next.Usage)
+	if next.Agent != nil {
+		total.Agent = next.Agent
+	}
+	if next.ContextVariables != nil {
+		total.ContextVariables = next.ContextVariables
+	}
+	total.Terminated = next.Terminated
+	switch {
+	case next.View != nil:
+		total.View = next.View
+	case total.View != nil:
+		total.View = append(total.View, next.Messages...)
+	}
+	return total
+}
+
+// finalContent returns the content of the last assistant message
+func finalContent(messages []llm.Message) string {
+	for i := len(messages) - 1; i >= 0; i-- {
+		if messages[i].Role == llm.RoleAssistant {
+			return messages[i].Content
+		}
+	}
+	return ""
+}
+
+// parseStructured unmarshals content into v, rejecting unknown fields and
+// missing required ones, then runs v's Validate method if it has one
+func parseStructured(content string, schema map[string]interface{}, v interface{}) error {
+	content = strings.TrimSpace(content)
+	// Models sometimes wrap JSON in a Markdown code fence
+	if strings.HasPrefix(content, "```") {
+		content = strings.TrimPrefix(content, "```json")
+		content = strings.TrimPrefix(content, "```")
+		content = strings.TrimSuffix(strings.TrimSpace(content), "```")
+	}
+	if content == "" {
+		return fmt.Errorf("response is empty")
+	}
+
+	var fields map[string]json.RawMessage
+	if err := json.Unmarshal([]byte(content), &fields); err != nil {
+		return fmt.Errorf("response is not a JSON object: %w", err)
+	}
+	if required, ok := schema["required"].([]interface{}); ok {
+		for _, r := range required {
+			if name, ok := r.(string); ok {
+				if _, ok := fields[name]; !ok {
+					return fmt.Errorf("missing required field %q", name)
+				}
+			}
+		}
+	}
+
+	decoder := json.NewDecoder(bytes.NewReader([]byte(content)))
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(v); err != nil {
+		return fmt.Errorf("response does not match the schema: %w", err)
+	}
+
+	// v is a pointer, so this matches value and pointer receivers alike
+	if validator, ok := v.(Validator); ok {
+		return validator.Validate()
+	}
+	return nil
+}
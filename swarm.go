@@ -3,6 +3,7 @@ package swarmgo
 import (
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"log"
 	"time"
@@ -10,51 +11,53 @@ import (
 	"github.com/wlevene/swarmgo/llm"
 )
 
+// DefaultMaxTurns is the number of completions Run makes when the caller does
+// not specify a positive maxTurns.
+const DefaultMaxTurns = 10
+
 // Swarm represents the main structure
 type Swarm struct {
-	client llm.LLM
+	client               llm.LLM           // Default client for agents without a provider
+	provider             llm.LLMProvider   // Provider of the default client
+	apiKey               string            // API key of the default client
+	registry             *ProviderRegistry // Resolves per-agent clients
+	toolErrorPolicy      ToolErrorPolicy
+	maxParallelToolCalls int // Bounds concurrent tool calls for agents with ParallelToolCalls
+	llmMiddleware        []LLMMiddleware
+	llmStreamMiddleware  []LLMStreamMiddleware
+	toolMiddleware       []ToolMiddleware
+	contextWindow        *ContextWindow // Shrinks histories that exceed a model's context
+	approval             ApprovalFunc   // Approves calls to functions that require approval
 }
 
-// NewSwarm initializes a new Swarm instance with an LLM client
+// NewSwarm initializes a new Swarm instance with an LLM client. It returns nil
+// if the client cannot be created; use NewSwarmFromConfig to get the error.
 func NewSwarm(apiKey string, provider llm.LLMProvider) *Swarm {
-	if provider == llm.OpenAI {
-		client := llm.NewOpenAILLM(apiKey)
-		return &Swarm{
-			client: client,
-		}
-	}
-	if provider == llm.Gemini {
-		client, err := llm.NewGeminiLLM(apiKey)
-		if err != nil {
-			log.Fatalf("Failed to create Gemini client: %v", err)
-		}
-		return &Swarm{
-			client: client,
-		}
+	swarm, err := NewSwarmFromConfig(ClientConfig{
+		Provider:  provider,
+		AuthToken: apiKey,
+	})
+	if err != nil {
+		log.Printf("Failed to create swarm: %v", err)
+		return nil
 	}
-	if provider == llm.Claude {
-		client := llm.NewClaudeLLM(apiKey)
+	return swarm
+}
 
-		return &Swarm{
-			client: client,
-		}
-	}
-	if provider == llm.Ollama {
-		client, err := llm.NewOllamaLLM()
-		if err != nil {
-			log.Fatalf("Failed to create Ollama client: %v", err)
-		}
-		return &Swarm{
-			client: client,
-		}
-	}
-	if provider == llm.DeepSeek {
-		client := llm.NewDeepSeekLLM(apiKey)
-		return &Swarm{
-			client: client,
-		}
+// NewSwarmFromConfig initializes a new Swarm whose default client is built
+// from cfg. Agents whose LLM or ClientConfig names another provider get their
+// own client from DefaultProviderRegistry.
+func NewSwarmFromConfig(cfg ClientConfig) (*Swarm, error) {
+	client, err := DefaultProviderRegistry.NewClient(cfg.Provider, cfg.llmConfig())
+	if err != nil {
+		return nil, err
 	}
-	return nil
+	return &Swarm{
+		client:   client,
+		provider: cfg.Provider,
+		apiKey:   cfg.AuthToken,
+		registry: DefaultProviderRegistry,
+	}, nil
 }
 
 // getChatCompletion requests a chat completion from the LLM
@@ -63,15 +66,20 @@ func (s *Swarm) getChatCompletion(
 	agent Agent,
 	history []llm.Message,
 	contextVariables map[string]interface{},
-	modelOverride string,
-	stream bool,
-	debug bool,
+	opts RunOptions,
 ) (llm.ChatCompletionResponse, error) {
 	// Prepare the initial system message with agent instructions
-	instructions := agent.GetInstructions()
-	// if agent.InstructionsFunc != nil {
-	// 	instructions = agent.InstructionsFunc(contextVariables)
-	// }
+	instructions, err := agent.RenderInstructions(contextVariables)
+	if err != nil {
+		return llm.ChatCompletionResponse{}, err
+	}
+	if format := opts.ResponseFormat; format != nil && format.Schema != nil {
+		schema, err := json.Marshal(format.Schema)
+		if err != nil {
+			return llm.ChatCompletionResponse{}, fmt.Errorf("invalid response schema: %w", err)
+		}
+		instructions += "\n\nRespond with only a JSON object matching this JSON schema:\n" + string(schema)
+	}
 	messages := append([]llm.Message{
 		{
 			Role:    llm.RoleSystem,
@@ -83,7 +91,7 @@ func (s *Swarm) getChatCompletion(
 	var tools []llm.Tool
 	fmt.Println()
 	fmt.Println("add funciotns...start")
-	for _, af := range agent.GetFunctions() {
+	for _, af := range functionsFor(agent, opts) {
 
 		fmt.Println("add function: ", af)
 		def := FunctionToDefinition(af)
@@ -100,18 +108,33 @@ func (s *Swarm) getChatCompletion(
 	fmt.Println()
 
 	// Prepare the chat completion request
-	model := agent.GetModel()
-	if modelOverride != "" {
-		// model = modelOverride
+	req := llm.ChatCompletionRequest{
+		Model:          requestModel(agent, opts),
+		Messages:       messages,
+		Tools:          tools,
+		ResponseFormat: opts.ResponseFormat,
+	}
+	generationFor(agent, []GenerationSettings{opts.Generation}).apply(&req)
+	// A forced tool choice would make the model call tools forever
+	if opts.toolChoiceUsed && req.ToolChoice.Forces() {
+		req.ToolChoice = nil
+	}
+	// Providers reject a choice that forces a function the agent does not have
+	if choice := req.ToolChoice; choice != nil && choice.Mode == llm.ToolChoiceFunction && !hasTool(tools, choice.Function) {
+		req.ToolChoice = nil
 	}
 
-	req := llm.ChatCompletionRequest{
-		Model:    model.Model,
-		Messages: messages,
-		Tools:    tools,
+	window := s.contextWindow
+	if opts.ContextWindow != nil {
+		window = opts.ContextWindow
+	}
+	if window != nil {
+		if err := window.fit(ctx, &req); err != nil {
+			return llm.ChatCompletionResponse{}, err
+		}
 	}
 
-	if debug {
+	if opts.Debug {
 		log.Println()
 		log.Printf("Getting chat completion for: %+v\n", messages)
 		for _, m := range req.Messages {
@@ -120,8 +143,14 @@ func (s *Swarm) getChatCompletion(
 		log.Println()
 	}
 
-	// Call the LLM to get a chat completion
-	resp, err := s.client.CreateChatCompletion(ctx, req)
+	// Call the LLM through the middleware chain to get a chat completion
+	var resp llm.ChatCompletionResponse
+	if opts.Stream {
+		req.Stream = true
+		resp, err = s.streamCompletion(ctx, agent, req)
+	} else {
+		resp, err = s.llmHandler(opts.LLMMiddleware)(ctx, agent, req)
+	}
 	if err != nil {
 		fmt.Println("error ###:", err)
 		return llm.ChatCompletionResponse{}, err
@@ -130,21 +159,52 @@ func (s *Swarm) getChatCompletion(
 	return resp, nil
 }
 
-// handleToolCall processes a tool call from the chat completion
+// handleToolCall processes a tool call from the chat completion. Failures are
+// handled according to the agent's ToolErrorPolicy: they are either reported
+// to the model in the tool result or returned as a *ToolError.
 func (s *Swarm) handleToolCall(
 	ctx context.Context,
 	toolCall *llm.ToolCall,
 	agent Agent,
 	contextVariables map[string]interface{},
-	debug bool,
+	opts RunOptions,
 ) (Response, error) {
+	debug := opts.Debug
 	toolName := toolCall.Function.Name
 	argsJSON := toolCall.Function.Arguments
+	policy := s.toolErrorPolicyFor(agent)
+
+	// toolFailed reports err to the model, or fails the run, per the policy
+	toolFailed := func(err error, attempts int) (Response, error) {
+		toolErr := &ToolError{
+			ToolName:   toolName,
+			ToolCallID: toolCall.ID,
+			Attempts:   attempts,
+			Err:        err,
+		}
+		if debug {
+			log.Println(toolErr.Error())
+		}
+		if policy.Mode == ToolErrorFail {
+			return Response{}, toolErr
+		}
+		return Response{
+			Messages: []llm.Message{
+				{
+					Role:       llm.RoleTool,
+					Content:    toolErrorContent(toolErr),
+					Name:       toolName,
+					ToolCallID: toolCall.ID,
+				},
+			},
+			ToolErrors: []ToolError{*toolErr},
+		}, nil
+	}
 
 	// Parse the tool call arguments
 	var args map[string]interface{}
 	if err := json.Unmarshal([]byte(argsJSON), &args); err != nil {
-		return Response{}, err
+		return toolFailed(fmt.Errorf("invalid arguments: %w", err), 0)
 	}
 
 	if debug {
@@ -153,7 +213,7 @@ func (s *Swarm) handleToolCall(
 
 	// Find the corresponding function in the agent's functions
 	var functionFound AgentFunction
-	for _, af := range agent.GetFunctions() {
+	for _, af := range functionsFor(agent, opts) {
 		if af.GetName() == toolName {
 			functionFound = af
 			break
@@ -162,40 +222,102 @@ func (s *Swarm) handleToolCall(
 
 	// Handle case where function is not found
 	if functionFound == nil {
-		errorMessage := fmt.Sprintf("Error: Tool %s not found.", toolName)
+		return toolFailed(fmt.Errorf("tool %s not found", toolName), 0)
+	}
+
+	// Sensitive functions wait for approval; a rejection is reported to the model
+	approve := s.approval
+	if opts.Approval != nil {
+		approve = opts.Approval
+	}
+	// toolCall points into the assistant message in the history, which is
+	// updated when the approver edits the arguments
+	args, rejection, err := approveToolCall(ctx, approve, agent, functionFound, toolCall, args)
+	if err != nil {
+		return Response{}, err
+	}
+	if rejection != "" {
 		if debug {
-			log.Println(errorMessage)
+			log.Printf("Tool call %s rejected: %s\n", toolName, rejection)
 		}
 		return Response{
 			Messages: []llm.Message{
 				{
-					Role:    llm.RoleAssistant,
-					Content: errorMessage,
+					Role:       llm.RoleTool,
+					Content:    rejectionContent(toolName, rejection),
+					Name:       toolName,
+					ToolCallID: toolCall.ID,
 				},
 			},
 		}, nil
 	}
 
 	// Execute the function
-	result := functionFound.GetFunction()(args, contextVariables)
+	result, attempts := callFunction(ctx, s.toolHandler(opts.ToolMiddleware), ToolInvocation{
+		Agent:            agent,
+		Function:         functionFound,
+		ToolCall:         *toolCall,
+		Args:             args,
+		ContextVariables: contextVariables,
+		Turn:             opts.turn,
+	}, policy)
+	var subRuns []SubRun
+	if result.SubRun != nil {
+		subRuns = append(subRuns, *result.SubRun)
+	}
+	if result.Error != nil {
+		resp, err := toolFailed(result.Error, attempts)
+		resp.SubRuns = subRuns
+		return resp, err
+	}
 
-	// Create a message with the tool result
+	// Create a message with the tool result, tied to the originating call
 	toolResultMessage := llm.Message{
-		Role:    llm.RoleAssistant,
-		Content: fmt.Sprintf("%v", result.Data),
+		Role:       llm.RoleTool,
+		Content:    fmt.Sprintf("%v", result.Data),
+		Name:       toolName,
+		ToolCallID: toolCall.ID,
 	}
 
-	// Return the partial response with the tool result and any agent transfer
+	// Return the partial response with the tool result, any agent transfer and
+	// the context variable updates for the caller to merge
 	partialResponse := Response{
 		Messages:         []llm.Message{toolResultMessage},
 		Agent:            result.Agent, // Use the agent from the result if provided
-		ContextVariables: contextVariables,
+		ContextVariables: result.ContextVariables,
+		Terminated:       result.Terminal,
+		SubRuns:          subRuns,
+		inputFilter:      result.InputFilter,
+		handoffMode:      result.HandoffMode,
 	}
 
 	return partialResponse, nil
 }
 
-// Run executes the chat interaction loop with the agent
+// hasTool reports whether tools include the function name
+func hasTool(tools []llm.Tool, name string) bool {
+	for _, tool := range tools {
+		if tool.Function != nil && tool.Function.Name == name {
+			return true
+		}
+	}
+	return false
+}
+
+// requestModel returns the model requested for agent, honoring the override
+func requestModel(agent Agent, opts RunOptions) string {
+	if opts.ModelOverride != "" {
+		return opts.ModelOverride
+	}
+	return agent.GetModel().Model
+}
+
+// Run executes the chat interaction loop with the agent. It alternates between
+// chat completions and tool execution until the model answers without tool
+// calls, a tool returns a terminal Result, or maxTurns completions have been
+// made. A maxTurns of zero or less falls back to DefaultMaxTurns. Generation
+// settings passed here override those of the active agent for this call.
+// RunWithOptions accepts the same settings as options.
 func (s *Swarm) Run(
 	ctx context.Context,
 	agent Agent,
@@ -206,16 +328,59 @@ func (s *Swarm) Run(
 	debug bool,
 	maxTurns int,
 	executeTools bool,
+	generation ...GenerationSettings,
 ) (Response, error) {
+	opts := RunOptions{
+		ContextVariables: contextVariables,
+		ModelOverride:    modelOverride,
+		Stream:           stream,
+		Debug:            debug,
+		MaxTurns:         maxTurns,
+		ExecuteTools:     executeTools,
+	}
+	for _, g := range generation {
+		opts.Generation = opts.Generation.Merge(g)
+	}
+	return s.run(ctx, agent, messages, opts)
+}
+
+// run implements Run and RunWithOptions
+func (s *Swarm) run(ctx context.Context, agent Agent, messages []llm.Message, opts RunOptions) (_ Response, err error) {
+	contextVariables := opts.ContextVariables
+	maxTurns := opts.MaxTurns
 	activeAgent := agent
 	history := make([]llm.Message, len(messages))
 	copy(history, messages)
 	if contextVariables == nil {
 		contextVariables = make(map[string]interface{})
 	}
+	if maxTurns <= 0 {
+		maxTurns = DefaultMaxTurns
+	}
 
 	initLen := len(messages)
-	turns := 0
+	terminated := false
+	var toolErrors []ToolError
+	var subRuns []SubRun
+	var usage UsageReport
+
+	// The budget's duration limit also stops a hung completion or tool
+	if opts.Budget != nil {
+		if deadline, ok := opts.Budget.deadline(); ok {
+			parent := ctx
+			var cancel context.CancelFunc
+			ctx, cancel = context.WithDeadline(ctx, deadline)
+			defer cancel()
+			defer func() {
+				if errors.Is(err, context.DeadlineExceeded) && parent.Err() == nil {
+					err = opts.Budget.durationExceeded()
+				}
+			}()
+		}
+	}
+
+	// Agent tools run nested runs with this Swarm and these options
+	ctx = withRunScope(ctx, s, opts)
 
 	// Store initial user message as memory if it exists
 	if len(messages) > 0 && messages[len(messages)-1].Role == llm.RoleUser {
@@ -225,78 +390,243 @@ func (s *Swarm) Run(
 		})
 	}
 
-	// Get chat completion from LLM
-	resp, err := s.getChatCompletion(ctx, activeAgent, history, contextVariables, modelOverride, stream, debug)
-	if err != nil {
-		fmt.Println("111111@@")
-		return Response{}, err
+	// Agents waiting for a HandoffCall to return, and what they saw when
+	// they made their calls
+	stack := append([]Agent{}, opts.CallStack...)
+	callerViews := make([][]llm.Message, len(stack))
+	copy(callerViews, opts.CallerViews)
+
+	// After a filtered handoff the model sees view instead of history; both
+	// receive every later message
+	var view []llm.Message
+
+	// partial returns what happened so far, for runs that end with an error
+	partial := func() Response {
+		return Response{
+			Messages:         history[initLen:],
+			Agent:            activeAgent,
+			ContextVariables: contextVariables,
+			ToolErrors:       toolErrors,
+			Usage:            usage,
+			CallStack:        stack,
+			CallerViews:      callerViews,
+			SubRuns:          subRuns,
+			View:             view,
+		}
 	}
 
-	// Process the response
-	if len(resp.Choices) == 0 {
-		return Response{}, fmt.Errorf("no choices in response")
+	// record adds messages to history and, after a filtered handoff, to view
+	record := func(msgs ...llm.Message) {
+		history = append(history, msgs...)
+		if view != nil {
+			view = append(view, msgs...)
+		}
 	}
+	visible := func() []llm.Message {
+		if view != nil {
+			return view
+		}
+		return history
+	}
+
+	// Agents whose input guardrails have passed in this run
+	checkedInput := make(map[Agent]bool)
 
-	choice := resp.Choices[0]
+	// The last assistant message, where it sits in history and view, and
+	// the agent that wrote it, for the output guardrails
+	lastAnswer, viewAnswer := -1, -1
+	var answeredBy Agent
 
-	// Check for tool calls
-	if len(choice.Message.ToolCalls) > 0 && executeTools {
-		var toolResponses []Response
-		// Add the assistant's message with tool calls
-		history = append(history, choice.Message)
+	// checkOutput runs the output guardrails on the last answer. A blocked
+	// answer, and the results of its tool calls, are left out of the response.
+	checkOutput := func() error {
+		if answeredBy == nil {
+			return nil
+		}
+		if err := checkOutputGuardrails(ctx, answeredBy, history[lastAnswer]); err != nil {
+			history = history[:lastAnswer]
+			if view != nil && viewAnswer >= 0 {
+				view = view[:viewAnswer]
+			}
+			answeredBy = nil
+			return err
+		}
+		return nil
+	}
 
-		for _, toolCall := range choice.Message.ToolCalls {
-			toolResp, err := s.handleToolCall(ctx, &toolCall, activeAgent, contextVariables, debug)
+	// fail returns what happened so far with err. The answer it returns must
+	// pass the output guardrails too; when it does not, the guardrail's error
+	// is returned instead.
+	fail := func(err error) (Response, error) {
+		if outputErr := checkOutput(); outputErr != nil {
+			return partial(), outputErr
+		}
+		return partial(), err
+	}
 
-			if err != nil {
-				return Response{}, err
+	for turns := 0; turns < maxTurns && !terminated; turns++ {
+		if opts.Budget != nil {
+			if err := opts.Budget.Check(); err != nil {
+				return fail(err)
 			}
-			toolResponses = append(toolResponses, toolResp)
-			// Add the tool response as a function message
-			history = append(history, llm.Message{
-				Role:    llm.RoleFunction,
-				Content: toolResp.Messages[0].Content,
-				Name:    toolCall.Function.Name,
-			})
-			// Update the active agent if the tool result includes an agent transfer
-			if toolResp.Agent != nil {
-				activeAgent = toolResp.Agent
+			// A cost limit cannot hold for a model it has no price for
+			if err := opts.Budget.checkModel(requestModel(activeAgent, opts)); err != nil {
+				return fail(err)
 			}
 		}
-		turns++
 
-		// Get a follow-up response from the AI after tool execution
-		followUpResp, err := s.getChatCompletion(ctx, activeAgent, history, contextVariables, modelOverride, stream, debug)
+		// Input guardrails run before an agent's first completion, so a
+		// handoff cannot bypass them
+		if !checkedInput[activeAgent] {
+			if err := checkInputGuardrails(ctx, activeAgent, visible()); err != nil {
+				return fail(err)
+			}
+			checkedInput[activeAgent] = true
+		}
+
+		// A called agent can return to its caller
+		opts.returnFunction = nil
+		if len(stack) > 0 {
+			opts.returnFunction = newReturnToCallerFunction(stack[len(stack)-1])
+		}
+
+		// Get chat completion from LLM
+		resp, err := s.getChatCompletion(ctx, activeAgent, visible(), contextVariables, opts)
 		if err != nil {
-			return Response{}, err
+			return fail(err)
+		}
+		model := requestModel(activeAgent, opts)
+		if resp.Metadata.Model != "" {
+			// A routing client such as llm.FallbackLLM may have used another model
+			model = resp.Metadata.Model
+		}
+		usage.Record(activeAgent.GetName(), model, resp.Usage)
+
+		// Process the response
+		if len(resp.Choices) == 0 {
+			return fail(fmt.Errorf("no choices in response"))
 		}
 
-		followUpChoice := followUpResp.Choices[0]
-		// Don't process tool calls in the follow-up response to avoid loops
-		if len(followUpChoice.Message.ToolCalls) > 0 {
-			// Create a new message without the tool calls
-			followUpChoice.Message.ToolCalls = nil
+		message := resp.Choices[0].Message
+		turnStart := len(history)
+		record(message)
+		lastAnswer, viewAnswer, answeredBy = len(history)-1, len(view)-1, activeAgent
+
+		// A crossed budget ends the run before any requested tool is executed
+		if opts.Budget != nil {
+			if err := opts.Budget.recordCompletion(activeAgent.GetName(), model, resp.Usage); err != nil {
+				return fail(err)
+			}
 		}
-		if followUpChoice.Message.Content != "" {
-			history = append(history, followUpChoice.Message)
+
+		// The model answered without requesting tools, so the run is complete
+		if len(message.ToolCalls) == 0 {
+			break
+		}
+		if !opts.ExecuteTools {
+			break
 		}
 
-		// Return response with all messages including the follow-up
-		return Response{
-			Messages:         history[initLen:],
-			Agent:            activeAgent,
-			ContextVariables: contextVariables,
-		}, nil
-	} else {
-		// Add the assistant's message to history
-		history = append(history, choice.Message)
+		if opts.Budget != nil {
+			if err := opts.Budget.reserveToolCalls(len(message.ToolCalls)); err != nil {
+				return fail(err)
+			}
+		}
 
-		// Return final response only if there are no tool calls
-		finalResponse := Response{
-			Messages:         history[initLen:],
-			Agent:            activeAgent,
-			ContextVariables: contextVariables,
+		// Tools are resolved against the agent that requested them. When
+		// several calls hand off, the first one in call order wins.
+		var handoff Agent
+		var inputFilter HandoffInputFilter
+		var handoffMode HandoffMode
+		opts.turn = turns
+		for _, outcome := range s.handleToolCalls(ctx, message.ToolCalls, activeAgent, contextVariables, opts) {
+			if outcome.err != nil {
+				// Return what happened so far alongside the failure
+				var toolErr *ToolError
+				if errors.As(outcome.err, &toolErr) {
+					toolErrors = append(toolErrors, *toolErr)
+				}
+				return fail(outcome.err)
+			}
+			toolErrors = append(toolErrors, outcome.resp.ToolErrors...)
+			for _, subRun := range outcome.resp.SubRuns {
+				subRuns = append(subRuns, subRun)
+				usage.Merge(subRun.Response.Usage)
+			}
+
+			// Add the tool result messages to the history
+			record(outcome.resp.Messages...)
+
+			if handoff == nil && outcome.resp.Agent != nil {
+				handoff = outcome.resp.Agent
+				inputFilter = outcome.resp.inputFilter
+				handoffMode = outcome.resp.handoffMode
+			}
+
+			// Finish the remaining tool calls of this turn, then end the run
+			if outcome.resp.Terminated {
+				terminated = true
+			}
+		}
+
+		// Update the active agent if a tool result includes an agent transfer
+		if handoff != nil {
+			switch handoffMode {
+			case HandoffCall:
+				// A filtered call keeps what the caller saw for its return
+				var seen []llm.Message
+				if inputFilter != nil {
+					seen = visible()
+					seen = seen[:len(seen):len(seen)]
+				}
+				stack = append(stack, activeAgent)
+				callerViews = append(callerViews, seen)
+			case handoffReturn:
+				if len(stack) > 0 {
+					// The caller of a filtered call continues on what it saw,
+					// followed by this turn with the result
+					if caller := callerViews[len(callerViews)-1]; caller != nil {
+						view = append(caller[:len(caller):len(caller)], history[turnStart:]...)
+						viewAnswer = len(caller)
+					}
+					stack, callerViews = stack[:len(stack)-1], callerViews[:len(callerViews)-1]
+				}
+			}
+			activeAgent = handoff
+			if inputFilter != nil {
+				filtered, err := inputFilter(ctx, visible())
+				if err != nil {
+					return fail(fmt.Errorf("handoff input filter failed: %w", err))
+				}
+				view = append(make([]llm.Message, 0, len(filtered)), filtered...)
+				viewAnswer = -1 // The filter may have dropped the answer
+			}
+		}
+		// An agent taking over starts with its own forced tool choice; a
+		// forced choice of the run only applies until it is used
+		opts.toolChoiceUsed = handoff == nil
+		if opts.Generation.ToolChoice.Forces() {
+			opts.Generation.ToolChoice = nil
 		}
-		return finalResponse, nil
 	}
+
+	// Output guardrails check the last answer the run returns, however the
+	// run ended: with a final answer, a terminal tool, ExecuteTools off or
+	// out of turns
+	if err := checkOutput(); err != nil {
+		return partial(), err
+	}
+
+	return Response{
+		Messages:         history[initLen:],
+		Agent:            activeAgent,
+		ContextVariables: contextVariables,
+		Terminated:       terminated,
+		ToolErrors:       toolErrors,
+		Usage:            usage,
+		CallStack:        stack,
+		CallerViews:      callerViews,
+		SubRuns:          subRuns,
+		View:             view,
+	}, nil
 }
@@ -0,0 +1,1716 @@
+package swarmgo
+
+import (
+	"bufio"
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/wlevene/swarmgo/llm"
+	_ "modernc.org/sqlite"
+)
+
+// mockLLM replays a scripted list of responses and records every request.
+type mockLLM struct {
+	mu        sync.Mutex
+	responses []llm.ChatCompletionResponse
+	requests  []llm.ChatCompletionRequest
+}
+
+func (m *mockLLM) CreateChatCompletion(ctx context.Context, req llm.ChatCompletionRequest) (llm.ChatCompletionResponse, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.requests = append(m.requests, req)
+	if len(m.responses) == 0 {
+		return llm.ChatCompletionResponse{}, fmt.Errorf("mock: no scripted response left")
+	}
+	resp := m.responses[0]
+	m.responses = m.responses[1:]
+	return resp, nil
+}
+
+// CreateChatCompletionStream streams the next scripted response as a single chunk
+func (m *mockLLM) CreateChatCompletionStream(ctx context.Context, req llm.ChatCompletionRequest) (llm.ChatCompletionStream, error) {
+	resp, err := m.CreateChatCompletion(ctx, req)
+	if err != nil {
+		return nil, err
+	}
+	return &mockStream{chunks: []llm.ChatCompletionResponse{resp}}, nil
+}
+
+type mockStream struct {
+	chunks []llm.ChatCompletionResponse
+}
+
+func (m *mockStream) Recv() (llm.ChatCompletionResponse, error) {
+	if len(m.chunks) == 0 {
+		return llm.ChatCompletionResponse{}, io.EOF
+	}
+	chunk := m.chunks[0]
+	m.chunks = m.chunks[1:]
+	return chunk, nil
+}
+
+func (m *mockStream) Close() error { return nil }
+
+func toolCallResponse(calls ...llm.ToolCall) llm.ChatCompletionResponse {
+	return llm.ChatCompletionResponse{
+		Choices: []llm.Choice{{
+			Message: llm.Message{Role: llm.RoleAssistant, ToolCalls: calls},
+		}},
+	}
+}
+
+func textResponse(content string) llm.ChatCompletionResponse {
+	return llm.ChatCompletionResponse{
+		Choices: []llm.Choice{{
+			Message: llm.Message{Role: llm.RoleAssistant, Content: content},
+		}},
+	}
+}
+
+func newToolCall(id, name, args string) llm.ToolCall {
+	return llm.ToolCall{
+		ID:       id,
+		Type:     "function",
+		Function: llm.ToolCallFunction{Name: name, Arguments: args},
+	}
+}
+
+// newTestFunction builds an AgentFunction around fn without going through
+// NewCustomFunction's reflection.
+func newTestFunction(name string, fn Function) *BaseFunction {
+	return &BaseFunction{
+		name: name,
+		parameters: map[string]interface{}{
+			"type":       "object",
+			"properties": map[string]interface{}{},
+		},
+		fn: fn,
+	}
+}
+
+func newTestAgent(name string, fns ...AgentFunction) *BaseAgent {
+	return &BaseAgent{
+		name:      name,
+		model:     LLM{Model: "test-model"},
+		Functions: fns,
+		memory:    NewMemoryStore(10),
+	}
+}
+
+func TestRunChainsToolCalls(t *testing.T) {
+	calls := 0
+	counter := newTestFunction("count", func(args map[string]interface{}, contextVariables map[string]interface{}) Result {
+		calls++
+		return Result{Data: calls}
+	})
+
+	client := &mockLLM{responses: []llm.ChatCompletionResponse{
+		toolCallResponse(newToolCall("call_1", "count", "{}")),
+		toolCallResponse(newToolCall("call_2", "count", "{}")),
+		toolCallResponse(newToolCall("call_3", "count", "{}")),
+		textResponse("counted to 3"),
+	}}
+	s := &Swarm{client: client}
+
+	resp, err := s.Run(context.Background(), newTestAgent("counter", counter),
+		[]llm.Message{{Role: llm.RoleUser, Content: "count"}}, nil, "", false, false, 10, true)
+	if err != nil {
+		t.Fatalf("Run returned error: %v", err)
+	}
+
+	if calls != 3 {
+		t.Errorf("expected 3 tool invocations, got %d", calls)
+	}
+	if len(client.requests) != 4 {
+		t.Errorf("expected 4 completion requests, got %d", len(client.requests))
+	}
+	// 3 x (assistant tool call + tool result) + final answer
+	if len(resp.Messages) != 7 {
+		t.Fatalf("expected 7 messages, got %d", len(resp.Messages))
+	}
+	if last := resp.Messages[len(resp.Messages)-1]; last.Content != "counted to 3" {
+		t.Errorf("unexpected final message %q", last.Content)
+	}
+	if result := resp.Messages[1]; result.Role != llm.RoleTool || result.ToolCallID != "call_1" {
+		t.Errorf("expected tool result for call_1, got role %q id %q", result.Role, result.ToolCallID)
+	}
+}
+
+func TestRunStopsAtMaxTurns(t *testing.T) {
+	noop := newTestFunction("noop", func(args map[string]interface{}, contextVariables map[string]interface{}) Result {
+		return Result{Data: "ok"}
+	})
+
+	client := &mockLLM{}
+	for i := 0; i < 5; i++ {
+		client.responses = append(client.responses, toolCallResponse(newToolCall(fmt.Sprintf("call_%d", i), "noop", "{}")))
+	}
+	s := &Swarm{client: client}
+
+	_, err := s.Run(context.Background(), newTestAgent("looper", noop),
+		[]llm.Message{{Role: llm.RoleUser, Content: "loop"}}, nil, "", false, false, 2, true)
+	if err != nil {
+		t.Fatalf("Run returned error: %v", err)
+	}
+	if len(client.requests) != 2 {
+		t.Errorf("expected 2 completion requests, got %d", len(client.requests))
+	}
+}
+
+func TestRunTerminalResultEndsRunAndMergesContext(t *testing.T) {
+	submit := newTestFunction("submit_order", func(args map[string]interface{}, contextVariables map[string]interface{}) Result {
+		return Result{
+			Data:             "order submitted",
+			ContextVariables: map[string]interface{}{"order_id": "A-1", "status": "submitted"},
+			Terminal:         true,
+		}
+	})
+
+	client := &mockLLM{responses: []llm.ChatCompletionResponse{
+		toolCallResponse(newToolCall("call_1", "submit_order", "{}")),
+		textResponse("should not be requested"),
+	}}
+	s := &Swarm{client: client}
+
+	resp, err := s.Run(context.Background(), newTestAgent("shop", submit),
+		[]llm.Message{{Role: llm.RoleUser, Content: "buy"}},
+		map[string]interface{}{"status": "draft", "user": "ann"}, "", false, false, 10, true)
+	if err != nil {
+		t.Fatalf("Run returned error: %v", err)
+	}
+
+	if !resp.Terminated {
+		t.Error("expected response to be marked terminated")
+	}
+	if len(client.requests) != 1 {
+		t.Errorf("expected 1 completion request, got %d", len(client.requests))
+	}
+	want := map[string]interface{}{"order_id": "A-1", "status": "submitted", "user": "ann"}
+	for k, v := range want {
+		if resp.ContextVariables[k] != v {
+			t.Errorf("context variable %s = %v, want %v", k, resp.ContextVariables[k], v)
+		}
+	}
+}
+
+func TestRunAppliesGenerationSettings(t *testing.T) {
+	client := &mockLLM{responses: []llm.ChatCompletionResponse{textResponse("done")}}
+	s := &Swarm{client: client}
+
+	agent := newTestAgent("extractor")
+	agent.SetGenerationSettings(GenerationSettings{
+		Temperature: llm.Ptr(float32(0)),
+		MaxTokens:   256,
+		Stop:        []string{"END"},
+	})
+
+	_, err := s.Run(context.Background(), agent,
+		[]llm.Message{{Role: llm.RoleUser, Content: "extract"}}, nil, "other-model", false, false, 1, true,
+		GenerationSettings{MaxTokens: 512, Seed: llm.Ptr(7)})
+	if err != nil {
+		t.Fatalf("Run returned error: %v", err)
+	}
+
+	req := client.requests[0]
+	if req.Model != "other-model" {
+		t.Errorf("expected model override, got %q", req.Model)
+	}
+	if req.Temperature == nil || *req.Temperature != 0 {
+		t.Errorf("expected explicit temperature 0, got %v", req.Temperature)
+	}
+	if req.MaxTokens != 512 {
+		t.Errorf("expected per-call max tokens 512, got %d", req.MaxTokens)
+	}
+	if len(req.Stop) != 1 || req.Stop[0] != "END" {
+		t.Errorf("expected agent stop sequences, got %v", req.Stop)
+	}
+	if req.Seed == nil || *req.Seed != 7 {
+		t.Errorf("expected seed 7, got %v", req.Seed)
+	}
+}
+
+func TestRunToolErrorPolicies(t *testing.T) {
+	errBoom := errors.New("boom")
+	newFailing := func(calls *int) *BaseFunction {
+		return newTestFunction("flaky", func(args map[string]interface{}, contextVariables map[string]interface{}) Result {
+			*calls++
+			return Result{Error: errBoom}
+		})
+	}
+	script := func() *mockLLM {
+		return &mockLLM{responses: []llm.ChatCompletionResponse{
+			toolCallResponse(newToolCall("call_1", "flaky", "{}")),
+			textResponse("giving up"),
+		}}
+	}
+	messages := []llm.Message{{Role: llm.RoleUser, Content: "go"}}
+
+	t.Run("report", func(t *testing.T) {
+		calls := 0
+		s := &Swarm{client: script()}
+		resp, err := s.Run(context.Background(), newTestAgent("a", newFailing(&calls)), messages, nil, "", false, false, 5, true)
+		if err != nil {
+			t.Fatalf("Run returned error: %v", err)
+		}
+		if len(resp.ToolErrors) != 1 || resp.ToolErrors[0].ToolCallID != "call_1" {
+			t.Fatalf("expected one tool error for call_1, got %+v", resp.ToolErrors)
+		}
+		var payload map[string]interface{}
+		if err := json.Unmarshal([]byte(resp.Messages[1].Content), &payload); err != nil || payload["error"] != "boom" {
+			t.Errorf("expected structured error payload, got %q", resp.Messages[1].Content)
+		}
+	})
+
+	t.Run("fail", func(t *testing.T) {
+		calls := 0
+		s := &Swarm{client: script()}
+		s.SetToolErrorPolicy(ToolErrorPolicy{Mode: ToolErrorFail})
+		resp, err := s.Run(context.Background(), newTestAgent("a", newFailing(&calls)), messages, nil, "", false, false, 5, true)
+		var toolErr *ToolError
+		if !errors.As(err, &toolErr) || !errors.Is(err, errBoom) {
+			t.Fatalf("expected *ToolError wrapping boom, got %v", err)
+		}
+		if len(resp.Messages) != 1 || len(resp.ToolErrors) != 1 {
+			t.Errorf("expected partial response with the tool call, got %d messages and %d tool errors", len(resp.Messages), len(resp.ToolErrors))
+		}
+	})
+
+	t.Run("retry", func(t *testing.T) {
+		calls := 0
+		agent := newTestAgent("a", newFailing(&calls))
+		agent.SetToolErrorPolicy(&ToolErrorPolicy{Mode: ToolErrorRetry, MaxRetries: 2})
+		s := &Swarm{client: script()}
+		resp, err := s.Run(context.Background(), agent, messages, nil, "", false, false, 5, true)
+		if err != nil {
+			t.Fatalf("Run returned error: %v", err)
+		}
+		if calls != 3 {
+			t.Errorf("expected 3 invocations, got %d", calls)
+		}
+		if len(resp.ToolErrors) != 1 || resp.ToolErrors[0].Attempts != 3 {
+			t.Errorf("expected one tool error after 3 attempts, got %+v", resp.ToolErrors)
+		}
+	})
+}
+
+func TestRunRoutesHandoffToAgentProvider(t *testing.T) {
+	cheap := &mockLLM{responses: []llm.ChatCompletionResponse{
+		toolCallResponse(newToolCall("call_1", "TransferToexpert", "{}")),
+	}}
+	strong := &mockLLM{responses: []llm.ChatCompletionResponse{
+		textResponse("expert answer"),
+	}}
+
+	registry := NewProviderRegistry()
+	registry.Register("CHEAP", func(cfg llm.Config) (llm.LLM, error) { return cheap, nil })
+	registry.Register("STRONG", func(cfg llm.Config) (llm.LLM, error) { return strong, nil })
+
+	expert := newTestAgent("expert")
+	expert.SetModel(LLM{LLMProvider: "STRONG", Model: "big"})
+	triage := newTestAgent("triage", newTestFunction("TransferToexpert", func(args map[string]interface{}, contextVariables map[string]interface{}) Result {
+		return Result{Agent: expert, Data: "transferring"}
+	}))
+	triage.SetModel(LLM{LLMProvider: "CHEAP", Model: "small"})
+
+	s := &Swarm{registry: registry}
+	resp, err := s.Run(context.Background(), triage,
+		[]llm.Message{{Role: llm.RoleUser, Content: "hard question"}}, nil, "", false, false, 5, true)
+	if err != nil {
+		t.Fatalf("Run returned error: %v", err)
+	}
+
+	if len(cheap.requests) != 1 || cheap.requests[0].Model != "small" {
+		t.Errorf("expected one request to the cheap provider, got %+v", cheap.requests)
+	}
+	if len(strong.requests) != 1 || strong.requests[0].Model != "big" {
+		t.Errorf("expected one request to the strong provider, got %+v", strong.requests)
+	}
+	if resp.Agent != expert {
+		t.Errorf("expected expert to be the active agent")
+	}
+}
+
+func TestRunParallelToolCalls(t *testing.T) {
+	billing := newTestAgent("billing")
+	support := newTestAgent("support")
+
+	// Every call waits until all three are running, so the test only
+	// finishes if they execute concurrently.
+	var started sync.WaitGroup
+	started.Add(3)
+	fetch := newTestFunction("fetch", func(args map[string]interface{}, contextVariables map[string]interface{}) Result {
+		started.Done()
+		started.Wait()
+		url := args["url"].(string)
+		result := Result{Data: "body of " + url, ContextVariables: map[string]interface{}{"last": url}}
+		switch url {
+		case "b":
+			result.Agent = billing
+		case "c":
+			result.Agent = support
+		}
+		return result
+	})
+
+	client := &mockLLM{responses: []llm.ChatCompletionResponse{
+		toolCallResponse(
+			newToolCall("call_a", "fetch", `{"url":"a"}`),
+			newToolCall("call_b", "fetch", `{"url":"b"}`),
+			newToolCall("call_c", "fetch", `{"url":"c"}`),
+		),
+		textResponse("done"),
+	}}
+	s := &Swarm{client: client}
+
+	agent := newTestAgent("fetcher", fetch)
+	agent.ParallelToolCalls = true
+
+	resp, err := s.Run(context.Background(), agent,
+		[]llm.Message{{Role: llm.RoleUser, Content: "fetch"}}, nil, "", false, false, 2, true)
+	if err != nil {
+		t.Fatalf("Run returned error: %v", err)
+	}
+
+	for i, id := range []string{"call_a", "call_b", "call_c"} {
+		if msg := resp.Messages[i+1]; msg.ToolCallID != id {
+			t.Errorf("result %d answers %q, want %q", i, msg.ToolCallID, id)
+		}
+	}
+	if resp.Agent != billing {
+		t.Errorf("expected the first handoff in call order to win, got %v", resp.Agent.GetName())
+	}
+	if resp.ContextVariables["last"] != "c" {
+		t.Errorf("expected context updates merged in call order, got %v", resp.ContextVariables["last"])
+	}
+}
+
+func TestRunWithOptionsAppliesMiddleware(t *testing.T) {
+	var seenArgs []interface{}
+	lookup := newTestFunction("lookup", func(args map[string]interface{}, contextVariables map[string]interface{}) Result {
+		seenArgs = append(seenArgs, args["ssn"])
+		return Result{Data: "found"}
+	})
+	deleteAll := newTestFunction("delete_all", func(args map[string]interface{}, contextVariables map[string]interface{}) Result {
+		t.Error("blocked tool was invoked")
+		return Result{}
+	})
+
+	client := &mockLLM{responses: []llm.ChatCompletionResponse{
+		toolCallResponse(
+			newToolCall("call_1", "lookup", `{"ssn":"123-45-6789"}`),
+			newToolCall("call_2", "delete_all", `{}`),
+		),
+		textResponse("done"),
+	}}
+	s := &Swarm{client: client}
+
+	var order []string
+	s.UseLLMMiddleware(func(next LLMHandler) LLMHandler {
+		return func(ctx context.Context, agent Agent, req llm.ChatCompletionRequest) (llm.ChatCompletionResponse, error) {
+			order = append(order, "swarm")
+			return next(ctx, agent, req)
+		}
+	})
+
+	redact := func(next ToolHandler) ToolHandler {
+		return func(ctx context.Context, inv ToolInvocation) Result {
+			if _, ok := inv.Args["ssn"]; ok {
+				inv.Args["ssn"] = "[redacted]"
+			}
+			return next(ctx, inv)
+		}
+	}
+	block := func(next ToolHandler) ToolHandler {
+		return func(ctx context.Context, inv ToolInvocation) Result {
+			if inv.Function.GetName() == "delete_all" {
+				return Result{Error: errors.New("blocked by policy")}
+			}
+			return next(ctx, inv)
+		}
+	}
+
+	resp, err := s.RunWithOptions(context.Background(), newTestAgent("clerk", lookup, deleteAll),
+		[]llm.Message{{Role: llm.RoleUser, Content: "look up"}},
+		WithMaxTurns(3),
+		WithLLMMiddleware(func(next LLMHandler) LLMHandler {
+			return func(ctx context.Context, agent Agent, req llm.ChatCompletionRequest) (llm.ChatCompletionResponse, error) {
+				order = append(order, "run")
+				return next(ctx, agent, req)
+			}
+		}),
+		WithToolMiddleware(redact, block),
+	)
+	if err != nil {
+		t.Fatalf("RunWithOptions returned error: %v", err)
+	}
+
+	if want := []string{"swarm", "run", "swarm", "run"}; fmt.Sprint(order) != fmt.Sprint(want) {
+		t.Errorf("middleware order = %v, want %v", order, want)
+	}
+	if len(seenArgs) != 1 || seenArgs[0] != "[redacted]" {
+		t.Errorf("expected redacted arguments, got %v", seenArgs)
+	}
+	if len(resp.ToolErrors) != 1 || resp.ToolErrors[0].ToolName != "delete_all" {
+		t.Errorf("expected the blocked call to be reported, got %+v", resp.ToolErrors)
+	}
+}
+
+func TestRunAggregatesUsage(t *testing.T) {
+	expert := newTestAgent("expert")
+	expert.SetModel(LLM{Model: "big"})
+	triage := newTestAgent("triage", newTestFunction("transfer", func(args map[string]interface{}, contextVariables map[string]interface{}) Result {
+		return Result{Agent: expert}
+	}))
+
+	handoff := toolCallResponse(newToolCall("call_1", "transfer", "{}"))
+	handoff.Usage = llm.Usage{PromptTokens: 100, CompletionTokens: 10, TotalTokens: 110}
+	answer := textResponse("answer")
+	answer.Usage = llm.Usage{PromptTokens: 1000, CompletionTokens: 200}
+	client := &mockLLM{responses: []llm.ChatCompletionResponse{handoff, answer}}
+	s := &Swarm{client: client}
+
+	resp, err := s.Run(context.Background(), triage,
+		[]llm.Message{{Role: llm.RoleUser, Content: "question"}}, nil, "", false, false, 5, true)
+	if err != nil {
+		t.Fatalf("Run returned error: %v", err)
+	}
+
+	want := Usage{Requests: 2, PromptTokens: 1100, CompletionTokens: 210, TotalTokens: 1310}
+	if resp.Usage.Total != want {
+		t.Errorf("total usage = %+v, want %+v", resp.Usage.Total, want)
+	}
+	if got := resp.Usage.ByAgent["expert"].TotalTokens; got != 1200 {
+		t.Errorf("expert tokens = %d, want 1200", got)
+	}
+	if got := resp.Usage.ByModel["test-model"].TotalTokens; got != 110 {
+		t.Errorf("test-model tokens = %d, want 110", got)
+	}
+
+	estimate := resp.Usage.EstimateCost(PricingTable{
+		"big": {PromptPerMillion: 2, CompletionPerMillion: 10},
+	})
+	if estimate.Total != 0.004 {
+		t.Errorf("estimated cost = %v, want 0.004", estimate.Total)
+	}
+	if len(estimate.Unpriced) != 1 || estimate.Unpriced[0] != "test-model" {
+		t.Errorf("expected test-model to be unpriced, got %v", estimate.Unpriced)
+	}
+
+	// A failed completion keeps the usage and messages of earlier turns
+	client = &mockLLM{responses: []llm.ChatCompletionResponse{handoff}}
+	s = &Swarm{client: client}
+	resp, err = s.Run(context.Background(), triage,
+		[]llm.Message{{Role: llm.RoleUser, Content: "question"}}, nil, "", false, false, 5, true)
+	if err == nil || resp.Usage.Total.TotalTokens != 110 || len(resp.Messages) != 2 {
+		t.Errorf("expected the failed run to report earlier usage and messages, got %+v and %d messages (%v)", resp.Usage.Total, len(resp.Messages), err)
+	}
+}
+
+func TestRunBudget(t *testing.T) {
+	loopingClient := func() *mockLLM {
+		client := &mockLLM{}
+		for i := 0; i < 5; i++ {
+			resp := toolCallResponse(newToolCall(fmt.Sprintf("call_%d", i), "noop", "{}"))
+			resp.Usage = llm.Usage{PromptTokens: 40, CompletionTokens: 10, TotalTokens: 50}
+			client.responses = append(client.responses, resp)
+		}
+		return client
+	}
+
+	tests := []struct {
+		name      string
+		limits    BudgetLimits
+		limit     BudgetLimit
+		toolCalls int
+	}{
+		{"tool calls", BudgetLimits{MaxToolCalls: 2}, BudgetToolCalls, 2},
+		{"tokens", BudgetLimits{MaxTokens: 120}, BudgetTokens, 2},
+		{"cost", BudgetLimits{MaxCost: 0.1, Pricing: PricingTable{"test-model": {PromptPerMillion: 1000}}}, BudgetCost, 2},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			calls := 0
+			noop := newTestFunction("noop", func(args map[string]interface{}, contextVariables map[string]interface{}) Result {
+				calls++
+				return Result{Data: "ok"}
+			})
+			s := &Swarm{client: loopingClient()}
+
+			resp, err := s.RunWithOptions(context.Background(), newTestAgent("looper", noop),
+				[]llm.Message{{Role: llm.RoleUser, Content: "loop"}}, WithBudget(NewBudget(tt.limits)))
+
+			var budgetErr *BudgetExceededError
+			if !errors.Is(err, ErrBudgetExceeded) || !errors.As(err, &budgetErr) || budgetErr.Limit != tt.limit {
+				t.Fatalf("expected %s budget error, got %v", tt.limit, err)
+			}
+			if calls != tt.toolCalls {
+				t.Errorf("expected %d tool invocations, got %d", tt.toolCalls, calls)
+			}
+			if len(resp.Messages) != 2*tt.toolCalls+1 {
+				t.Errorf("expected partial response with %d messages, got %d", 2*tt.toolCalls+1, len(resp.Messages))
+			}
+		})
+	}
+
+	// A cost limit fails closed for models it cannot price
+	client := loopingClient()
+	s := &Swarm{client: client}
+	_, err := s.RunWithOptions(context.Background(), newTestAgent("looper"),
+		[]llm.Message{{Role: llm.RoleUser, Content: "loop"}}, WithBudget(NewBudget(BudgetLimits{MaxCost: 1, Pricing: PricingTable{"other-model": {}}})))
+	if !errors.Is(err, ErrUnpricedModel) || len(client.requests) != 0 {
+		t.Errorf("expected ErrUnpricedModel before any completion, got %v after %d requests", err, len(client.requests))
+	}
+
+	// The duration limit stops a completion that never returns
+	s = &Swarm{client: hangingLLM{}}
+	_, err = s.RunWithOptions(context.Background(), newTestAgent("looper"),
+		[]llm.Message{{Role: llm.RoleUser, Content: "loop"}}, WithBudget(NewBudget(BudgetLimits{MaxDuration: 20 * time.Millisecond})))
+	var budgetErr *BudgetExceededError
+	if !errors.As(err, &budgetErr) || budgetErr.Limit != BudgetDuration {
+		t.Errorf("expected duration budget error, got %v", err)
+	}
+}
+
+// hangingLLM blocks until the request's context is done
+type hangingLLM struct{}
+
+func (hangingLLM) CreateChatCompletion(ctx context.Context, req llm.ChatCompletionRequest) (llm.ChatCompletionResponse, error) {
+	<-ctx.Done()
+	return llm.ChatCompletionResponse{}, ctx.Err()
+}
+
+func (hangingLLM) CreateChatCompletionStream(ctx context.Context, req llm.ChatCompletionRequest) (llm.ChatCompletionStream, error) {
+	<-ctx.Done()
+	return nil, ctx.Err()
+}
+
+func TestRunFitsContextWindow(t *testing.T) {
+	filler := strings.Repeat("x", 400) // about 100 tokens
+	var history []llm.Message
+	for i := 0; i < 10; i++ {
+		history = append(history,
+			llm.Message{Role: llm.RoleUser, Content: fmt.Sprintf("question %d %s", i, filler)},
+			llm.Message{Role: llm.RoleAssistant, ToolCalls: []llm.ToolCall{newToolCall(fmt.Sprintf("call_%d", i), "search", "{}")}},
+			llm.Message{Role: llm.RoleTool, Content: filler, ToolCallID: fmt.Sprintf("call_%d", i)},
+			llm.Message{Role: llm.RoleAssistant, Content: "answer"},
+		)
+	}
+	history = append(history, llm.Message{Role: llm.RoleUser, Content: "latest question"})
+
+	tests := []struct {
+		name     string
+		strategy ContextStrategy
+		summary  *mockLLM
+		check    func(t *testing.T, messages []llm.Message)
+	}{
+		{
+			name: "sliding window",
+			check: func(t *testing.T, messages []llm.Message) {
+				if messages[1].Role != llm.RoleUser {
+					t.Errorf("expected the window to start at a user turn, got %q", messages[1].Role)
+				}
+				if len(messages) >= len(history)+1 {
+					t.Errorf("expected older turns to be dropped, got %d messages", len(messages))
+				}
+			},
+		},
+		{
+			name:     "drop tool outputs",
+			strategy: DropToolOutputs{},
+			check: func(t *testing.T, messages []llm.Message) {
+				if len(messages) != len(history)+1 {
+					t.Errorf("expected every message to be kept, got %d", len(messages))
+				}
+				if messages[3].Content != "[tool output removed]" {
+					t.Errorf("expected the oldest tool output to be dropped, got %q", messages[3].Content)
+				}
+			},
+		},
+		{
+			name:    "summarize older",
+			summary: &mockLLM{responses: []llm.ChatCompletionResponse{textResponse("they asked ten questions")}},
+			check: func(t *testing.T, messages []llm.Message) {
+				if !strings.Contains(messages[0].Content, "they asked ten questions") {
+					t.Errorf("expected the summary in the system prompt, got %q", messages[0].Content)
+				}
+				if messages[1].Role == llm.RoleTool {
+					t.Error("expected kept messages not to start with a tool result")
+				}
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			strategy := tt.strategy
+			if tt.summary != nil {
+				strategy = &SummarizeOlder{Client: tt.summary, Model: "cheap"}
+			}
+			client := &mockLLM{responses: []llm.ChatCompletionResponse{textResponse("done")}}
+			s := &Swarm{client: client}
+			s.SetContextWindow(&ContextWindow{
+				Limits:        map[string]int{"test-model": 2000},
+				ReserveTokens: 500,
+				Strategy:      strategy,
+			})
+
+			if _, err := s.Run(context.Background(), newTestAgent("agent"), history, nil, "", false, false, 1, true); err != nil {
+				t.Fatalf("Run returned error: %v", err)
+			}
+
+			messages := client.requests[0].Messages
+			if got := EstimateTokens(messages); got > 1500 {
+				t.Errorf("expected request to fit in 1500 tokens, estimated %d", got)
+			}
+			if last := messages[len(messages)-1]; last.Content != "latest question" {
+				t.Errorf("expected the latest question to be kept, got %q", last.Content)
+			}
+			tt.check(t, messages)
+		})
+	}
+
+	// Later requests reuse the summary instead of summarizing the same turns again
+	summarizer := &mockLLM{responses: []llm.ChatCompletionResponse{textResponse("they asked ten questions")}}
+	client := &mockLLM{responses: []llm.ChatCompletionResponse{
+		toolCallResponse(newToolCall("call_a", "search", "{}")),
+		toolCallResponse(newToolCall("call_b", "search", "{}")),
+		textResponse("done"),
+	}}
+	s := &Swarm{client: client}
+	s.SetContextWindow(&ContextWindow{
+		Limits:        map[string]int{"test-model": 2000},
+		ReserveTokens: 500,
+		Strategy:      &SummarizeOlder{Client: summarizer, Model: "cheap"},
+	})
+	search := newTestFunction("search", func(args map[string]interface{}, contextVariables map[string]interface{}) Result {
+		return Result{Data: "nothing new"}
+	})
+	if _, err := s.Run(context.Background(), newTestAgent("agent", search), history, nil, "", false, false, 5, true); err != nil {
+		t.Fatalf("Run returned error: %v", err)
+	}
+	if len(client.requests) != 3 || len(summarizer.requests) != 1 {
+		t.Errorf("expected one summary for %d requests, got %d", len(client.requests), len(summarizer.requests))
+	}
+	for _, req := range client.requests {
+		if !strings.Contains(req.Messages[0].Content, "they asked ten questions") {
+			t.Errorf("expected every request to carry the summary, got %q", req.Messages[0].Content)
+		}
+	}
+
+	// A sliding window cannot shrink a single turn that is too long
+	client = &mockLLM{responses: []llm.ChatCompletionResponse{textResponse("done")}}
+	s = &Swarm{client: client}
+	s.SetContextWindow(&ContextWindow{Limits: map[string]int{"test-model": 600}, ReserveTokens: 500})
+	_, err := s.Run(context.Background(), newTestAgent("agent"), []llm.Message{{Role: llm.RoleUser, Content: filler}}, nil, "", false, false, 1, true)
+	if !errors.Is(err, llm.ErrContextLength) || len(client.requests) != 0 {
+		t.Errorf("expected ErrContextLength without a request, got %v after %d requests", err, len(client.requests))
+	}
+}
+
+func TestRunRendersInstructions(t *testing.T) {
+	run := func(agent Agent, contextVariables map[string]interface{}) (*mockLLM, error) {
+		client := &mockLLM{responses: []llm.ChatCompletionResponse{textResponse("hi")}}
+		s := &Swarm{client: client}
+		_, err := s.Run(context.Background(), agent,
+			[]llm.Message{{Role: llm.RoleUser, Content: "hello"}}, contextVariables, "", false, false, 1, true)
+		return client, err
+	}
+
+	agent := newTestAgent("greeter")
+	agent.SetInstructions("Greet {{.user}} ({{.tier}}) in {{.language}}.")
+	agent.SetInstructionsVar("language", "English")
+	agent.SetValue("tier", "free")
+	client, err := run(agent, map[string]interface{}{"user": "Ann", "tier": "gold"})
+	if err != nil {
+		t.Fatalf("Run returned error: %v", err)
+	}
+	if got := client.requests[0].Messages[0].Content; got != "Greet Ann (gold) in English." {
+		t.Errorf("unexpected instructions %q", got)
+	}
+
+	agent.SetInstructionsFunc(func(contextVariables map[string]interface{}) (string, error) {
+		return fmt.Sprintf("Task state: %v", contextVariables["state"]), nil
+	})
+	client, err = run(agent, map[string]interface{}{"state": "shipping"})
+	if err != nil {
+		t.Fatalf("Run returned error: %v", err)
+	}
+	if got := client.requests[0].Messages[0].Content; got != "Task state: shipping" {
+		t.Errorf("unexpected instructions %q", got)
+	}
+
+	broken := newTestAgent("broken")
+	broken.SetInstructions("Hello {{.user")
+	if client, err = run(broken, nil); err == nil {
+		t.Error("expected a template error")
+	}
+	if len(client.requests) != 0 {
+		t.Error("expected no request with broken instructions")
+	}
+}
+
+type invoice struct {
+	Customer string  `json:"customer"`
+	Total    float64 `json:"total"`
+}
+
+func (i invoice) Validate() error {
+	if i.Total < 0 {
+		return errors.New("total must not be negative")
+	}
+	return nil
+}
+
+func TestRunTypedParsesAndRetries(t *testing.T) {
+	client := &mockLLM{responses: []llm.ChatCompletionResponse{
+		textResponse(`{"customer":"ACME"}`),
+		textResponse(`{"customer":"ACME","total":-1}`),
+		textResponse("```json\n{\"customer\":\"ACME\",\"total\":12.5}\n```"),
+	}}
+	s := &Swarm{client: client}
+
+	got, resp, err := RunTyped[invoice](context.Background(), s, newTestAgent("extractor"),
+		[]llm.Message{{Role: llm.RoleUser, Content: "extract the invoice"}})
+	if err != nil {
+		t.Fatalf("RunTyped returned error: %v", err)
+	}
+	if got != (invoice{Customer: "ACME", Total: 12.5}) {
+		t.Errorf("unexpected value %+v", got)
+	}
+	if len(client.requests) != 3 {
+		t.Fatalf("expected 3 requests, got %d", len(client.requests))
+	}
+
+	format := client.requests[0].ResponseFormat
+	if format == nil || format.Type != llm.ResponseFormatJSONSchema || format.Name != "invoice" {
+		t.Errorf("expected a JSON schema response format, got %+v", format)
+	}
+	retry := client.requests[1].Messages
+	if last := retry[len(retry)-1]; last.Role != llm.RoleUser || !strings.Contains(last.Content, `"total"`) {
+		t.Errorf("expected the retry to report the missing field, got %q", last.Content)
+	}
+	// 3 answers and 2 corrections
+	if len(resp.Messages) != 5 || resp.Usage.Total.Requests != 3 {
+		t.Errorf("expected the response to cover every attempt, got %d messages", len(resp.Messages))
+	}
+
+	client = &mockLLM{responses: []llm.ChatCompletionResponse{textResponse("not json")}}
+	s = &Swarm{client: client}
+	_, _, err = RunTyped[invoice](context.Background(), s, newTestAgent("extractor"),
+		[]llm.Message{{Role: llm.RoleUser, Content: "extract the invoice"}}, WithOutputRetries(0))
+	var outputErr *StructuredOutputError
+	if !errors.As(err, &outputErr) || outputErr.Attempts != 1 {
+		t.Errorf("expected a StructuredOutputError after one attempt, got %v", err)
+	}
+}
+
+func TestRunToolChoice(t *testing.T) {
+	lookup := newTestFunction("lookup", func(args map[string]interface{}, contextVariables map[string]interface{}) Result {
+		return Result{Data: "found"}
+	})
+	agent := newTestAgent("researcher", lookup)
+	agent.SetGenerationSettings(GenerationSettings{ToolChoice: llm.ForceTool("lookup")})
+
+	client := &mockLLM{responses: []llm.ChatCompletionResponse{
+		toolCallResponse(newToolCall("call_1", "lookup", "{}")),
+		textResponse("done"),
+	}}
+	s := &Swarm{client: client}
+	if _, err := s.Run(context.Background(), agent,
+		[]llm.Message{{Role: llm.RoleUser, Content: "look it up"}}, nil, "", false, false, 5, true); err != nil {
+		t.Fatalf("Run returned error: %v", err)
+	}
+	if choice := client.requests[0].ToolChoice; choice == nil || choice.Mode != llm.ToolChoiceFunction || choice.Function != "lookup" {
+		t.Errorf("expected the first request to force lookup, got %+v", choice)
+	}
+	if choice := client.requests[1].ToolChoice; choice != nil {
+		t.Errorf("expected the forced choice to be dropped after the tool call, got %+v", choice)
+	}
+
+	// An agent taking over gets its own forced choice on its first turn
+	triage := newTestAgent("triage", newTestFunction("TransferToresearcher", func(args map[string]interface{}, contextVariables map[string]interface{}) Result {
+		return Result{Agent: agent, Data: "transferring"}
+	}))
+	triage.SetGenerationSettings(GenerationSettings{ToolChoice: &llm.ToolChoice{Mode: llm.ToolChoiceRequired}})
+	client = &mockLLM{responses: []llm.ChatCompletionResponse{
+		toolCallResponse(newToolCall("call_1", "TransferToresearcher", "{}")),
+		toolCallResponse(newToolCall("call_2", "lookup", "{}")),
+		textResponse("done"),
+	}}
+	s = &Swarm{client: client}
+	if _, err := s.Run(context.Background(), triage,
+		[]llm.Message{{Role: llm.RoleUser, Content: "look it up"}}, nil, "", false, false, 5, true); err != nil {
+		t.Fatalf("Run returned error: %v", err)
+	}
+	if choice := client.requests[1].ToolChoice; choice == nil || choice.Function != "lookup" {
+		t.Errorf("expected the new agent's first request to force lookup, got %+v", choice)
+	}
+	if choice := client.requests[2].ToolChoice; choice != nil {
+		t.Errorf("expected the forced choice to be dropped after the tool call, got %+v", choice)
+	}
+
+	// A forced choice of the run does not follow the conversation to the next agent
+	refund := newTestFunction("refund", func(args map[string]interface{}, contextVariables map[string]interface{}) Result {
+		return Result{Data: "refunded"}
+	})
+	billing := newTestAgent("billing", refund)
+	support := newTestAgent("support", NewTransferFunction(billing))
+	client = &mockLLM{responses: []llm.ChatCompletionResponse{
+		toolCallResponse(newToolCall("call_1", "TransferTobilling", "{}")),
+		textResponse("billing here"),
+	}}
+	s = &Swarm{client: client}
+	if _, err := s.RunWithOptions(context.Background(), support,
+		[]llm.Message{{Role: llm.RoleUser, Content: "refund please"}},
+		WithToolChoice(llm.ForceTool("TransferTobilling"))); err != nil {
+		t.Fatalf("RunWithOptions returned error: %v", err)
+	}
+	if choice := client.requests[0].ToolChoice; choice == nil || choice.Function != "TransferTobilling" {
+		t.Errorf("expected the first request to force the transfer, got %+v", choice)
+	}
+	if choice := client.requests[1].ToolChoice; choice != nil {
+		t.Errorf("expected billing's request to use its own tool choice, got %+v", choice)
+	}
+
+	// A choice forcing a function the agent lacks is not sent
+	client = &mockLLM{responses: []llm.ChatCompletionResponse{textResponse("billing here")}}
+	s = &Swarm{client: client}
+	if _, err := s.RunWithOptions(context.Background(), billing,
+		[]llm.Message{{Role: llm.RoleUser, Content: "refund please"}},
+		WithToolChoice(llm.ForceTool("TransferTobilling"))); err != nil {
+		t.Fatalf("RunWithOptions returned error: %v", err)
+	}
+	if choice := client.requests[0].ToolChoice; choice != nil {
+		t.Errorf("expected the unknown forced function to be dropped, got %+v", choice)
+	}
+
+	client = &mockLLM{responses: []llm.ChatCompletionResponse{textResponse("summary")}}
+	s = &Swarm{client: client}
+	if _, err := s.RunWithOptions(context.Background(), agent,
+		[]llm.Message{{Role: llm.RoleUser, Content: "summarize"}},
+		WithToolChoice(&llm.ToolChoice{Mode: llm.ToolChoiceNone})); err != nil {
+		t.Fatalf("RunWithOptions returned error: %v", err)
+	}
+	if choice := client.requests[0].ToolChoice; choice == nil || choice.Mode != llm.ToolChoiceNone {
+		t.Errorf("expected the run to forbid tools, got %+v", choice)
+	}
+}
+
+func TestStreamingResponseToolChoice(t *testing.T) {
+	lookup := newTestFunction("lookup", func(args map[string]interface{}, contextVariables map[string]interface{}) Result {
+		return Result{Data: "found"}
+	})
+	agent := newTestAgent("researcher", lookup)
+	agent.SetGenerationSettings(GenerationSettings{ToolChoice: llm.ForceTool("lookup")})
+
+	client := &mockLLM{responses: []llm.ChatCompletionResponse{
+		toolCallResponse(newToolCall("call_1", "lookup", "{}")),
+		textResponse("done"),
+	}}
+	s := &Swarm{client: client}
+	if err := s.StreamingResponse(context.Background(), agent,
+		[]llm.Message{{Role: llm.RoleUser, Content: "look it up"}}, nil, "", nil, false); err != nil {
+		t.Fatalf("StreamingResponse returned error: %v", err)
+	}
+	if len(client.requests) != 2 || !client.requests[0].ToolChoice.Forces() {
+		t.Fatalf("expected a forced first stream and one follow-up, got %d requests", len(client.requests))
+	}
+	if choice := client.requests[1].ToolChoice; choice != nil {
+		t.Errorf("expected the forced choice to be dropped after the tool call, got %+v", choice)
+	}
+}
+
+func TestStreamingResponseMiddleware(t *testing.T) {
+	lookup := newTestFunction("lookup", func(args map[string]interface{}, contextVariables map[string]interface{}) Result {
+		return Result{Data: "found"}
+	})
+	client := &mockLLM{responses: []llm.ChatCompletionResponse{
+		toolCallResponse(newToolCall("call_1", "lookup", "{}")),
+		textResponse("done"),
+	}}
+	s := &Swarm{client: client}
+
+	var opened []string
+	s.UseLLMStreamMiddleware(func(next LLMStreamHandler) LLMStreamHandler {
+		return func(ctx context.Context, agent Agent, req llm.ChatCompletionRequest) (llm.ChatCompletionStream, error) {
+			opened = append(opened, agent.GetName())
+			req.User = "redacted"
+			return next(ctx, agent, req)
+		}
+	})
+
+	if err := s.StreamingResponse(context.Background(), newTestAgent("researcher", lookup),
+		[]llm.Message{{Role: llm.RoleUser, Content: "look it up"}}, nil, "", nil, false); err != nil {
+		t.Fatalf("StreamingResponse returned error: %v", err)
+	}
+	if len(opened) != 2 || client.requests[1].User != "redacted" {
+		t.Errorf("expected the initial and follow-up streams to pass through the middleware, got %v", opened)
+	}
+
+	// Streamed runs collect the chunks of every completion
+	toolCallChunk := func(id, name, args string) llm.ChatCompletionResponse {
+		return toolCallResponse(newToolCall(id, name, args))
+	}
+	usageChunk := llm.ChatCompletionResponse{Usage: llm.Usage{PromptTokens: 8, CompletionTokens: 2, TotalTokens: 10}}
+	streams := [][]llm.ChatCompletionResponse{
+		{toolCallChunk("call_1", "lookup", `{"q":`), toolCallChunk("", "", `"x"}`), usageChunk},
+		{textResponse("do"), textResponse("ne"), usageChunk},
+	}
+	s = &Swarm{client: &mockLLM{}}
+	s.UseLLMStreamMiddleware(func(next LLMStreamHandler) LLMStreamHandler {
+		return func(ctx context.Context, agent Agent, req llm.ChatCompletionRequest) (llm.ChatCompletionStream, error) {
+			if !req.Stream || len(streams) == 0 {
+				return nil, fmt.Errorf("unexpected stream request")
+			}
+			chunks := streams[0]
+			streams = streams[1:]
+			return &mockStream{chunks: chunks}, nil
+		}
+	})
+	resp, err := s.RunWithOptions(context.Background(), newTestAgent("researcher", lookup),
+		[]llm.Message{{Role: llm.RoleUser, Content: "look it up"}}, WithStream(true))
+	if err != nil {
+		t.Fatalf("RunWithOptions returned error: %v", err)
+	}
+	if len(resp.Messages) != 3 || resp.Messages[0].ToolCalls[0].Function.Arguments != `{"q":"x"}` || resp.Messages[2].Content != "done" {
+		t.Errorf("expected the streamed tool call and answer to be collected, got %+v", resp.Messages)
+	}
+	if resp.Usage.Total.TotalTokens != 20 {
+		t.Errorf("expected the streamed usage to be recorded, got %+v", resp.Usage.Total)
+	}
+}
+
+func TestRunGuardrails(t *testing.T) {
+	offTopic := NewInputGuardrail("billing_only", func(ctx context.Context, agent Agent, messages []llm.Message) (GuardrailVerdict, error) {
+		last := messages[len(messages)-1].Content
+		return GuardrailVerdict{Tripped: !strings.Contains(last, "invoice"), Reason: "not about billing"}, nil
+	})
+	noSecrets := NewOutputGuardrail("no_secrets", func(ctx context.Context, agent Agent, message llm.Message) (GuardrailVerdict, error) {
+		return GuardrailVerdict{Tripped: strings.Contains(message.Content, "sk-"), Reason: "leaks a key"}, nil
+	})
+	agent := newTestAgent("billing")
+	agent.AddInputGuardrail(offTopic)
+	agent.AddOutputGuardrail(noSecrets)
+
+	client := &mockLLM{responses: []llm.ChatCompletionResponse{textResponse("hi")}}
+	s := &Swarm{client: client}
+	resp, err := s.RunWithOptions(context.Background(), agent, []llm.Message{{Role: llm.RoleUser, Content: "tell me a joke"}})
+	var tripped *GuardrailTrippedError
+	if !errors.Is(err, ErrGuardrailTripped) || !errors.As(err, &tripped) {
+		t.Fatalf("expected a GuardrailTrippedError, got %v", err)
+	}
+	if tripped.Stage != GuardrailInput || tripped.Guardrail != "billing_only" || tripped.Verdict.Reason != "not about billing" {
+		t.Errorf("unexpected error details: %+v", tripped)
+	}
+	if len(client.requests) != 0 || resp.Agent != agent {
+		t.Errorf("expected no request before the input guardrail, got %d", len(client.requests))
+	}
+
+	client = &mockLLM{responses: []llm.ChatCompletionResponse{textResponse("your key is sk-123")}}
+	s = &Swarm{client: client}
+	resp, err = s.RunWithOptions(context.Background(), agent, []llm.Message{{Role: llm.RoleUser, Content: "about my invoice"}})
+	if !errors.As(err, &tripped) || tripped.Stage != GuardrailOutput {
+		t.Fatalf("expected the output guardrail to trip, got %v", err)
+	}
+	for _, msg := range resp.Messages {
+		if strings.Contains(msg.Content, "sk-") {
+			t.Errorf("expected the blocked answer to be left out, got %q", msg.Content)
+		}
+	}
+
+	client = &mockLLM{responses: []llm.ChatCompletionResponse{textResponse("paid")}}
+	s = &Swarm{client: client}
+	if _, err := s.RunWithOptions(context.Background(), agent, []llm.Message{{Role: llm.RoleUser, Content: "is my invoice paid?"}}); err != nil {
+		t.Errorf("expected guardrails to pass, got %v", err)
+	}
+
+	// Runs that end without a final answer are checked too
+	agent.AddFunction(newTestFunction("lookup", func(args map[string]interface{}, contextVariables map[string]interface{}) Result {
+		return Result{Data: "found"}
+	}))
+	for name, opts := range map[string][]RunOption{
+		"tools not executed": {WithExecuteTools(false)},
+		"out of turns":       {WithMaxTurns(1)},
+	} {
+		leaking := toolCallResponse(newToolCall("call_1", "lookup", "{}"))
+		leaking.Choices[0].Message.Content = "checking key sk-123"
+		s = &Swarm{client: &mockLLM{responses: []llm.ChatCompletionResponse{leaking}}}
+		resp, err = s.RunWithOptions(context.Background(), agent, []llm.Message{{Role: llm.RoleUser, Content: "about my invoice"}}, opts...)
+		if !errors.As(err, &tripped) || tripped.Stage != GuardrailOutput || len(resp.Messages) != 0 {
+			t.Errorf("%s: expected the output guardrail to trip and drop the answer, got %v with %d messages", name, err, len(resp.Messages))
+		}
+	}
+
+	// Runs that fail after an answer keep a blocked answer out as well
+	leaking := func(calls ...llm.ToolCall) llm.ChatCompletionResponse {
+		resp := toolCallResponse(calls...)
+		resp.Choices[0].Message.Content = "your key is sk-123"
+		resp.Usage = llm.Usage{TotalTokens: 50}
+		return resp
+	}
+	failingRuns := []struct {
+		name  string
+		setup func(agent *BaseAgent) (*Swarm, []RunOption)
+	}{
+		{"token budget", func(agent *BaseAgent) (*Swarm, []RunOption) {
+			return &Swarm{client: &mockLLM{responses: []llm.ChatCompletionResponse{leaking()}}},
+				[]RunOption{WithBudget(NewBudget(BudgetLimits{MaxTokens: 10}))}
+		}},
+		{"tool call budget", func(agent *BaseAgent) (*Swarm, []RunOption) {
+			agent.AddFunction(newTestFunction("lookup", func(args map[string]interface{}, contextVariables map[string]interface{}) Result {
+				return Result{Data: "found"}
+			}))
+			resp := leaking(newToolCall("call_1", "lookup", "{}"), newToolCall("call_2", "lookup", "{}"))
+			return &Swarm{client: &mockLLM{responses: []llm.ChatCompletionResponse{resp}}},
+				[]RunOption{WithBudget(NewBudget(BudgetLimits{MaxToolCalls: 1}))}
+		}},
+		{"budget spent by a tool", func(agent *BaseAgent) (*Swarm, []RunOption) {
+			budget := NewBudget(BudgetLimits{MaxTokens: 100})
+			agent.AddFunction(newTestFunction("research", func(args map[string]interface{}, contextVariables map[string]interface{}) Result {
+				budget.recordCompletion("researcher", "test-model", llm.Usage{TotalTokens: 100})
+				return Result{Data: "found"}
+			}))
+			resp := leaking(newToolCall("call_1", "research", "{}"))
+			return &Swarm{client: &mockLLM{responses: []llm.ChatCompletionResponse{resp}}}, []RunOption{WithBudget(budget)}
+		}},
+		{"unpriced model", func(agent *BaseAgent) (*Swarm, []RunOption) {
+			other := newTestAgent("other")
+			other.model = LLM{Model: "other-model"}
+			transfer := NewTransferFunction(other)
+			agent.AddFunction(transfer)
+			resp := leaking(newToolCall("call_1", transfer.GetName(), "{}"))
+			return &Swarm{client: &mockLLM{responses: []llm.ChatCompletionResponse{resp}}},
+				[]RunOption{WithBudget(NewBudget(BudgetLimits{MaxCost: 1, Pricing: PricingTable{"test-model": {}}}))}
+		}},
+		{"failing tool", func(agent *BaseAgent) (*Swarm, []RunOption) {
+			agent.AddFunction(newTestFunction("lookup", func(args map[string]interface{}, contextVariables map[string]interface{}) Result {
+				return Result{Error: errors.New("lookup failed")}
+			}))
+			s := &Swarm{client: &mockLLM{responses: []llm.ChatCompletionResponse{leaking(newToolCall("call_1", "lookup", "{}"))}}}
+			s.SetToolErrorPolicy(ToolErrorPolicy{Mode: ToolErrorFail})
+			return s, nil
+		}},
+		{"failing input filter", func(agent *BaseAgent) (*Swarm, []RunOption) {
+			transfer := NewTransferFunction(newTestAgent("other")).SetInputFilter(
+				func(ctx context.Context, messages []llm.Message) ([]llm.Message, error) {
+					return nil, errors.New("filter failed")
+				})
+			agent.AddFunction(transfer)
+			resp := leaking(newToolCall("call_1", transfer.GetName(), "{}"))
+			return &Swarm{client: &mockLLM{responses: []llm.ChatCompletionResponse{resp}}}, nil
+		}},
+		{"failing completion", func(agent *BaseAgent) (*Swarm, []RunOption) {
+			agent.AddFunction(newTestFunction("lookup", func(args map[string]interface{}, contextVariables map[string]interface{}) Result {
+				return Result{Data: "found"}
+			}))
+			return &Swarm{client: &mockLLM{responses: []llm.ChatCompletionResponse{leaking(newToolCall("call_1", "lookup", "{}"))}}}, nil
+		}},
+	}
+	for _, tt := range failingRuns {
+		agent := newTestAgent("billing")
+		agent.AddOutputGuardrail(noSecrets)
+		s, opts := tt.setup(agent)
+		resp, err := s.RunWithOptions(context.Background(), agent, []llm.Message{{Role: llm.RoleUser, Content: "about my invoice"}}, opts...)
+		if !errors.As(err, &tripped) || tripped.Stage != GuardrailOutput {
+			t.Errorf("%s: expected the output guardrail to trip, got %v", tt.name, err)
+		}
+		for _, msg := range resp.Messages {
+			if strings.Contains(msg.Content, "sk-") {
+				t.Errorf("%s: expected the blocked answer to be left out, got %q", tt.name, msg.Content)
+			}
+		}
+	}
+}
+
+func TestRunApprovesSensitiveTools(t *testing.T) {
+	var sent []string
+	sendEmail := newTestFunction("sendEmail", func(args map[string]interface{}, contextVariables map[string]interface{}) Result {
+		sent = append(sent, fmt.Sprint(args["to"]))
+		return Result{Data: "sent"}
+	})
+	sendEmail.SetRequiresApproval(true)
+	agent := newTestAgent("mailer", sendEmail)
+
+	run := func(opts ...RunOption) (*mockLLM, Response, error) {
+		client := &mockLLM{responses: []llm.ChatCompletionResponse{
+			toolCallResponse(newToolCall("call_1", "sendEmail", `{"to":"bob@example.com"}`)),
+			textResponse("done"),
+		}}
+		s := &Swarm{client: client}
+		resp, err := s.RunWithOptions(context.Background(), agent,
+			[]llm.Message{{Role: llm.RoleUser, Content: "email bob"}}, opts...)
+		return client, resp, err
+	}
+
+	var requests []ApprovalRequest
+	_, _, err := run(WithApproval(func(ctx context.Context, req ApprovalRequest) (ApprovalDecision, error) {
+		requests = append(requests, req)
+		return Approve(), nil
+	}))
+	if err != nil || len(sent) != 1 || len(requests) != 1 || requests[0].Args["to"] != "bob@example.com" {
+		t.Fatalf("expected an approved call, got err=%v sent=%v requests=%v", err, sent, requests)
+	}
+
+	sent = nil
+	client, _, err := run(WithApproval(func(ctx context.Context, req ApprovalRequest) (ApprovalDecision, error) {
+		return Reject("not before noon"), nil
+	}))
+	if err != nil || len(sent) != 0 {
+		t.Fatalf("expected the rejected call to be skipped, got err=%v sent=%v", err, sent)
+	}
+	if result := client.requests[1].Messages[len(client.requests[1].Messages)-1]; !strings.Contains(result.Content, "not before noon") {
+		t.Errorf("expected the rejection reason in the tool result, got %q", result.Content)
+	}
+
+	client, resp, err := run(WithApproval(func(ctx context.Context, req ApprovalRequest) (ApprovalDecision, error) {
+		return EditArgs(map[string]interface{}{"to": "alice@example.com"}), nil
+	}))
+	if err != nil || len(sent) != 1 || sent[0] != "alice@example.com" {
+		t.Errorf("expected the call to use the edited arguments, got err=%v sent=%v", err, sent)
+	}
+	want := `{"to":"alice@example.com"}`
+	if got := resp.Messages[0].ToolCalls[0].Function.Arguments; got != want {
+		t.Errorf("expected the history to show the edited arguments, got %s", got)
+	}
+	if got := client.requests[1].Messages[2].ToolCalls[0].Function.Arguments; got != want {
+		t.Errorf("expected the model to see the edited arguments, got %s", got)
+	}
+
+	sent = nil
+	if _, _, err = run(); err != nil || len(sent) != 0 {
+		t.Errorf("expected calls without an approver to be rejected, got err=%v sent=%v", err, sent)
+	}
+
+	var out strings.Builder
+	prompt := PromptApproval(bufio.NewReader(strings.NewReader("maybe\nedit\n{\"to\":\"carol@example.com\"}\n")), &out)
+	decision, err := prompt(context.Background(), ApprovalRequest{ToolName: "sendEmail"})
+	if err != nil || decision.Action != ApprovalEdit || decision.Args["to"] != "carol@example.com" {
+		t.Errorf("expected the prompt to return edited arguments, got %+v, %v", decision, err)
+	}
+}
+
+func TestRunContextFunctionsAndTimeouts(t *testing.T) {
+	var seen ToolCallInfo
+	lookup := newTestFunction("lookup", nil)
+	lookup.SetContextFunction(func(ctx context.Context, call ToolCallInfo, args map[string]interface{}, contextVariables map[string]interface{}) Result {
+		seen = call
+		return Result{Data: "found"}
+	})
+	slow := newTestFunction("slow", nil)
+	slow.SetTimeout(10 * time.Millisecond)
+	slow.SetContextFunction(func(ctx context.Context, call ToolCallInfo, args map[string]interface{}, contextVariables map[string]interface{}) Result {
+		<-ctx.Done()
+		return Result{Error: ctx.Err()}
+	})
+	hung := newTestFunction("hung", func(args map[string]interface{}, contextVariables map[string]interface{}) Result {
+		time.Sleep(time.Second)
+		return Result{Data: "too late"}
+	})
+	hung.SetTimeout(10 * time.Millisecond)
+	agent := newTestAgent("researcher", lookup, slow, hung)
+
+	client := &mockLLM{responses: []llm.ChatCompletionResponse{
+		toolCallResponse(newToolCall("call_1", "lookup", "{}")),
+		toolCallResponse(newToolCall("call_2", "slow", "{}"), newToolCall("call_3", "hung", "{}")),
+		textResponse("done"),
+	}}
+	s := &Swarm{client: client}
+	resp, err := s.RunWithOptions(context.Background(), agent, []llm.Message{{Role: llm.RoleUser, Content: "look it up"}})
+	if err != nil {
+		t.Fatalf("RunWithOptions returned error: %v", err)
+	}
+	if seen != (ToolCallInfo{Agent: "researcher", ToolName: "lookup", ToolCallID: "call_1", Turn: 0}) {
+		t.Errorf("unexpected tool call info: %+v", seen)
+	}
+	if len(resp.ToolErrors) != 2 {
+		t.Fatalf("expected both slow calls to time out, got %+v", resp.ToolErrors)
+	}
+	for _, toolErr := range resp.ToolErrors {
+		if !errors.Is(toolErr.Err, ErrToolTimeout) {
+			t.Errorf("expected a timeout for %s, got %v", toolErr.ToolName, toolErr.Err)
+		}
+	}
+
+	// A timed function that finishes in time keeps its in-place writes
+	tier := newTestFunction("tier", func(args map[string]interface{}, contextVariables map[string]interface{}) Result {
+		contextVariables["tier"] = "gold"
+		delete(contextVariables, "trial")
+		return Result{Data: "updated"}
+	})
+	tier.SetTimeout(time.Second)
+	client = &mockLLM{responses: []llm.ChatCompletionResponse{
+		toolCallResponse(newToolCall("call_1", "tier", "{}")),
+		textResponse("done"),
+	}}
+	s = &Swarm{client: client}
+	resp, err = s.RunWithOptions(context.Background(), newTestAgent("researcher", tier), []llm.Message{{Role: llm.RoleUser, Content: "upgrade"}},
+		WithContextVariables(map[string]interface{}{"trial": true}))
+	if err != nil {
+		t.Fatalf("RunWithOptions returned error: %v", err)
+	}
+	if _, trial := resp.ContextVariables["trial"]; resp.ContextVariables["tier"] != "gold" || trial {
+		t.Errorf("expected the timed function's writes to be kept, got %v", resp.ContextVariables)
+	}
+
+	// Retries stop once the run's context is done
+	ctx, cancel := context.WithCancel(context.Background())
+	calls := 0
+	_, attempts := callFunction(ctx, func(ctx context.Context, inv ToolInvocation) Result {
+		calls++
+		cancel()
+		return Result{Error: ctx.Err()}
+	}, ToolInvocation{}, ToolErrorPolicy{Mode: ToolErrorRetry, MaxRetries: 3})
+	if calls != 1 || attempts != 1 {
+		t.Errorf("expected no retry after cancellation, got %d calls", calls)
+	}
+
+	// Functions that only implement the original AgentFunction methods still run
+	client = &mockLLM{responses: []llm.ChatCompletionResponse{
+		toolCallResponse(newToolCall("call_1", "legacy", "{}")),
+		textResponse("done"),
+	}}
+	s = &Swarm{client: client}
+	resp, err = s.RunWithOptions(context.Background(), newTestAgent("researcher", legacyFunction{}), []llm.Message{{Role: llm.RoleUser, Content: "look it up"}})
+	if err != nil || client.requests[1].Messages[3].Content != "legacy result" {
+		t.Errorf("expected the legacy function to run, got %v", err)
+	}
+}
+
+// legacyFunction implements AgentFunction without any optional interface
+type legacyFunction struct{}
+
+func (legacyFunction) GetID() string          { return "legacy" }
+func (legacyFunction) GetName() string        { return "legacy" }
+func (legacyFunction) GetDescription() string { return "" }
+func (legacyFunction) GetParameters() map[string]interface{} {
+	return map[string]interface{}{"type": "object"}
+}
+func (f legacyFunction) GetFunction() Function { return f.Work }
+func (legacyFunction) SetFunction(fn Function) {}
+func (legacyFunction) Work(args map[string]interface{}, contextVariables map[string]interface{}) Result {
+	return Result{Data: "legacy result"}
+}
+
+func TestSessionPersistsAcrossRestarts(t *testing.T) {
+	support := newTestAgent("support")
+	billing := newTestAgent("billing")
+	support.AddFunction(newTestFunction("transfer_to_billing", func(args map[string]interface{}, contextVariables map[string]interface{}) Result {
+		return Result{Data: "transferred", Agent: billing, ContextVariables: map[string]interface{}{"topic": "invoice"}}
+	}))
+
+	fileStore, err := NewFileSessionStore(t.TempDir())
+	if err != nil {
+		t.Fatalf("NewFileSessionStore returned error: %v", err)
+	}
+	db, err := sql.Open("sqlite", filepath.Join(t.TempDir(), "sessions.db"))
+	if err != nil {
+		t.Fatalf("sql.Open returned error: %v", err)
+	}
+	t.Cleanup(func() { db.Close() })
+	sqliteStore, err := NewSQLiteSessionStore(context.Background(), db)
+	if err != nil {
+		t.Fatalf("NewSQLiteSessionStore returned error: %v", err)
+	}
+	for name, store := range map[string]SessionStore{"memory": NewMemorySessionStore(), "file": fileStore, "sqlite": sqliteStore} {
+		t.Run(name, func(t *testing.T) {
+			ctx := context.Background()
+			client := &mockLLM{responses: []llm.ChatCompletionResponse{
+				toolCallResponse(newToolCall("call_1", "transfer_to_billing", "{}")),
+				textResponse("billing here"),
+				textResponse("it is paid"),
+			}}
+			s := &Swarm{client: client}
+
+			session, err := s.OpenSession(ctx, store, "user/42", support, billing)
+			if err != nil {
+				t.Fatalf("OpenSession returned error: %v", err)
+			}
+			if _, err := session.Send(ctx, "question about my invoice"); err != nil {
+				t.Fatalf("Send returned error: %v", err)
+			}
+
+			// A new process resumes the session from the store
+			resumed, err := s.OpenSession(ctx, store, "user/42", support, billing)
+			if err != nil {
+				t.Fatalf("OpenSession returned error: %v", err)
+			}
+			if resumed.Agent() != billing || resumed.ContextVariables()["topic"] != "invoice" || len(resumed.Messages()) != 4 {
+				t.Fatalf("expected the session to resume with billing, got %s with %d messages", resumed.Agent().GetName(), len(resumed.Messages()))
+			}
+			if _, err := resumed.Send(ctx, "is it paid?"); err != nil {
+				t.Fatalf("Send returned error: %v", err)
+			}
+			if last := client.requests[2].Messages; len(last) != 6 || last[2].ToolCalls == nil {
+				t.Errorf("expected the full history with tool calls to be sent, got %+v", last)
+			}
+			if resumed.Usage().Total.Requests != 3 {
+				t.Errorf("expected usage to accumulate, got %+v", resumed.Usage().Total)
+			}
+
+			// A failed run leaves the session unchanged
+			if _, err := resumed.Send(ctx, "anything else?"); err == nil || len(resumed.Messages()) != 6 {
+				t.Errorf("expected the failed turn to be dropped, got %v with %d messages", err, len(resumed.Messages()))
+			}
+
+			if err := store.Delete(ctx, "user/42"); err != nil {
+				t.Fatalf("Delete returned error: %v", err)
+			}
+			if _, err := store.Load(ctx, "user/42"); !errors.Is(err, ErrSessionNotFound) {
+				t.Errorf("expected ErrSessionNotFound after Delete, got %v", err)
+			}
+		})
+	}
+}
+
+func TestRunHandoffPayloadAndInputFilter(t *testing.T) {
+	billing := newTestAgent("billing")
+	transfer := NewTransferFunction(billing).
+		SetPayloadSchema(map[string]interface{}{
+			"type": "object",
+			"properties": map[string]interface{}{
+				"reason":   map[string]interface{}{"type": "string"},
+				"priority": map[string]interface{}{"type": "integer"},
+			},
+		}).
+		SetInputFilter(StripToolCalls())
+	lookup := newTestFunction("lookup", func(args map[string]interface{}, contextVariables map[string]interface{}) Result {
+		return Result{Data: "customer 42"}
+	})
+	triage := newTestAgent("triage", lookup, transfer)
+
+	client := &mockLLM{responses: []llm.ChatCompletionResponse{
+		toolCallResponse(newToolCall("call_1", "lookup", "{}")),
+		toolCallResponse(newToolCall("call_2", transfer.GetName(), `{"reason":"refund","priority":2}`)),
+		textResponse("billing here"),
+	}}
+	s := &Swarm{client: client}
+	resp, err := s.RunWithOptions(context.Background(), triage, []llm.Message{{Role: llm.RoleUser, Content: "refund please"}})
+	if err != nil {
+		t.Fatalf("RunWithOptions returned error: %v", err)
+	}
+
+	var payload struct {
+		Reason   string `json:"reason"`
+		Priority int    `json:"priority"`
+	}
+	if ok, err := DecodeHandoffPayload(resp.ContextVariables, &payload); !ok || err != nil || payload.Reason != "refund" || payload.Priority != 2 {
+		t.Errorf("expected the handoff payload, got %+v (%v, %v)", payload, ok, err)
+	}
+	if got := client.requests[1].Tools; len(got) != 2 || got[1].Function.Parameters == nil {
+		t.Errorf("expected the transfer tool to declare its payload schema, got %+v", got)
+	}
+	if got := client.requests[2].Messages; len(got) != 2 || got[1].Content != "refund please" {
+		t.Errorf("expected billing to see the conversation without tool chatter, got %+v", got)
+	}
+	if len(resp.Messages) != 5 || len(resp.View) != 2 {
+		t.Errorf("expected the response to keep every message and the filtered view, got %d and %d", len(resp.Messages), len(resp.View))
+	}
+
+	// The filter holds for the rest of a session
+	client = &mockLLM{responses: []llm.ChatCompletionResponse{
+		toolCallResponse(newToolCall("call_1", "lookup", "{}")),
+		toolCallResponse(newToolCall("call_2", transfer.GetName(), `{"reason":"refund"}`)),
+		textResponse("billing here"),
+		textResponse("you're welcome"),
+	}}
+	session, err := (&Swarm{client: client}).OpenSession(context.Background(), NewMemorySessionStore(), "filtered", triage, billing)
+	if err != nil {
+		t.Fatalf("OpenSession returned error: %v", err)
+	}
+	for _, text := range []string{"refund please", "thanks"} {
+		if _, err := session.Send(context.Background(), text); err != nil {
+			t.Fatalf("Send returned error: %v", err)
+		}
+	}
+	if got := client.requests[3].Messages; len(got) != 4 || got[1].Content != "refund please" || got[3].Content != "thanks" {
+		t.Errorf("expected billing to see the filtered conversation on the second send, got %+v", got)
+	}
+	if got := session.Messages(); len(got) != 8 {
+		t.Errorf("expected the session to keep the full transcript, got %d messages", len(got))
+	}
+
+	messages := []llm.Message{
+		{Role: llm.RoleUser, Content: "a"},
+		{Role: llm.RoleAssistant, ToolCalls: []llm.ToolCall{newToolCall("call_1", "lookup", "{}")}},
+		{Role: llm.RoleTool, Content: "b", ToolCallID: "call_1"},
+		{Role: llm.RoleAssistant, Content: "c"},
+	}
+	kept, _ := KeepLastMessages(2)(context.Background(), messages)
+	if len(kept) != 1 || kept[0].Content != "c" {
+		t.Errorf("expected orphaned tool results to be dropped, got %+v", kept)
+	}
+}
+
+func TestRunReturnToCaller(t *testing.T) {
+	refunds := newTestAgent("refunds")
+	billing := newTestAgent("billing")
+	triage := newTestAgent("triage")
+	billing.AddFunction(NewTransferFunction(refunds).SetReturnToCaller(true))
+	triage.AddFunction(NewTransferFunction(billing).SetReturnToCaller(true))
+
+	client := &mockLLM{responses: []llm.ChatCompletionResponse{
+		toolCallResponse(newToolCall("call_1", "TransferTobilling", "{}")),
+		toolCallResponse(newToolCall("call_2", "TransferTorefunds", "{}")),
+		toolCallResponse(newToolCall("call_3", ReturnToCallerTool, `{"result":"refund issued"}`)),
+		toolCallResponse(newToolCall("call_4", ReturnToCallerTool, `{"result":"refunded 20 EUR"}`)),
+		textResponse("your refund is on its way"),
+	}}
+	s := &Swarm{client: client}
+	resp, err := s.RunWithOptions(context.Background(), triage, []llm.Message{{Role: llm.RoleUser, Content: "refund please"}})
+	if err != nil {
+		t.Fatalf("RunWithOptions returned error: %v", err)
+	}
+	if resp.Agent != triage || len(resp.CallStack) != 0 {
+		t.Fatalf("expected control back at triage with an empty stack, got %s with %d callers", resp.Agent.GetName(), len(resp.CallStack))
+	}
+
+	hasReturn := func(req llm.ChatCompletionRequest) bool {
+		for _, tool := range req.Tools {
+			if tool.Function.Name == ReturnToCallerTool {
+				return true
+			}
+		}
+		return false
+	}
+	for i, want := range []bool{false, true, true, true, false} {
+		if got := hasReturn(client.requests[i]); got != want {
+			t.Errorf("request %d: expected return_to_caller offered=%v, got %v", i, want, got)
+		}
+	}
+	if result := resp.Messages[7].Content; !strings.Contains(result, "refunded 20 EUR") {
+		t.Errorf("expected the caller to receive the result, got %q", result)
+	}
+
+	// A run that stops inside a call reports the stack, and the next run resumes it
+	client = &mockLLM{responses: []llm.ChatCompletionResponse{
+		toolCallResponse(newToolCall("call_1", "TransferTobilling", "{}")),
+		textResponse("which invoice?"),
+		toolCallResponse(newToolCall("call_2", ReturnToCallerTool, `{"result":"done"}`)),
+		textResponse("all set"),
+	}}
+	s = &Swarm{client: client}
+	resp, err = s.RunWithOptions(context.Background(), triage, []llm.Message{{Role: llm.RoleUser, Content: "billing question"}})
+	if err != nil || resp.Agent != billing || len(resp.CallStack) != 1 || resp.CallStack[0] != triage {
+		t.Fatalf("expected billing to wait with triage on the stack, got %v", err)
+	}
+	resp, err = s.RunWithOptions(context.Background(), resp.Agent, []llm.Message{{Role: llm.RoleUser, Content: "the last one"}},
+		WithCallStack(resp.CallStack))
+	if err != nil || resp.Agent != triage || len(resp.CallStack) != 0 {
+		t.Errorf("expected the resumed run to return to triage, got %v", err)
+	}
+
+	// A caller gets its own view back after a filtered call returns
+	lookup := newTestFunction("lookup", func(args map[string]interface{}, contextVariables map[string]interface{}) Result {
+		return Result{Data: "customer 42"}
+	})
+	support := newTestAgent("support", lookup, NewTransferFunction(billing).SetReturnToCaller(true).SetInputFilter(StripToolCalls()))
+	hasContent := func(messages []llm.Message, content string) bool {
+		for _, msg := range messages {
+			if strings.Contains(msg.Content, content) {
+				return true
+			}
+		}
+		return false
+	}
+	client = &mockLLM{responses: []llm.ChatCompletionResponse{
+		toolCallResponse(newToolCall("call_1", "lookup", "{}")),
+		toolCallResponse(newToolCall("call_2", "TransferTobilling", "{}")),
+		toolCallResponse(newToolCall("call_3", ReturnToCallerTool, `{"result":"refund issued"}`)),
+		textResponse("your refund is on its way"),
+	}}
+	s = &Swarm{client: client}
+	resp, err = s.RunWithOptions(context.Background(), support, []llm.Message{{Role: llm.RoleUser, Content: "refund please"}})
+	if err != nil || resp.Agent != support {
+		t.Fatalf("expected control back at support, got %v", err)
+	}
+	if got := client.requests[2].Messages; hasContent(got, "customer 42") {
+		t.Errorf("expected billing to see the filtered conversation, got %+v", got)
+	}
+	if got := client.requests[3].Messages; !hasContent(got, "customer 42") || !hasContent(got, "refund issued") {
+		t.Errorf("expected support to see its own history and the result, got %+v", got)
+	}
+
+	// The caller's view survives a session send that ends inside the call
+	client = &mockLLM{responses: []llm.ChatCompletionResponse{
+		toolCallResponse(newToolCall("call_1", "lookup", "{}")),
+		toolCallResponse(newToolCall("call_2", "TransferTobilling", "{}")),
+		textResponse("which invoice?"),
+		toolCallResponse(newToolCall("call_3", ReturnToCallerTool, `{"result":"refund issued"}`)),
+		textResponse("your refund is on its way"),
+	}}
+	store := NewMemorySessionStore()
+	session, err := (&Swarm{client: client}).OpenSession(context.Background(), store, "call", support, billing)
+	if err != nil {
+		t.Fatalf("OpenSession returned error: %v", err)
+	}
+	if _, err := session.Send(context.Background(), "refund please"); err != nil {
+		t.Fatalf("Send returned error: %v", err)
+	}
+	session, err = (&Swarm{client: client}).OpenSession(context.Background(), store, "call", support, billing)
+	if err != nil {
+		t.Fatalf("OpenSession returned error: %v", err)
+	}
+	if _, err := session.Send(context.Background(), "the last one"); err != nil {
+		t.Fatalf("Send returned error: %v", err)
+	}
+	if got := client.requests[4].Messages; !hasContent(got, "customer 42") || !hasContent(got, "refund issued") {
+		t.Errorf("expected support to see its own history after the session resumed, got %+v", got)
+	}
+}
+
+func TestRunAgentAsTool(t *testing.T) {
+	type researchInput struct {
+		Topic string `json:"topic"`
+	}
+	researcher := newTestAgent("researcher")
+	research, err := NewAgentToolFor[researchInput](researcher, "Research a topic")
+	if err != nil {
+		t.Fatalf("NewAgentToolFor returned error: %v", err)
+	}
+	planner := newTestAgent("planner", research)
+
+	usage := func(prompt, completion int) llm.ChatCompletionResponse {
+		return llm.ChatCompletionResponse{Usage: llm.Usage{PromptTokens: prompt, CompletionTokens: completion, TotalTokens: prompt + completion}}
+	}
+	withUsage := func(resp, u llm.ChatCompletionResponse) llm.ChatCompletionResponse {
+		resp.Usage = u.Usage
+		return resp
+	}
+	client := &mockLLM{responses: []llm.ChatCompletionResponse{
+		withUsage(toolCallResponse(newToolCall("call_1", "Askresearcher", `{"topic":"tides"}`)), usage(10, 5)),
+		withUsage(textResponse("the moon causes tides"), usage(20, 8)),
+		withUsage(textResponse("plan: study the moon"), usage(30, 6)),
+	}}
+	s := &Swarm{client: client}
+	resp, err := s.RunWithOptions(context.Background(), planner, []llm.Message{{Role: llm.RoleUser, Content: "plan a lesson"}})
+	if err != nil {
+		t.Fatalf("RunWithOptions returned error: %v", err)
+	}
+
+	if resp.Agent != planner {
+		t.Errorf("expected control to stay with the planner, got %s", resp.Agent.GetName())
+	}
+	if got := client.requests[1].Messages; len(got) != 2 || got[1].Content != `{"topic":"tides"}` {
+		t.Errorf("expected the researcher to start with its own history, got %+v", got)
+	}
+	if result := resp.Messages[1]; result.Content != "the moon causes tides" {
+		t.Errorf("expected the final answer as the tool result, got %q", result.Content)
+	}
+	if len(resp.SubRuns) != 1 || resp.SubRuns[0].Agent != "researcher" || resp.SubRuns[0].ToolCallID != "call_1" || len(resp.SubRuns[0].Response.Messages) != 1 {
+		t.Fatalf("expected the nested run to be recorded, got %+v", resp.SubRuns)
+	}
+	if resp.Usage.Total.TotalTokens != 79 || resp.Usage.ByAgent["researcher"].Requests != 1 {
+		t.Errorf("expected nested usage in the total, got %+v", resp.Usage)
+	}
+	if props := research.GetParameters()["properties"].(map[string]interface{}); props["topic"] == nil {
+		t.Errorf("expected parameters derived from the input struct, got %+v", research.GetParameters())
+	}
+}
+
+func TestProviderRegistryCachesClients(t *testing.T) {
+	created := 0
+	registry := NewProviderRegistry()
+	registry.Register("FAKE", func(cfg llm.Config) (llm.LLM, error) {
+		created++
+		return &mockLLM{}, nil
+	})
+
+	a, _ := registry.Client("FAKE", "key-1")
+	b, _ := registry.Client("FAKE", "key-1")
+	c, _ := registry.Client("FAKE", "key-2")
+	if a != b || a == c || created != 2 {
+		t.Errorf("expected one client per key, created %d", created)
+	}
+	if _, err := registry.Client("MISSING", ""); !errors.Is(err, ErrUnknownProvider) {
+		t.Errorf("expected ErrUnknownProvider, got %v", err)
+	}
+}
+
+// concurrencyLLM answers after a short delay and records the highest number of requests in flight
+type concurrencyLLM struct {
+	mu       sync.Mutex
+	inFlight int
+	peak     int
+}
+
+func (c *concurrencyLLM) CreateChatCompletion(ctx context.Context, req llm.ChatCompletionRequest) (llm.ChatCompletionResponse, error) {
+	c.mu.Lock()
+	c.inFlight++
+	if c.inFlight > c.peak {
+		c.peak = c.inFlight
+	}
+	c.mu.Unlock()
+
+	time.Sleep(10 * time.Millisecond)
+
+	c.mu.Lock()
+	c.inFlight--
+	c.mu.Unlock()
+	return textResponse("done"), nil
+}
+
+func (c *concurrencyLLM) CreateChatCompletionStream(ctx context.Context, req llm.ChatCompletionRequest) (llm.ChatCompletionStream, error) {
+	return nil, fmt.Errorf("mock: streaming not supported")
+}
+
+func TestRunConcurrentRateLimits(t *testing.T) {
+	backend := &concurrencyLLM{}
+	registry := NewProviderRegistry()
+	registry.Register("FAKE", func(cfg llm.Config) (llm.LLM, error) {
+		return llm.WithRateLimiter(backend, cfg.RateLimiter), nil
+	})
+	registry.SetRateLimits("FAKE", "key", llm.RateLimits{RateLimit: llm.RateLimit{MaxInFlight: 2}})
+
+	// Two swarms with their own clients for the same key share the limit
+	configs := make(map[string]AgentConfig)
+	var swarms []*ConcurrentSwarm
+	for i := 0; i < 2; i++ {
+		client, err := registry.NewClient("FAKE", llm.Config{APIKey: "key"})
+		if err != nil {
+			t.Fatalf("NewClient returned error: %v", err)
+		}
+		swarms = append(swarms, &ConcurrentSwarm{Swarm: &Swarm{client: client}})
+	}
+	for i := 0; i < 4; i++ {
+		configs[fmt.Sprintf("agent%d", i)] = AgentConfig{
+			Agent:    newTestAgent(fmt.Sprintf("agent%d", i)),
+			Messages: []llm.Message{{Role: llm.RoleUser, Content: "go"}},
+			MaxTurns: 1,
+		}
+	}
+
+	var wg sync.WaitGroup
+	for _, cs := range swarms {
+		wg.Add(1)
+		go func(cs *ConcurrentSwarm) {
+			defer wg.Done()
+			for _, result := range cs.RunConcurrent(context.Background(), configs) {
+				if result.Error != nil {
+					t.Errorf("%s failed: %v", result.AgentName, result.Error)
+				}
+			}
+		}(cs)
+	}
+	wg.Wait()
+	if backend.peak != 2 {
+		t.Errorf("expected at most 2 requests in flight across swarms, got %d", backend.peak)
+	}
+
+	// The swarm's own cap limits how many runs execute at the same time
+	single := &concurrencyLLM{}
+	cs := &ConcurrentSwarm{Swarm: &Swarm{client: single}}
+	cs.SetMaxConcurrency(1)
+	if results := cs.RunConcurrent(context.Background(), configs); len(results) != 4 || single.peak != 1 {
+		t.Errorf("expected 4 runs executed one at a time, got %d runs and %d at once", len(results), single.peak)
+	}
+}
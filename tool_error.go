@@ -0,0 +1,156 @@
+package swarmgo
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+)
+
+// ErrToolTimeout is matched by the error of a tool call that exceeded its timeout
+var ErrToolTimeout = errors.New("tool call timed out")
+
+// ToolTimeoutError is the Result error of a tool call that exceeded its timeout
+type ToolTimeoutError struct {
+	ToolName string
+	Timeout  time.Duration
+}
+
+func (e *ToolTimeoutError) Error() string {
+	return fmt.Sprintf("tool %s timed out after %s", e.ToolName, e.Timeout)
+}
+
+// Is makes errors.Is(err, ErrToolTimeout) match
+func (e *ToolTimeoutError) Is(target error) bool {
+	return target == ErrToolTimeout
+}
+
+// ToolErrorMode defines how a failed tool call is handled
+type ToolErrorMode int
+
+const (
+	// ToolErrorReport sends the error back to the model as the tool result so it can retry
+	ToolErrorReport ToolErrorMode = iota
+	// ToolErrorFail stops the run and returns a *ToolError
+	ToolErrorFail
+	// ToolErrorRetry re-invokes the function up to MaxRetries times, then reports the error
+	ToolErrorRetry
+)
+
+// ToolErrorPolicy configures how tool failures are handled. It can be set on
+// the Swarm and overridden per agent.
+type ToolErrorPolicy struct {
+	Mode       ToolErrorMode
+	MaxRetries int // Extra attempts made in ToolErrorRetry mode
+}
+
+// ToolError describes a failed tool call
+type ToolError struct {
+	ToolName   string
+	ToolCallID string
+	Attempts   int // Number of times the function was invoked
+	Err        error
+}
+
+func (e *ToolError) Error() string {
+	return fmt.Sprintf("tool %s failed after %d attempt(s): %v", e.ToolName, e.Attempts, e.Err)
+}
+
+func (e *ToolError) Unwrap() error {
+	return e.Err
+}
+
+// toolErrorContent renders a tool error as the structured tool result sent to the model
+func toolErrorContent(toolErr *ToolError) string {
+	content, err := json.Marshal(map[string]interface{}{
+		"error":    toolErr.Err.Error(),
+		"tool":     toolErr.ToolName,
+		"attempts": toolErr.Attempts,
+	})
+	if err != nil {
+		return fmt.Sprintf("Error: %v", toolErr.Err)
+	}
+	return string(content)
+}
+
+// SetToolErrorPolicy sets the default tool error policy for all agents
+func (s *Swarm) SetToolErrorPolicy(policy ToolErrorPolicy) {
+	s.toolErrorPolicy = policy
+}
+
+// toolErrorPolicyFor returns the agent's policy, falling back to the Swarm default
+func (s *Swarm) toolErrorPolicyFor(agent Agent) ToolErrorPolicy {
+	if policy := agent.GetToolErrorPolicy(); policy != nil {
+		return *policy
+	}
+	return s.toolErrorPolicy
+}
+
+// callFunction invokes a tool through handler, retrying according to policy
+// until ctx is done. It returns the last result and the number of invocations
+// made.
+func callFunction(ctx context.Context, handler ToolHandler, inv ToolInvocation, policy ToolErrorPolicy) (Result, int) {
+	attempts := 0
+	for {
+		attempts++
+		result := handler(ctx, inv)
+		if result.Error == nil || policy.Mode != ToolErrorRetry || attempts > policy.MaxRetries || ctx.Err() != nil {
+			return result, attempts
+		}
+	}
+}
+
+// invokeFunction calls the function of inv, preferring its ContextFunction,
+// and enforces the function's timeout
+func invokeFunction(ctx context.Context, inv ToolInvocation) Result {
+	fn := inv.Function
+	call := func(ctx context.Context, contextVariables map[string]interface{}) Result {
+		if ctxFn := contextFunction(fn); ctxFn != nil {
+			return ctxFn(ctx, ToolCallInfo{
+				Agent:      inv.Agent.GetName(),
+				ToolName:   fn.GetName(),
+				ToolCallID: inv.ToolCall.ID,
+				Turn:       inv.Turn,
+			}, inv.Args, contextVariables)
+		}
+		return fn.GetFunction()(inv.Args, contextVariables)
+	}
+
+	timeout := functionTimeout(fn)
+	if timeout <= 0 {
+		return call(ctx, inv.ContextVariables)
+	}
+
+	callCtx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	// The call may outlive the timeout, so it gets its own copy of the context variables
+	contextVariables := make(map[string]interface{}, len(inv.ContextVariables))
+	mergeContextVariables(contextVariables, inv.ContextVariables)
+
+	done := make(chan Result, 1)
+	go func() {
+		done <- call(callCtx, contextVariables)
+	}()
+
+	select {
+	case result := <-done:
+		// The call finished in time, so its in-place changes are kept as for
+		// calls without a timeout
+		if inv.ContextVariables != nil {
+			for k := range inv.ContextVariables {
+				if _, ok := contextVariables[k]; !ok {
+					delete(inv.ContextVariables, k)
+				}
+			}
+			mergeContextVariables(inv.ContextVariables, contextVariables)
+		}
+		return result
+	case <-callCtx.Done():
+		if ctx.Err() != nil {
+			return Result{Error: ctx.Err()}
+		}
+		return Result{Error: &ToolTimeoutError{ToolName: fn.GetName(), Timeout: timeout}}
+	}
+}
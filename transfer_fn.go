@@ -6,6 +6,8 @@ type (
 	TransferFunction struct {
 		BaseFunction
 		TargetAgent Agent
+		inputFilter HandoffInputFilter // Shapes the history TargetAgent sees
+		mode        HandoffMode
 	}
 )
 
@@ -30,10 +32,42 @@ func (f *TransferFunction) tarnsferAgent(args map[string]interface{}, contextVar
 	fmt.Println("### tarnsferAgent:", args, " to: ", f.TargetAgent.GetName())
 	fmt.Println("")
 
-	return Result{
-		Agent: f.TargetAgent,
-		Data:  fmt.Sprintf("Transferring to %s", f.TargetAgent.GetName()),
+	result := Result{
+		Agent:       f.TargetAgent,
+		Data:        fmt.Sprintf("Transferring to %s", f.TargetAgent.GetName()),
+		InputFilter: f.inputFilter,
+		HandoffMode: f.mode,
 	}
+	if f.parameters != nil {
+		result.ContextVariables = map[string]interface{}{HandoffPayloadKey: args}
+	}
+	return result
+}
+
+// SetPayloadSchema makes the model send a payload, e.g. a reason, priority or
+// extracted fields, with the handoff. schema is a JSON schema object, such as
+// the Schema of ResponseFormatFor. The receiving agent finds the payload in the
+// context variables under HandoffPayloadKey; see DecodeHandoffPayload.
+func (f *TransferFunction) SetPayloadSchema(schema map[string]interface{}) *TransferFunction {
+	f.parameters = schema
+	return f
+}
+
+// SetReturnToCaller makes the transfer a call: the calling agent waits on the
+// run's call stack and TargetAgent gets a return_to_caller tool to hand the
+// conversation back with a result
+func (f *TransferFunction) SetReturnToCaller(returnToCaller bool) *TransferFunction {
+	f.mode = HandoffTransfer
+	if returnToCaller {
+		f.mode = HandoffCall
+	}
+	return f
+}
+
+// SetInputFilter controls what history TargetAgent sees after the handoff
+func (f *TransferFunction) SetInputFilter(filter HandoffInputFilter) *TransferFunction {
+	f.inputFilter = filter
+	return f
 }
 
 func (f *TransferFunction) GetID() string {
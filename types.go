@@ -9,12 +9,39 @@ type Response struct {
 	Messages         []llm.Message
 	Agent            Agent
 	ContextVariables map[string]interface{}
+	Terminated       bool            // Whether a tool ended the run via Result.Terminal
+	ToolErrors       []ToolError     // Tool calls that failed during the run
+	Usage            UsageReport     // Tokens used by the run's completions
+	CallStack        []Agent         // Agents waiting for a HandoffCall to return, innermost last
+	CallerViews      [][]llm.Message // What the CallStack agents saw when they made filtered calls; nil for unfiltered calls
+	SubRuns          []SubRun        // Nested runs made by agent tools; their usage is included in Usage
+	// View is the conversation the active agent sees after a filtered
+	// handoff, input messages included; nil when no filter was applied.
+	// Continue from View instead of the input and Messages so the filter
+	// stays in effect on later runs.
+	View []llm.Message
+
+	inputFilter HandoffInputFilter // Filter of the handoff made by a tool call
+	handoffMode HandoffMode        // Mode of the handoff made by a tool call
 }
 
 // Result represents the result of a function execution
 type Result struct {
-	Success bool        // Whether the function execution was successful
-	Data    interface{} // Any data returned by the function
-	Error   error       // Any error that occurred during execution
-	Agent   Agent       // Active agent
+	Success          bool                   // Whether the function execution was successful
+	Data             interface{}            // Any data returned by the function
+	Error            error                  // Any error that occurred during execution
+	Agent            Agent                  // Active agent
+	ContextVariables map[string]interface{} // Context variable updates merged into the run's context
+	Terminal         bool                   // Whether the run should end after this tool call
+	InputFilter      HandoffInputFilter     // Shapes the history Agent sees after the handoff
+	HandoffMode      HandoffMode            // How Agent takes over; HandoffTransfer by default
+	SubRun           *SubRun                // Nested run made by an agent tool
+}
+
+// mergeContextVariables copies every key of delta into contextVariables,
+// replacing existing values
+func mergeContextVariables(contextVariables, delta map[string]interface{}) {
+	for k, v := range delta {
+		contextVariables[k] = v
+	}
 }
@@ -0,0 +1,129 @@
+package swarmgo
+
+import (
+	"sort"
+
+	"github.com/wlevene/swarmgo/llm"
+)
+
+// Usage holds token counts summed over one or more completions
+type Usage struct {
+	Requests         int
+	PromptTokens     int
+	CompletionTokens int
+	TotalTokens      int
+}
+
+// Add returns the sum of u and other
+func (u Usage) Add(other Usage) Usage {
+	return Usage{
+		Requests:         u.Requests + other.Requests,
+		PromptTokens:     u.PromptTokens + other.PromptTokens,
+		CompletionTokens: u.CompletionTokens + other.CompletionTokens,
+		TotalTokens:      u.TotalTokens + other.TotalTokens,
+	}
+}
+
+// fromLLMUsage converts the usage of a single completion
+func fromLLMUsage(usage llm.Usage) Usage {
+	total := usage.TotalTokens
+	if total == 0 {
+		total = usage.PromptTokens + usage.CompletionTokens
+	}
+	return Usage{
+		Requests:         1,
+		PromptTokens:     usage.PromptTokens,
+		CompletionTokens: usage.CompletionTokens,
+		TotalTokens:      total,
+	}
+}
+
+// UsageReport breaks token usage down by agent and by model
+type UsageReport struct {
+	Total   Usage
+	ByAgent map[string]Usage
+	ByModel map[string]Usage
+}
+
+// Record adds the usage of a completion made by agent with model
+func (r *UsageReport) Record(agent, model string, usage llm.Usage) {
+	r.add(agent, model, fromLLMUsage(usage))
+}
+
+func (r *UsageReport) add(agent, model string, usage Usage) {
+	if r.ByAgent == nil {
+		r.ByAgent = make(map[string]Usage)
+	}
+	if r.ByModel == nil {
+		r.ByModel = make(map[string]Usage)
+	}
+	r.Total = r.Total.Add(usage)
+	r.ByAgent[agent] = r.ByAgent[agent].Add(usage)
+	r.ByModel[model] = r.ByModel[model].Add(usage)
+}
+
+// Merge adds every count of other to r
+func (r *UsageReport) Merge(other UsageReport) {
+	if r.ByAgent == nil {
+		r.ByAgent = make(map[string]Usage)
+	}
+	if r.ByModel == nil {
+		r.ByModel = make(map[string]Usage)
+	}
+	r.Total = r.Total.Add(other.Total)
+	for agent, usage := range other.ByAgent {
+		r.ByAgent[agent] = r.ByAgent[agent].Add(usage)
+	}
+	for model, usage := range other.ByModel {
+		r.ByModel[model] = r.ByModel[model].Add(usage)
+	}
+}
+
+// ModelPrice is the price of a model in currency units per million tokens
+type ModelPrice struct {
+	PromptPerMillion     float64
+	CompletionPerMillion float64
+}
+
+// Cost returns the price of usage at p
+func (p ModelPrice) Cost(usage Usage) float64 {
+	return float64(usage.PromptTokens)*p.PromptPerMillion/1e6 +
+		float64(usage.CompletionTokens)*p.CompletionPerMillion/1e6
+}
+
+// PricingTable maps model names to their prices. Prices change often, so no
+// table is built in; load one from your provider's price list.
+type PricingTable map[string]ModelPrice
+
+// CostEstimate is the estimated cost of a UsageReport
+type CostEstimate struct {
+	Total    float64
+	ByModel  map[string]float64
+	Unpriced []string // Models used but missing from the pricing table
+}
+
+// EstimateCost prices the report's per-model usage with pricing
+func (r UsageReport) EstimateCost(pricing PricingTable) CostEstimate {
+	estimate := CostEstimate{ByModel: make(map[string]float64)}
+	for model, usage := range r.ByModel {
+		price, ok := pricing[model]
+		if !ok {
+			estimate.Unpriced = append(estimate.Unpriced, model)
+			continue
+		}
+		cost := price.Cost(usage)
+		estimate.ByModel[model] = cost
+		estimate.Total += cost
+	}
+	sort.Strings(estimate.Unpriced)
+	return estimate
+}
+
+// ConcurrentUsage sums the usage of concurrent agent runs
+func ConcurrentUsage(results []ConcurrentResult) UsageReport {
+	var report UsageReport
+	for _, result := range results {
+		report.Merge(result.Response.Usage)
+	}
+	return report
+}
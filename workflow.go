@@ -57,6 +57,8 @@ type Workflow struct {
 	stepResults   []StepResult                        // Track results of each step
 	currentStep   int                                 // Current step number
 	visualHook    VisualizationHook                   // Add visualization hook
+	runOptions    []RunOption                         // Applied to every agent run
+	budget        *Budget                             // Shared by every agent run
 }
 
 // VisualizationHook defines the interface for workflow visualization
@@ -71,7 +73,19 @@ type VisualizationHook interface {
 
 // NewWorkflow initializes a new Workflow instance.
 func NewWorkflow(apikey string, provider llm.LLMProvider, workflowType WorkflowType) *Workflow {
-	swarm := NewSwarm(apikey, provider)
+	return newWorkflow(NewSwarm(apikey, provider), workflowType)
+}
+
+// NewWorkflowFromConfig initializes a new Workflow whose default client is built from cfg.
+func NewWorkflowFromConfig(cfg ClientConfig, workflowType WorkflowType) (*Workflow, error) {
+	swarm, err := NewSwarmFromConfig(cfg)
+	if err != nil {
+		return nil, err
+	}
+	return newWorkflow(swarm, workflowType), nil
+}
+
+func newWorkflow(swarm *Swarm, workflowType WorkflowType) *Workflow {
 	return &Workflow{
 		swarm:         swarm,
 		agents:        make(map[string]Agent),
@@ -96,6 +110,17 @@ func (wf *Workflow) SetCycleHandling(handling CycleHandling) {
 	wf.cycleHandling = handling
 }
 
+// SetRunOptions sets options applied to every agent run, after the workflow defaults
+func (wf *Workflow) SetRunOptions(opts ...RunOption) {
+	wf.runOptions = opts
+}
+
+// SetBudget limits the workflow as a whole. When a limit is crossed, Execute
+// returns the partial WorkflowResult with an error matching ErrBudgetExceeded.
+func (wf *Workflow) SetBudget(budget *Budget) {
+	wf.budget = budget
+}
+
 // SetVisualizationHook sets the visualization hook for the workflow
 func (wf *Workflow) SetVisualizationHook(hook VisualizationHook) {
 	wf.visualHook = hook
@@ -199,8 +224,10 @@ func (wf *Workflow) Execute(startAgent string, userRequest string) (*WorkflowRes
 
 		// Execute current agent
 		fmt.Printf("\033[96mExecuting agent: %s (Step %d)\033[0m\n", wf.currentAgent, stepResult.StepNumber)
-		response, err := wf.executeAgent(wf.currentAgent, messageHistory)
+		response, usage, err := wf.executeAgent(wf.currentAgent, messageHistory)
 		stepResult.EndTime = time.Now()
+		stepResult.Usage = usage
+		result.Usage.Merge(usage)
 
 		// Notify visualization of agent completion
 		if wf.visualHook != nil {
@@ -209,9 +236,11 @@ func (wf *Workflow) Execute(startAgent string, userRequest string) (*WorkflowRes
 
 		if err != nil {
 			stepResult.Error = err
+			stepResult.Output = response
 			result.Steps = append(result.Steps, stepResult)
 			result.Error = err
 			result.EndTime = time.Now()
+			result.FinalOutput = append(messageHistory, response...)
 			return result, err
 		}
 
@@ -312,7 +341,7 @@ func (wf *Workflow) GetLastStepResult() (*StepResult, error) {
 }
 
 // executeAgent executes a single agent and manages its state
-func (wf *Workflow) executeAgent(agentName string, messageHistory []llm.Message) ([]llm.Message, error) {
+func (wf *Workflow) executeAgent(agentName string, messageHistory []llm.Message) ([]llm.Message, UsageReport, error) {
 	agent := wf.agents[agentName]
 	fmt.Printf("\033[95mAgent %s processing message...\033[0m\n", agentName)
 
@@ -325,20 +354,15 @@ func (wf *Workflow) executeAgent(agentName string, messageHistory []llm.Message)
 	}
 
 	// Execute agent
-	response, err := wf.swarm.Run(
-		context.Background(),
-		agent,
-		messageHistory,
-		state,
-		"",
-		false,
-		true,
-		0,
-		true,
-	)
+	opts := append([]RunOption{
+		WithContextVariables(state),
+		WithDebug(true),
+		WithBudget(wf.budget),
+	}, wf.runOptions...)
+	response, err := wf.swarm.RunWithOptions(context.Background(), agent, messageHistory, opts...)
 	if err != nil {
 		fmt.Printf("\033[91mError executing agent %s: %v\033[0m\n", agentName, err)
-		return nil, err
+		return response.Messages, response.Usage, err
 	}
 
 	fmt.Printf("\033[92mAgent %s completed processing\033[0m\n", agentName)
@@ -350,7 +374,7 @@ func (wf *Workflow) executeAgent(agentName string, messageHistory []llm.Message)
 		wf.agentStates[agentName] = state
 	}
 
-	return response.Messages, nil
+	return response.Messages, response.Usage, nil
 }
 
 // routeToNextAgent determines the next agent based on workflow type and message content
@@ -697,6 +721,7 @@ type StepResult struct {
 	EndTime    time.Time
 	NextAgent  string
 	StepNumber int
+	Usage      UsageReport // Tokens used by the step's completions
 }
 
 // WorkflowResult represents the complete workflow execution result
@@ -706,4 +731,5 @@ type WorkflowResult struct {
 	Error       error
 	StartTime   time.Time
 	EndTime     time.Time
+	Usage       UsageReport // Tokens used by every step
 }